@@ -2,10 +2,15 @@
 package cache
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/shibukawa/configdir"
 
@@ -33,52 +38,264 @@ func init() {
 // TODO: get:			download from online storage
 // TODO: free:		delete from cache (not online storage)
 // TODO: remove:	delete from cache (if exists) and online storage
-// ---------------------------------------------------------------
-// TODO: read:		decrypt for ram or local filesystem
 
-// Write analyzes, encrypts, and compresses a new file into the cache
+// Write analyzes, encrypts, and compresses a new file into the cache, returning its Entry
+// The Entry's Checksum covers the encrypted data so it can be verified on its way to and from storage
+// Unless padding is stream.NoPadding, compressed data is padded as it describes before
+// it is encrypted, so the size stored hides the file's own
 // NOTE: this will overwrite the data currently existing in cache for this entity
-func Write(ctx context.Context, pc *secure.PassphraseContainer, parentID string, path string) error {
+func Write(ctx context.Context, pc *secure.PassphraseContainer, parentID string, path string, padding stream.Padding) (*cloud.Entry, error) {
 	srcFile, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer srcFile.Close()
 
 	kc, err := secure.GenerateKeyContainer()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	keyStr, err := secure.EncryptWithSaltToString(pc, kc.Buffer())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	entry, err := fileToEntry(ctx, srcFile, parentID, keyStr)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	entry.Padding = padding
 
 	cacheFile, err := cacheConfig.Create(entry.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer cacheFile.Close()
 
 	// streamToFile is expected to close srcFile and cacheFile
-	if err := streamToFile(ctx, srcFile, cacheFile, kc); err != nil {
-		return err
+	checksum := cloud.NewChecksum()
+	if err := streamToFile(ctx, srcFile, cacheFile, checksum, kc, padding); err != nil {
+		return nil, err
 	}
+	entry.Checksum = checksum.String()
 
 	// TODO: add metadata to bolt
 
-	// TODO: produce checksum of file data
-
 	// TODO: add entry to each storage provider for upload
 
+	return entry, nil
+}
+
+// Read decrypts and decompresses entry's cached data to w, removing any padding Write added
+// Padding that is not exactly as entry's scheme pads fails with stream.ErrPadding
+func Read(ctx context.Context, pc *secure.PassphraseContainer, entry cloud.Entry, w io.Writer) error {
+	cacheFile, err := cacheConfig.Open(entry.ID)
+	if err != nil {
+		return err
+	}
+	defer cacheFile.Close()
+
+	kc, err := secure.DecryptWithSaltFromStringToKey(pc, entry.Key)
+	if err != nil {
+		return err
+	}
+	defer kc.Destroy()
+
+	return unseal(ctx, kc, entry, cacheFile, w)
+}
+
+// unseal decrypts, unpads if entry was padded, and decompresses data written by Write from r to w
+func unseal(ctx context.Context, kc *secure.KeyContainer, entry cloud.Entry, r io.Reader, w io.Writer) error {
+	var stages []func(io.Reader, io.Writer) error
+	stages = append(stages, func(r io.Reader, w io.Writer) error {
+		_, err := stream.Decrypt(ctx, kc, r, w)
+		return err
+	})
+	if entry.Padding != stream.NoPadding {
+		stages = append(stages, func(r io.Reader, w io.Writer) error {
+			_, err := stream.Unpad(entry.Padding, r, w)
+			return err
+		})
+	}
+	stages = append(stages, func(r io.Reader, w io.Writer) error {
+		_, err := stream.Decompress(r, w)
+		return err
+	})
+	return pipeline(r, w, stages...)
+}
+
+// WriteChunked splits a new file into content-defined chunks, encrypting and compressing
+// each into store unless an identical chunk is there already, and returns its Entry
+// Chunks are cut and named by keyed hashes of their plaintext under kc, the archive key, so
+// copies of the same data deduplicate across files without revealing anything about them. The
+// Entry lists its chunks in place of holding data, so only an empty file is cached for it
+// NOTE: release the Entry's chunks from store once the Entry is deleted
+func WriteChunked(ctx context.Context, store *cloud.ChunkStore, kc *secure.KeyContainer, parentID string, path string) (*cloud.Entry, error) {
+	srcFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+
+	entry, err := fileToEntry(ctx, srcFile, parentID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	chunker := stream.NewChunker(srcFile)
+	chunker.Gear = stream.KeyedGearTable(kc) // otherwise chunk sizes would hint at the data
+	for {
+		chunk, err := chunker.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			ref := cloud.ChunkRef{ID: hex.EncodeToString(secure.KeyedHash(kc, chunk)), Size: int64(len(chunk))}
+			_, err = store.Put(ctx, ref.ID, func() ([]byte, error) {
+				return sealChunk(ctx, kc, chunk)
+			})
+			if err == nil {
+				entry.Chunks = append(entry.Chunks, ref)
+			}
+		}
+		if err != nil {
+			store.Release(ctx, *entry) // best effort; unreleased references only keep chunks around
+			return nil, err
+		}
+	}
+	if err := store.Flush(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := cacheConfig.WriteFile(entry.ID, nil); err != nil {
+		return nil, err
+	}
+	entry.Checksum = cloud.NewChecksum().String()
+	return entry, nil
+}
+
+// ReadChunked writes the plaintext of an Entry written by WriteChunked to w, fetching
+// each of its chunks from store
+// Chunks whose plaintext does not match the keyed hash naming them fail with cloud.ErrIntegrity
+func ReadChunked(ctx context.Context, store *cloud.ChunkStore, kc *secure.KeyContainer, entry cloud.Entry, w io.Writer) error {
+	for _, ref := range entry.Chunks {
+		rc, err := store.Get(ctx, ref.ID)
+		if err != nil {
+			return err
+		}
+		sealed, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+
+		chunk, err := unsealChunk(ctx, kc, sealed)
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(secure.KeyedHash(kc, chunk)) != ref.ID {
+			return cloud.ErrIntegrity
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// sealChunk compresses and encrypts a chunk
+func sealChunk(ctx context.Context, kc *secure.KeyContainer, chunk []byte) ([]byte, error) {
+	var compressed, sealed bytes.Buffer
+	if _, err := stream.Compress(bytes.NewReader(chunk), &compressed); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Encrypt(ctx, kc, &compressed, &sealed); err != nil {
+		return nil, err
+	}
+	return sealed.Bytes(), nil
+}
+
+// unsealChunk decrypts and decompresses a chunk
+func unsealChunk(ctx context.Context, kc *secure.KeyContainer, sealed []byte) ([]byte, error) {
+	var compressed, chunk bytes.Buffer
+	if _, err := stream.Decrypt(ctx, kc, bytes.NewReader(sealed), &compressed); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Decompress(&compressed, &chunk); err != nil {
+		return nil, err
+	}
+	return chunk.Bytes(), nil
+}
+
+// Put adds data received from cloud storage to the cache without any modifications
+// Data that does not match entry's checksum is refused with cloud.ErrIntegrity and
+// never replaces what is already cached
+func Put(entry cloud.Entry, rc io.ReadCloser) error {
+	defer rc.Close()
+
+	if err := cacheConfig.MkdirAll(); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(cacheConfig.Path, "."+entry.ID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	defer tmp.Close()           // backup in case we don't reach tmp.Close
+
+	checksum := cloud.NewChecksum()
+	if _, err := io.Copy(io.MultiWriter(tmp, checksum), rc); err != nil {
+		return err
+	}
+	if entry.Checksum != "" && checksum.String() != entry.Checksum {
+		return cloud.ErrIntegrity
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(cacheConfig.Path, entry.ID))
+}
+
+// Fetch downloads entry's data from client into the cache
+// Data in cold storage returns cloud.ErrRestorePending while it is being restored;
+// call Fetch again later to check on it, or use Await
+func Fetch(ctx context.Context, client cloud.Client, entry cloud.Entry) error {
+	rc, err := client.Download(ctx, entry)
+	if err != nil {
+		return err
+	}
+	return Put(entry, rc)
+}
+
+// Await fetches entry's data into the cache, checking back every interval while it is restored from cold storage
+// Cancelling ctx stops the waiting but not the restore, so a later Await or Fetch picks up where this left off
+func Await(ctx context.Context, client cloud.Client, entry cloud.Entry, interval time.Duration) error {
+	for {
+		err := Fetch(ctx, client, entry)
+		if !errors.Is(err, cloud.ErrRestorePending) {
+			return err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Get returns a cached file; caller responsible for closing
+// This is best used for providing cloud storage the bytes to transmit
+func Get(id string) (*os.File, error) {
+	return cacheConfig.Open(id)
+}
+
 func fileToEntry(ctx context.Context, file *os.File, parentID, keyStr string) (*cloud.Entry, error) {
 	info, err := file.Stat()
 	if err != nil {
@@ -102,43 +319,26 @@ func fileToEntry(ctx context.Context, file *os.File, parentID, keyStr string) (*
 	return entry, nil
 }
 
-// streamToFile compresses and encrypts contents as a stream from src to dst then closes src and dst once done
-func streamToFile(ctx context.Context, src, dst *os.File, kc *secure.KeyContainer) error {
-	streamCtx, cancelCtx := context.WithCancel(ctx)
-
-	pcr, pcw := io.Pipe()
-	errChan := make(chan error, 5)
-	go func() {
-		if _, err := stream.Compress(src, pcw); err != nil {
-			errChan <- err
-			cancelCtx()
-		}
-		if err := pcw.Close(); err != nil {
-			errChan <- err
-		}
-	}()
-
-	per, pew := io.Pipe()
-	go func() {
-		if _, err := stream.Encrypt(streamCtx, kc, pcr, pew); err != nil {
-			errChan <- err
-			cancelCtx()
-		}
-		if err := pew.Close(); err != nil {
-			errChan <- err
-		}
-	}()
-
-	if _, err := io.Copy(dst, per); err != nil {
-		errChan <- err
-	}
-	close(errChan)
-
-	var err error // starting as nil
-	for errFromChan := range errChan {
-		err = errors.New(err.Error() + "; " + errFromChan.Error())
+// streamToFile compresses, pads unless padding is stream.NoPadding, and encrypts contents
+// as a stream from src to dst then closes src and dst once done
+// Encrypted data is also written to checksum as it passes through
+func streamToFile(ctx context.Context, src, dst *os.File, checksum io.Writer, kc *secure.KeyContainer, padding stream.Padding) error {
+	var stages []func(io.Reader, io.Writer) error
+	stages = append(stages, func(r io.Reader, w io.Writer) error {
+		_, err := stream.Compress(r, w)
+		return err
+	})
+	if padding != stream.NoPadding {
+		stages = append(stages, func(r io.Reader, w io.Writer) error {
+			_, err := stream.Pad(padding, r, w)
+			return err
+		})
 	}
-	if err != nil {
+	stages = append(stages, func(r io.Reader, w io.Writer) error {
+		_, err := stream.Encrypt(ctx, kc, r, w)
+		return err
+	})
+	if err := pipeline(src, io.MultiWriter(dst, checksum), stages...); err != nil {
 		return err
 	}
 
@@ -152,6 +352,42 @@ func streamToFile(ctx context.Context, src, dst *os.File, kc *secure.KeyContaine
 	return src.Close()
 }
 
+// pipeline streams src through each stage in turn to dst, each stage running alongside
+// the others; errors from every stage that failed are joined together
+func pipeline(src io.Reader, dst io.Writer, stages ...func(io.Reader, io.Writer) error) error {
+	errChan := make(chan error, 2*len(stages))
+	r := src
+	for i, stage := range stages {
+		if i == len(stages)-1 {
+			if err := stage(r, dst); err != nil {
+				errChan <- err
+			}
+			break
+		}
+
+		pr, pw := io.Pipe()
+		go func(stage func(io.Reader, io.Writer) error, r io.Reader) {
+			err := stage(r, pw)
+			if err != nil {
+				errChan <- err
+			}
+			pw.CloseWithError(err) // later stages see the failure rather than a short stream
+		}(stage, r)
+		r = pr
+		defer pr.Close() // unblocks earlier stages should a later one stop reading
+	}
+
+	var err error // starting as nil
+	for len(errChan) > 0 {
+		if errFromChan := <-errChan; err == nil {
+			err = errFromChan
+		} else {
+			err = errors.New(err.Error() + "; " + errFromChan.Error())
+		}
+	}
+	return err
+}
+
 // generateID returns a randomly generated ID for use in a new Entry
 func generateID() string {
 	return "temp" // TODO: actually generate something
@@ -163,34 +399,6 @@ func generateID() string {
 // 	return nil
 // }
 
-// // Put adds a file to the cache without any modifications
-// // This is best used with data received from cloud storage
-// // TODO: update to use cache path
-// func Put(path string, rc io.ReadCloser) (err error) {
-// 	file, err := os.Create(path)
-// 	if err != nil {
-// 		return
-// 	}
-// 	defer file.Close() // backup in case we don't reach file.Sync
-
-// 	if _, err = io.Copy(file, rc); err != nil {
-// 		return err
-// 	}
-
-// 	if err := rc.Close(); err != nil {
-// 		return err
-// 	}
-
-// 	return file.Sync()
-// }
-
-// // Get returns readCloser to a cached file; caller responsible for closing
-// // This is best used for providing cloud storage the bytes to transmit
-// // TODO: update to use cache path
-// func Get(path string) (*os.File, error) {
-// 	return os.Open(path)
-// }
-
 // // seal compresses and encrypts a file at provided path, writing it to the cache
 // // TODO: Do not receive key; already have it
 // func seal(path string, kc *secure.KeyContainer) error {
@@ -1,11 +1,24 @@
 package cache_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jonathan-robertson/lockedarchive/cache"
+	"github.com/jonathan-robertson/lockedarchive/cloud"
 	"github.com/jonathan-robertson/lockedarchive/secure"
+	"github.com/jonathan-robertson/lockedarchive/stream"
 )
 
 const (
@@ -27,9 +40,290 @@ func setup(t *testing.T) {
 
 func TestWrite(t *testing.T) {
 	setup(t)
-	if err := cache.Write(context.Background(), pc, parentID, srcFilePath); err != nil {
+	entry, err := cache.Write(context.Background(), pc, parentID, srcFilePath, stream.NoPadding)
+	if err != nil {
 		t.Fatal(err)
 	}
+
+	file, err := cache.Get(entry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	checksum := cloud.NewChecksum()
+	if _, err := io.Copy(checksum, file); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Checksum == "" || entry.Checksum != checksum.String() {
+		t.Fatalf("entry checksum %q does not match cached data %q", entry.Checksum, checksum)
+	}
+}
+
+func TestRead(t *testing.T) {
+	setup(t)
+	expected, err := ioutil.ReadFile(srcFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, padding := range []stream.Padding{stream.NoPadding, stream.PowerOfTwo} {
+		entry, err := cache.Write(context.Background(), pc, parentID, srcFilePath, padding)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := cache.Read(context.Background(), pc, *entry, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("read back %d bytes not matching the %d written with padding %d", buf.Len(), len(expected), padding)
+		}
+
+		if padding == stream.PowerOfTwo {
+			file, err := cache.Get(entry.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := file.Stat()
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks := (info.Size() + stream.DecryptionChunkSize - 1) / stream.DecryptionChunkSize
+			padded := info.Size() - chunks*(stream.DecryptionChunkSize-stream.EncryptionChunkSize)
+			if padded&(padded-1) != 0 {
+				t.Errorf("expected data padded to a power of two before encryption, found %d bytes", padded)
+			}
+		}
+	}
+}
+
+// servingPresigner links to an Entry's cached data as served by a local server
+type servingPresigner struct {
+	url string
+}
+
+func (presigner servingPresigner) PresignDownload(entry cloud.Entry, expires time.Duration) (string, error) {
+	return presigner.url + "/" + entry.ID, nil
+}
+
+func TestShare(t *testing.T) {
+	setup(t)
+	expected, err := ioutil.ReadFile(srcFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.Write(context.Background(), pc, parentID, srcFilePath, stream.Padme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tamper bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := cache.Get(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+		data, _ := ioutil.ReadAll(file)
+		if tamper {
+			data = data[:len(data)-1]
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	share, err := cache.NewShare(pc, servingPresigner{url: server.URL}, *entry, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(share.Capsule, entry.Name) {
+		t.Error("expected the capsule to keep the entry's name secret")
+	}
+
+	t.Run("Open", func(t *testing.T) {
+		var buf bytes.Buffer
+		shared, err := cache.OpenShare(context.Background(), share.URL, share.Capsule, share.Secret, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("opened %d bytes not matching the %d shared", buf.Len(), len(expected))
+		}
+		if shared.Name != entry.Name || shared.Key != "" {
+			t.Errorf("expected the entry's metadata without its wrapped key, received %+v", shared)
+		}
+	})
+	t.Run("WrongSecret", func(t *testing.T) {
+		other, err := cache.NewShare(pc, servingPresigner{url: server.URL}, *entry, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.OpenShare(context.Background(), share.URL, share.Capsule, other.Secret, ioutil.Discard); err == nil {
+			t.Error("expected a capsule not to open with another share's secret")
+		}
+	})
+	t.Run("Tampered", func(t *testing.T) {
+		tamper = true
+		defer func() { tamper = false }()
+		if _, err := cache.OpenShare(context.Background(), share.URL, share.Capsule, share.Secret, ioutil.Discard); err == nil {
+			t.Error("expected truncated data to be refused")
+		}
+	})
+}
+
+func TestPut(t *testing.T) {
+	data := []byte("encrypted data received from storage")
+	checksum := cloud.NewChecksum()
+	checksum.Write(data)
+	entry := cloud.Entry{ID: "put", Checksum: checksum.String()}
+
+	t.Run("Valid", func(t *testing.T) {
+		if err := cache.Put(entry, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		assertCached(t, entry.ID, data)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		corrupted := append([]byte("x"), data[1:]...)
+		if err := cache.Put(entry, ioutil.NopCloser(bytes.NewReader(corrupted))); err != cloud.ErrIntegrity {
+			t.Fatalf("expected %v, got %v", cloud.ErrIntegrity, err)
+		}
+		assertCached(t, entry.ID, data) // previously cached data is untouched
+	})
+}
+
+// restoringClient reports its data as being restored a set number of times before serving it
+type restoringClient struct {
+	cloud.Client
+	pending int
+	data    []byte
+}
+
+func (client *restoringClient) Download(ctx context.Context, entry cloud.Entry) (io.ReadCloser, error) {
+	if client.pending > 0 {
+		client.pending--
+		return nil, cloud.ErrRestorePending
+	}
+	return ioutil.NopCloser(bytes.NewReader(client.data)), nil
+}
+
+func TestAwait(t *testing.T) {
+	client := &restoringClient{pending: 2, data: []byte("data restored from cold storage")}
+	entry := cloud.Entry{ID: "await"}
+
+	if err := cache.Fetch(context.Background(), client, entry); !errors.Is(err, cloud.ErrRestorePending) {
+		t.Fatalf("expected %v, got %v", cloud.ErrRestorePending, err)
+	}
+	if err := cache.Await(context.Background(), client, entry, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	assertCached(t, entry.ID, client.data)
+}
+
+func TestWriteChunked(t *testing.T) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	dir, err := ioutil.TempDir("", "lockedarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := cloud.LocalClient(filepath.Join(dir, "archive"))
+	if err := local.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store := &cloud.ChunkStore{Client: local, Key: kc}
+
+	// A scan, and a copy of it re-imported with a cover page added
+	scan := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(1)).Read(scan)
+	copied := append([]byte("cover page"), scan...)
+	write := func(name string, data []byte) *cloud.Entry {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := cache.WriteChunked(context.Background(), store, kc, parentID, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+	read := func(entry *cloud.Entry, expected []byte) {
+		var buf bytes.Buffer
+		if err := cache.ReadChunked(context.Background(), store, kc, *entry, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("read back %d bytes not matching the %d written", buf.Len(), len(expected))
+		}
+	}
+	chunkObjects := func() int {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, "archive"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		for _, info := range infos {
+			if !info.IsDir() && info.Name() != "chunk~refs" {
+				count++
+			}
+		}
+		return count
+	}
+
+	original := write("scan.pdf", scan)
+	stored := chunkObjects()
+	duplicate := write("scan copy.pdf", copied)
+	added := chunkObjects() - stored
+	if len(original.Chunks) < 2 || added > 2 {
+		t.Errorf("expected the copy to share all but its first chunk or so, %d of %d chunks were new", added, len(duplicate.Chunks))
+	}
+	read(original, scan)
+	read(duplicate, copied)
+
+	if err := store.Release(context.Background(), *original); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	read(duplicate, copied) // shared chunks survive
+
+	if err := store.Release(context.Background(), *duplicate); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := chunkObjects(); remaining != 0 {
+		t.Errorf("expected every chunk to be collected, %d remain", remaining)
+	}
+}
+
+func assertCached(t *testing.T, id string, expected []byte) {
+	file, err := cache.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	actual, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("expected cached data %q, got %q", expected, actual)
+	}
 }
 
 /// OLD BELOW ///
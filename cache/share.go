@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+var (
+	errShareChunked = errors.New("deduplicated entries cannot be shared; their data is spread across chunks")
+	errShareNoKey   = errors.New("entry has no key of its own to share")
+)
+
+// Share hands one Entry to someone without giving them the archive: a link to its encrypted
+// data, and a capsule holding what decrypts it, sealed with a secret made for this share alone
+// Send Secret by a different channel than URL and Capsule; anyone with all three can read the data
+type Share struct {
+	URL     string    `json:"url"`     // pre-signed link to the Entry's encrypted data
+	Expires time.Time `json:"expires"` // when URL stops working
+	Capsule string    `json:"capsule"` // the data's key and the Entry's metadata, sealed with Secret
+	Secret  string    `json:"-"`       // opens Capsule
+}
+
+// capsule is what Share.Capsule seals
+type capsule struct {
+	Key   []byte      `json:"key"`   // key the Entry's data was encrypted with
+	Entry cloud.Entry `json:"entry"` // without its Key, which only the archive's passphrase opens
+}
+
+// NewShare shares an Entry written by Write for expires, through a link presigner signs
+// The data's key is unwrapped with pc, the passphrase it was written with, and wrapped again
+// under a new secret, so the recipient never learns the passphrase or any other key
+func NewShare(pc *secure.PassphraseContainer, presigner cloud.Presigner, entry cloud.Entry, expires time.Duration) (*Share, error) {
+	switch {
+	case len(entry.Chunks) > 0:
+		return nil, errShareChunked
+	case entry.Key == "":
+		return nil, errShareNoKey
+	}
+
+	url, err := presigner.PresignDownload(entry, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	kc, err := secure.DecryptWithSaltFromStringToKey(pc, entry.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer kc.Destroy()
+	secret, err := secure.GenerateKeyContainer()
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Destroy()
+
+	shared := entry
+	shared.Key = ""
+	plaintext, err := json.Marshal(capsule{Key: kc.Buffer(), Entry: shared})
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := secure.GenerateNonce()
+	if err != nil {
+		secure.Wipe(plaintext)
+		return nil, err
+	}
+
+	return &Share{
+		URL:     url,
+		Expires: time.Now().Add(expires),
+		Capsule: base64.RawURLEncoding.EncodeToString(secure.EncryptAndWipe(secret, nonce, plaintext)),
+		Secret:  base64.RawURLEncoding.EncodeToString(secret.Buffer()),
+	}, nil
+}
+
+// OpenShare downloads a shared Entry's data from url and writes it to w, decrypted with the
+// key in capsule; returns the Entry's metadata so its name and mode can be restored
+// Data that does not match the Entry's checksum fails with cloud.ErrIntegrity, though some
+// of it may have been written to w by then
+func OpenShare(ctx context.Context, url, sealed, secret string, w io.Writer) (*cloud.Entry, error) {
+	contents, err := openCapsule(sealed, secret)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := secure.ProtectKey(contents.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer kc.Destroy()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("share could not be downloaded: %s", resp.Status) // expired links return 403 Forbidden
+	}
+
+	checksum := cloud.NewChecksum()
+	if err := unseal(ctx, kc, contents.Entry, io.TeeReader(resp.Body, checksum), w); err != nil {
+		return nil, err
+	}
+	if contents.Entry.Checksum != "" && checksum.String() != contents.Entry.Checksum {
+		return nil, cloud.ErrIntegrity
+	}
+	return &contents.Entry, nil
+}
+
+// openCapsule decrypts a Share's capsule with its secret
+func openCapsule(sealed, secret string) (*capsule, error) {
+	key, err := base64.RawURLEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := secure.ProtectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer kc.Destroy()
+
+	ciphertext, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := secure.Decrypt(kc, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer secure.Wipe(plaintext)
+
+	var contents capsule
+	if err := json.Unmarshal(plaintext, &contents); err != nil {
+		return nil, err
+	}
+	return &contents, nil
+}
@@ -1,20 +1,70 @@
 package cloud
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+const (
+	defaultRegion = "us-east-1"
+
+	checksumSHA256Header = "X-Amz-Checksum-Sha256"
+	contentSHA256Header  = "X-Amz-Content-Sha256" // hex SHA-256 of the payload, used in signing
+)
+
+var (
+	errInvalidCACert        = errors.New("no certificates could be parsed from CA cert")
+	errCredentialsDestroyed = errors.New("credentials have been destroyed")
 )
 
 // AS3 is used to access AWS S3 services in a way that satisfies the Client interface
+// Setting Endpoint allows it to reach S3-compatible services (MinIO, Wasabi, Ceph)
 type AS3 struct {
 	Bucket string
-	Region string
+	Region string // defaults to us-east-1
+
+	Endpoint  string // URL of an S3-compatible service; empty for AWS
+	PathStyle bool   // address bucket in URL path (endpoint/bucket/key) instead of host name
+	CACert    []byte // PEM-encoded certificates to trust in addition to system roots
+
+	PartSize    int64  // bytes per multipart upload part; defaults to 8 MiB, minimum 5 MiB
+	Concurrency int    // number of parts to upload in parallel; defaults to 4
+	StateDir    string // directory (normally the cache folder) for resumable upload state
+
+	StorageClass string       // storage class for uploads without one of their own; defaults to STANDARD
+	Transitions  []Transition // lifecycle rules moving data to colder storage classes as it ages
+	RestoreDays  int64        // days restored data stays readable; defaults to 7
+	RestoreTier  string       // speed (and price) of restores: Expedited, Standard or Bulk; defaults to Standard
+
+	Lock   *ObjectLock // if set, CreateArchive creates the bucket with object lock, retaining data as it describes
+	Harden bool        // if set, CreateArchive blocks public access, encrypts at rest by default, requires TLS and aborts abandoned uploads
+
+	AccessKey *secure.SecretContainer // credentials to sign requests with; the default AWS credential chain is used
+	SecretKey *secure.SecretContainer // when either is nil. Caller owns both and destroys them once done with the client
+
+	Key *secure.KeyContainer // archive key used to encrypt Entry metadata; metadata is not stored without it
+
+	// NOTE: connection settings (Region through CACert, and credentials) are read once, on first use
+	mutex   sync.Mutex
+	service *s3.S3 // shared by every call, so the SDK session and its connections are reused
 }
 
 // AS3Client returns a new Client
@@ -26,155 +76,484 @@ func AS3Client(bucketName, region string) (client Client) {
 }
 
 // CreateArchive creates a new Bucket responsible for storing data
-func (client AS3) CreateArchive() error {
-	_, err := client.svc().CreateBucket(&s3.CreateBucketInput{
+func (client *AS3) CreateArchive(ctx context.Context) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	input := &s3.CreateBucketInput{
 		Bucket: aws.String(client.Bucket),
+	}
+	if region := client.region(); region != defaultRegion { // us-east-1 refuses its own name as a constraint
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+	if client.Lock != nil {
+		err = client.createLockedBucket(ctx, svc, input)
+	} else {
+		_, err = svc.CreateBucketWithContext(ctx, input)
+		err = evalErr(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep every revision so overwritten or deleted data can be restored
+	_, err = svc.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{
+		Bucket: aws.String(client.Bucket),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
 	})
-	return evalErr(err)
+	if err != nil {
+		return evalErr(err)
+	}
+
+	if client.Harden {
+		if err := client.harden(ctx, svc); err != nil {
+			return err
+		}
+	}
+	if len(client.Transitions) > 0 || client.Harden {
+		return client.PutLifecycle(ctx)
+	}
+	return nil
 }
 
-// RemoveArchive removes the LockedArchive Bucket
-// TODO: How should this work? Seems pretty unsafe
-func (client AS3) RemoveArchive() error {
+// RemoveArchive removes the LockedArchive Bucket; errors with ErrArchiveNotEmpty if anything
+// is left in it, including old versions. Use PlanRemoval and PurgeArchive to empty it first
+func (client *AS3) RemoveArchive(ctx context.Context) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
 	input := &s3.DeleteBucketInput{
 		Bucket: aws.String(client.Bucket),
 	}
-	_, err := client.svc().DeleteBucket(input)
-	// TODO: current design here will error if there are any objcts within bucket
-	// Perhaps we want this behavior for now, exposing another func for delete all obj
-	// or maybe not. bool could be passed into RemoveArchive to confirm if we want to
-	// delete containing objects
+	_, err = svc.DeleteBucketWithContext(ctx, input)
 	return evalErr(err)
 }
 
 // List collects all list data for the given bucket; closes Entry chan when done
-func (client AS3) List(entries chan Entry) error {
+func (client *AS3) List(ctx context.Context, entries chan Entry) error {
 	defer close(entries)
+
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(client.Bucket),
 	}
-	return evalErr(client.svc().ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+	err = svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 		for _, obj := range page.Contents {
-			entries <- Entry{
-				Key:          aws.StringValue(obj.Key),
+			if isMetaSidecar(aws.StringValue(obj.Key)) {
+				continue
+			}
+			select {
+			case entries <- Entry{
+				ID:           aws.StringValue(obj.Key),
 				Size:         aws.Int64Value(obj.Size),
 				LastModified: aws.TimeValue(obj.LastModified),
+			}:
+			case <-ctx.Done():
+				return false
 			}
 		}
 		return aws.BoolValue(page.IsTruncated)
-	}))
+	})
+	if err == nil {
+		err = ctx.Err() // listing stopped early
+	}
+	return evalErr(err)
 }
 
 // Upload sends an Entry to S3, along with its body and properties
-func (client AS3) Upload(entry Entry, file *os.File) error {
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(client.Bucket),
-		Key:    aws.String(entry.Key),
-		Body:   aws.ReadSeekCloser(file),
-		// Tagging: aws.String("key1=value1&key2=value2"), // TODO: add this in later
+// Files larger than PartSize are sent as a resumable multipart upload
+func (client *AS3) Upload(ctx context.Context, entry Entry, file File) error {
+	return client.upload(ctx, entry, file, "", func(svc *s3.S3) (map[string]*string, error) {
+		return client.encodeMeta(ctx, svc, entry)
+	})
+}
+
+// upload stores entry's data along with the user metadata encode returns
+// sealed is the encrypted metadata encode stores, if given rather than encrypted from entry
+func (client *AS3) upload(ctx context.Context, entry Entry, file File, sealed string, encode func(*s3.S3) (map[string]*string, error)) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
 	}
-	result, err := client.svc().PutObject(input)
+
+	info, err := file.Stat()
 	if err != nil {
-		return evalErr(err)
+		return err
 	}
+	// Data is metered as it is sent (see meterBody) rather than as file is read, which
+	// happens ahead of sending it and again for any retry
+	markSending(ctx)
 
-	// REVIEW: result returns ETag
-	// NOTE: this may indicate that the system did not perform a hash on the contents (!)
-	fmt.Printf("%+v\n", result)
+	metadata, err := encode(svc)
+	if err != nil {
+		return err
+	}
 
-	return evalErr(err)
+	if info.Size() > client.partSize() {
+		var fingerprint string
+		if fingerprint, err = client.uploadFingerprint(entry, sealed); err != nil {
+			return err
+		}
+		return client.uploadMultipart(ctx, svc, entry, file, info, metadata, fingerprint)
+	}
+	return client.putObject(ctx, svc, entry, file, metadata)
+}
+
+// putObject sends file to S3 in a single request
+func (client *AS3) putObject(ctx context.Context, svc *s3.S3, entry Entry, file File, metadata map[string]*string) error {
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(client.Bucket),
+		Key:          aws.String(entry.ID),
+		Body:         aws.ReadSeekCloser(file),
+		Metadata:     metadata,
+		StorageClass: client.storageClass(entry),
+		Tagging:      tagging(entry),
+	}
+	req, _ := svc.PutObjectRequest(input)
+	req.SetContext(ctx)
+	meterBody(ctx, req)
+	if entry.Checksum != "" {
+		// S3 rejects the upload if the data it receives doesn't match
+		req.HTTPRequest.Header.Set(checksumSHA256Header, entry.Checksum)
+		// Signing needs the same hash; providing it spares reading file an extra time
+		if sum, err := base64.StdEncoding.DecodeString(entry.Checksum); err == nil {
+			req.HTTPRequest.Header.Set(contentSHA256Header, hex.EncodeToString(sum))
+		}
+	}
+	return evalErr(req.Send())
+}
+
+// meterBody has req's body limited and counted as it is sent, each time it is sent, by the
+// Transfer uploading through ctx; does nothing if there is none
+func meterBody(ctx context.Context, req *request.Request) {
+	m := sendMeter(ctx)
+	if m == nil {
+		return
+	}
+	req.Handlers.Send.PushFront(func(r *request.Request) {
+		if r.HTTPRequest.ContentLength > 0 {
+			r.HTTPRequest.Body = m.readCloser(r.HTTPRequest.Body)
+		}
+	})
 }
 
 // Download fetches entry's data from S3 and Puts it in cache
-func (client AS3) Download(entry Entry) (io.ReadCloser, error) {
+// Reading the data to the end returns ErrIntegrity instead of io.EOF if it does not match its checksum
+// Data in cold storage has a restore started for it, with ErrRestorePending returned until it is readable
+func (client *AS3) Download(ctx context.Context, entry Entry) (io.ReadCloser, error) {
+	svc, err := client.svc()
+	if err != nil {
+		return nil, err
+	}
+
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(client.Bucket),
-		Key:    aws.String(entry.Key),
+		Key:    aws.String(entry.ID),
 	}
 
-	result, err := client.svc().GetObject(input)
+	result, err := svc.GetObjectWithContext(ctx, input)
+	if err = evalErr(err); errors.Is(err, ErrArchived) {
+		return nil, client.requestRestore(ctx, svc, entry)
+	}
 	if err != nil {
-		return nil, evalErr(err)
+		return nil, err
 	}
 
-	fmt.Println(result.String()) // TODO: remove
-
 	if aws.Int64Value(result.ContentLength) == 0 {
 		// TODO: return error? does this even matter? Dirs will be size 0...
 	}
 
-	return result.Body, nil
-
-	// TODO: Confirm checksum matches ETAG
+	// Prefer the checksum from entry's (authenticated) metadata over the one stored alongside the data
+	expected := entry.Checksum
+	if expected == "" {
+		expected = aws.StringValue(result.Metadata[checksumHeader])
+	}
+	return verify(result.Body, expected), nil
 }
 
-// Head
-func (client AS3) Head(entry Entry) error {
-	input := &s3.HeadObjectInput{
+// DownloadRange fetches length bytes of entry's data from S3, starting at offset
+// Reading past the end of the data returns only the bytes available
+// Data in cold storage has a restore started for it, with ErrRestorePending returned until it is readable
+func (client *AS3) DownloadRange(ctx context.Context, entry Entry, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 1 {
+		return nil, errInvalidRange
+	}
+
+	svc, err := client.svc()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(client.Bucket),
-		Key:    aws.String(entry.Key),
+		Key:    aws.String(entry.ID),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
 	}
 
-	result, err := client.svc().HeadObject(input)
+	result, err := svc.GetObjectWithContext(ctx, input)
+	if err = evalErr(err); errors.Is(err, ErrArchived) {
+		return nil, client.requestRestore(ctx, svc, entry)
+	}
 	if err != nil {
-		return evalErr(err)
+		return nil, err
 	}
 
-	entry.LastModified = aws.TimeValue(result.LastModified)
+	return result.Body, nil
+}
+
+// Head fills in entry with the properties and decrypted metadata stored with its object
+func (client *AS3) Head(ctx context.Context, entry *Entry) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	result, err := client.head(ctx, svc, entry)
+	if err != nil {
+		return err
+	}
 	// TODO: if result.ETag differs from local checksum, remove cached version
-	// TODO: receive tags
 
-	// Metadata map[string]*string `location:"headers" locationName:"x-amz-meta-" type:"map"`
+	return client.decodeMeta(ctx, svc, entry, result.Metadata)
+}
 
-	fmt.Printf("lameta: %s\n", aws.StringValue(result.Metadata["lameta"]))
+// head fills in entry's properties from its object, returning the object's user metadata
+func (client *AS3) head(ctx context.Context, svc *s3.S3, entry *Entry) (*s3.HeadObjectOutput, error) {
+	result, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(entry.ID),
+	})
+	if err != nil {
+		return nil, evalErr(err)
+	}
 
-	return nil
+	entry.Size = aws.Int64Value(result.ContentLength)
+	entry.LastModified = aws.TimeValue(result.LastModified)
+	entry.StorageClass = aws.StringValue(result.StorageClass)
+	if entry.StorageClass == "" {
+		entry.StorageClass = StorageClassStandard // S3 leaves out the header for STANDARD
+	}
+	return result, nil
 }
 
-//
-func (client AS3) Update(entry Entry) error {
+// Update replaces the encrypted metadata stored with an Entry (name, parent, tags)
+// The object is copied onto itself on S3, so its data is not uploaded again
+// NOTE: data in Glacier or Deep Archive must be restored first, or ErrArchived is returned
+// NOTE: metadata too large for the object's headers is written to a sidecar object of its
+// own each time, which is kept until PurgeArchive (earlier revisions may still refer to it),
+// so every such Update leaves one more sidecar behind
+func (client *AS3) Update(ctx context.Context, entry Entry) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	stored, err := client.headStored(ctx, svc, entry)
+	if err != nil {
+		return err
+	}
+	metadata, err := client.encodeMeta(ctx, svc, entry)
+	if err != nil {
+		return err
+	}
+
+	// Copying would otherwise reset the storage class to STANDARD
+	storageClass := client.storageClass(entry)
+	if entry.StorageClass == "" && stored.StorageClass != nil {
+		storageClass = stored.StorageClass
+	}
+
+	_, err = svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(client.Bucket),
+		Key:               aws.String(entry.ID),
+		CopySource:        aws.String(client.copySource(entry, "")),
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		StorageClass:      storageClass,
+	})
+	return evalErr(err)
 }
 
 // Delete removes an Entry from S3
-func (client AS3) Delete(entry Entry) error {
+// Data under a legal hold or still within its retention period returns ErrLocked, and is left as is
+// NOTE: object lock only keeps revisions from being removed; S3 would accept the delete by
+// hiding the Entry behind a delete marker. If client has a Lock, the object is headed first
+// to refuse that instead, which is advisory: a hold placed in between goes unnoticed
+func (client *AS3) Delete(ctx context.Context, entry Entry) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	if client.Lock != nil {
+		_, lock, err := client.headLocked(ctx, svc, entry)
+		if err != nil {
+			return err
+		}
+		if err := lock.err(entry, time.Now()); err != nil {
+			return err
+		}
+	}
+
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(client.Bucket),
-		Key:    aws.String(entry.Key),
+		Key:    aws.String(entry.ID),
+	}
+
+	_, err = svc.DeleteObjectWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && refusedByLock(aerr.Code(), requestStatus(err)) {
+		return wrapErr(ErrLocked, aerr.Code(), err)
+	}
+	return evalErr(err)
+}
+
+func (client *AS3) svc() (*s3.S3, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.service != nil {
+		return client.service, nil
+	}
+
+	config := &aws.Config{
+		Region:           aws.String(client.region()),
+		S3ForcePathStyle: aws.Bool(client.PathStyle),
+	}
+	if client.Endpoint != "" {
+		config.Endpoint = aws.String(client.Endpoint)
+	}
+	if client.AccessKey != nil && client.SecretKey != nil {
+		config.Credentials = credentials.NewCredentials(&secretProvider{
+			accessKey: client.AccessKey,
+			secretKey: client.SecretKey,
+		})
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(client.CACert) > 0 {
+		// Set after the session is made, which would otherwise swap in any AWS_CA_BUNDLE instead
+		httpClient, err := httpClientWithCACert(client.CACert)
+		if err != nil {
+			return nil, err
+		}
+		sess.Config.HTTPClient = httpClient
+	}
+	client.service = s3.New(sess)
+	return client.service, nil
+}
+
+func (client *AS3) region() string {
+	if client.Region == "" {
+		return defaultRegion
 	}
+	return client.Region
+}
 
-	_, err := client.svc().DeleteObject(input)
-	err = evalErr(err)
-	return err
+// secretProvider hands the SDK credentials kept in protected memory
+// They are read again for every request so plaintext copies are short-lived,
+// and a client stops working once its containers are destroyed
+type secretProvider struct {
+	accessKey *secure.SecretContainer
+	secretKey *secure.SecretContainer
+}
+
+func (provider *secretProvider) Retrieve() (credentials.Value, error) {
+	if provider.accessKey.IsDestroyed() || provider.secretKey.IsDestroyed() {
+		return credentials.Value{}, errCredentialsDestroyed
+	}
+	return credentials.Value{
+		AccessKeyID:     string(provider.accessKey.Buffer()),
+		SecretAccessKey: string(provider.secretKey.Buffer()),
+		ProviderName:    "lockedarchive",
+	}, nil
 }
 
-func (client AS3) svc() *s3.S3 {
-	return s3.New(session.New(&aws.Config{
-		Region: aws.String("us-east-1"),
-	}))
+func (provider *secretProvider) IsExpired() bool {
+	return true
 }
 
-// evalErr surfaces more info from an error and returns it
+// httpClientWithCACert returns an http.Client trusting caCert along with the system's roots
+func httpClientWithCACert(caCert []byte) (*http.Client, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errInvalidCACert
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// evalErr classifies an error from S3 as one of the kinds of failure every Client reports
 func evalErr(err error) error {
 	if err == nil {
 		return nil
 	}
 
-	// TODO: type switch instead of this??
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
 
-	if aerr, ok := err.(awserr.Error); ok {
-		switch aerr.Code() {
-		case s3.ErrCodeBucketAlreadyExists:
-			return fmt.Errorf("%s: %s", s3.ErrCodeBucketAlreadyExists, aerr.Error())
-		case s3.ErrCodeBucketAlreadyOwnedByYou:
-			return fmt.Errorf("%s: %s", s3.ErrCodeBucketAlreadyOwnedByYou, aerr.Error())
-		case s3.ErrCodeNoSuchKey:
-			return fmt.Errorf("%s: %s", s3.ErrCodeNoSuchKey, aerr.Error())
-		default:
-			return aerr
+	switch aerr.Code() {
+	case request.CanceledErrorCode:
+		if aerr.OrigErr() != nil {
+			return wrapErr(aerr.OrigErr(), aerr.Code(), err) // context.Canceled or context.DeadlineExceeded
+		}
+	case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchUpload, "NoSuchVersion", "NotFound":
+		return wrapErr(ErrNotFound, aerr.Code(), err)
+	case s3.ErrCodeNoSuchBucket:
+		return wrapErr(ErrArchiveNotFound, aerr.Code(), err)
+	case s3.ErrCodeBucketAlreadyExists, s3.ErrCodeBucketAlreadyOwnedByYou:
+		return wrapErr(ErrArchiveExists, aerr.Code(), err)
+	case "BucketNotEmpty":
+		return wrapErr(ErrArchiveNotEmpty, aerr.Code(), err)
+	case lockedErrCode:
+		if refusedByLock(aerr.Code(), requestStatus(err)) {
+			return wrapErr(ErrLocked, aerr.Code(), err) // S3's own refusal to remove a protected revision
 		}
+	case "AccessDenied", "AllAccessDisabled", "AccountProblem", "InvalidAccessKeyId",
+		"SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+		return wrapErr(ErrAccessDenied, aerr.Code(), err)
+	case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded",
+		"RequestTimeout", "InternalError", "ServiceUnavailable", "OperationAborted",
+		"RequestError", request.ErrCodeResponseTimeout, request.ErrCodeRead:
+		return wrapErr(ErrTransient, aerr.Code(), err)
+	case "BadDigest", "InvalidDigest", "XAmzContentChecksumMismatch":
+		return wrapErr(ErrIntegrity, aerr.Code(), err)
+	case "InvalidObjectState", s3.ErrCodeObjectNotInActiveTierError:
+		return wrapErr(ErrArchived, aerr.Code(), err)
+	case "RestoreAlreadyInProgress":
+		return wrapErr(ErrRestorePending, aerr.Code(), err)
 	}
 
-	return err
+	// Fall back on the HTTP status for codes not listed above
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		switch status := rerr.StatusCode(); {
+		case status == http.StatusNotFound:
+			return wrapErr(ErrNotFound, aerr.Code(), err)
+		case status == http.StatusForbidden:
+			return wrapErr(ErrAccessDenied, aerr.Code(), err)
+		case status == http.StatusTooManyRequests, status >= http.StatusInternalServerError:
+			return wrapErr(ErrTransient, aerr.Code(), err)
+		}
+	}
+	return wrapErr(nil, aerr.Code(), err)
 }
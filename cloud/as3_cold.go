@@ -0,0 +1,143 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Storage classes for AS3.StorageClass, Entry.StorageClass and Transition
+// Data in Glacier or Deep Archive must be restored before it can be downloaded
+const (
+	StorageClassStandard    = "STANDARD"
+	StorageClassStandardIA  = "STANDARD_IA"
+	StorageClassGlacierIR   = "GLACIER_IR" // instant retrieval; no restore needed
+	StorageClassGlacier     = "GLACIER"
+	StorageClassDeepArchive = "DEEP_ARCHIVE"
+)
+
+const (
+	// Data objects are tagged so lifecycle rules skip sidecar metadata and control objects
+	// (see isControlID), which must stay readable
+	dataTag     = "lockedarchive=data"
+	dataTagKey  = "lockedarchive"
+	dataTagName = "data"
+
+	transitionRuleID = "lockedarchive-transitions"
+
+	defaultRestoreDays = 7
+	defaultRestoreTier = s3.TierStandard
+)
+
+// Transition moves data to a cheaper storage class once it reaches an age
+type Transition struct {
+	Days         int64  `json:"days"`
+	StorageClass string `json:"storage_class"`
+}
+
+// PutLifecycle applies the client's Transitions to its bucket, along with the rule aborting
+// abandoned uploads when Harden is set; without either, the bucket's lifecycle rules are removed
+// CreateArchive calls this for new archives
+func (client *AS3) PutLifecycle(ctx context.Context) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	var rules []*s3.LifecycleRule
+	if len(client.Transitions) > 0 {
+		rules = append(rules, client.transitionRule())
+	}
+	if client.Harden {
+		rules = append(rules, abortMultipartRule())
+	}
+	if len(rules) == 0 {
+		_, err = svc.DeleteBucketLifecycleWithContext(ctx, &s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(client.Bucket),
+		})
+		return evalErr(err)
+	}
+
+	_, err = svc.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(client.Bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	return evalErr(err)
+}
+
+// transitionRule moves data, but not sidecar metadata, along the client's Transitions
+func (client *AS3) transitionRule() *s3.LifecycleRule {
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(transitionRuleID),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{
+			Tag: &s3.Tag{Key: aws.String(dataTagKey), Value: aws.String(dataTagName)},
+		},
+	}
+	for _, transition := range client.Transitions {
+		rule.Transitions = append(rule.Transitions, &s3.Transition{
+			Days:         aws.Int64(transition.Days),
+			StorageClass: aws.String(transition.StorageClass),
+		})
+		// Versioning keeps replaced data around; move it along the same way
+		rule.NoncurrentVersionTransitions = append(rule.NoncurrentVersionTransitions, &s3.NoncurrentVersionTransition{
+			NoncurrentDays: aws.Int64(transition.Days),
+			StorageClass:   aws.String(transition.StorageClass),
+		})
+	}
+	return rule
+}
+
+// requestRestore asks S3 to bring entry's archived data back for RestoreDays
+// Always returns an error: ErrRestorePending once the restore has begun
+func (client *AS3) requestRestore(ctx context.Context, svc *s3.S3, entry Entry) error {
+	_, err := svc.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(entry.ID),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(client.restoreDays()),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(client.restoreTier())},
+		},
+	})
+	if err = evalErr(err); err == nil || errors.Is(err, ErrRestorePending) {
+		return ErrRestorePending
+	}
+	return err
+}
+
+// storageClass returns the storage class to store entry's data with
+func (client *AS3) storageClass(entry Entry) *string {
+	switch {
+	case isControlID(entry.ID):
+		return aws.String(StorageClassStandard)
+	case entry.StorageClass != "":
+		return aws.String(entry.StorageClass)
+	case client.StorageClass != "":
+		return aws.String(client.StorageClass)
+	}
+	return aws.String(StorageClassStandard)
+}
+
+// tagging returns the tags to store entry's object with: the data tag, unless it is a control object
+func tagging(entry Entry) *string {
+	if isControlID(entry.ID) {
+		return nil
+	}
+	return aws.String(dataTag)
+}
+
+func (client *AS3) restoreDays() int64 {
+	if client.RestoreDays < 1 {
+		return defaultRestoreDays
+	}
+	return client.RestoreDays
+}
+
+func (client *AS3) restoreTier() string {
+	if client.RestoreTier == "" {
+		return defaultRestoreTier
+	}
+	return client.RestoreTier
+}
@@ -0,0 +1,160 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	abortMultipartRuleID = "lockedarchive-abort-multipart"
+	abortMultipartDays   = 7 // long enough for an interrupted upload to be resumed
+
+	policyVersion = "2012-10-17"
+)
+
+// policyDocument is an AWS access policy, for a bucket or an IAM user
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Principal string                       `json:"Principal,omitempty"`
+	Action    []string                     `json:"Action"`
+	Resource  []string                     `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+// harden applies the baseline CreateArchive gives a bucket when Harden is set: public access
+// blocked, data encrypted at rest by default and reachable only over TLS
+// Versioning and the lifecycle rule aborting abandoned uploads are applied along with the rest
+func (client *AS3) harden(ctx context.Context, svc *s3.S3) error {
+	req := svc.NewRequest(&request.Operation{
+		Name:       "PutPublicAccessBlock",
+		HTTPMethod: http.MethodPut,
+		HTTPPath:   "/{Bucket}?publicAccessBlock",
+	}, &putPublicAccessBlockInput{
+		Bucket: aws.String(client.Bucket),
+		PublicAccessBlockConfiguration: &publicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	}, nil)
+	if err := sendWithMD5(ctx, req); err != nil {
+		return evalErr(err)
+	}
+
+	// Data is encrypted before it leaves, but this keeps anything else put here from sitting in the clear
+	req, _ = svc.PutBucketEncryptionRequest(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String(client.Bucket),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{{
+				ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+					SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+				},
+			}},
+		},
+	})
+	req.SetContext(ctx)
+	addContentMD5(req)
+	if err := req.Send(); err != nil {
+		return evalErr(err)
+	}
+
+	policy, err := json.Marshal(policyDocument{
+		Version: policyVersion,
+		Statement: []policyStatement{{
+			Sid:       "DenyInsecureTransport",
+			Effect:    "Deny",
+			Principal: "*",
+			Action:    []string{"s3:*"},
+			Resource:  client.resources(),
+			Condition: map[string]map[string]string{"Bool": {"aws:SecureTransport": "false"}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutBucketPolicyWithContext(ctx, &s3.PutBucketPolicyInput{
+		Bucket: aws.String(client.Bucket),
+		Policy: aws.String(string(policy)),
+	})
+	return evalErr(err)
+}
+
+// abortMultipartRule removes the parts of uploads abandoned for longer than any resume would wait
+func abortMultipartRule() *s3.LifecycleRule {
+	return &s3.LifecycleRule{
+		ID:     aws.String(abortMultipartRuleID),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+		AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(abortMultipartDays),
+		},
+	}
+}
+
+// IAMPolicy returns an IAM policy, as JSON, granting only what day-to-day use of the client's
+// bucket needs; attach it to the user whose access keys the client is given
+// Creating, removing or purging the archive, deleting old revisions, and placing or lifting
+// legal holds are left out, so keys that leak cannot destroy what versioning keeps nor lift a
+// hold to delete held data; use broader credentials for those
+func (client *AS3) IAMPolicy() ([]byte, error) {
+	resources := client.resources()
+	return json.MarshalIndent(policyDocument{
+		Version: policyVersion,
+		Statement: []policyStatement{
+			{
+				Sid:    "ListArchive",
+				Effect: "Allow",
+				Action: []string{
+					"s3:GetBucketLocation",
+					"s3:ListBucket",
+					"s3:ListBucketVersions",
+					"s3:ListBucketMultipartUploads",
+				},
+				Resource: resources[:1],
+			},
+			{
+				Sid:    "UseEntries",
+				Effect: "Allow",
+				Action: []string{
+					"s3:GetObject",
+					"s3:GetObjectVersion",
+					"s3:GetObjectTagging",
+					"s3:PutObject",
+					"s3:PutObjectTagging",
+					"s3:DeleteObject",
+					"s3:RestoreObject",
+					"s3:ListMultipartUploadParts",
+					"s3:AbortMultipartUpload",
+					"s3:GetObjectLegalHold",
+				},
+				Resource: resources[1:],
+			},
+		},
+	}, "", "  ")
+}
+
+// resources returns the ARNs of the client's bucket and of every object in it
+func (client *AS3) resources() []string {
+	partition := "aws"
+	switch region := client.region(); {
+	case strings.HasPrefix(region, "cn-"):
+		partition = "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		partition = "aws-us-gov"
+	}
+	bucket := "arn:" + partition + ":s3:::" + client.Bucket
+	return []string{bucket, bucket + "/*"}
+}
@@ -0,0 +1,311 @@
+package cloud
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/restxml"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Retention modes for ObjectLock
+// Governance can be bypassed by users granted s3:BypassGovernanceRetention; compliance by no one,
+// not even the account's root user, until the retention period ends
+const (
+	RetentionGovernance = "GOVERNANCE"
+	RetentionCompliance = "COMPLIANCE"
+)
+
+const (
+	objectLockEnabledHeader   = "X-Amz-Bucket-Object-Lock-Enabled"
+	objectLockModeHeader      = "X-Amz-Object-Lock-Mode"
+	objectLockRetainHeader    = "X-Amz-Object-Lock-Retain-Until-Date"
+	objectLockLegalHoldHeader = "X-Amz-Object-Lock-Legal-Hold"
+
+	legalHoldOn  = "ON"
+	legalHoldOff = "OFF"
+
+	lockedErrCode = "ObjectLocked"
+)
+
+var errInvalidRetention = errors.New("object lock needs a retention mode and a period in either days or years")
+
+// ObjectLock protects every revision of an archive's data from being deleted or overwritten
+// for a retention period after it is written, so stolen credentials cannot destroy it
+// NOTE: object lock can only be turned on as a bucket is created, and never turned off
+type ObjectLock struct {
+	Mode  string `json:"mode"`            // RetentionGovernance or RetentionCompliance
+	Days  int64  `json:"days,omitempty"`  // retention period; set this or Years
+	Years int64  `json:"years,omitempty"` // retention period; set this or Days
+}
+
+func (lock ObjectLock) validate() error {
+	if (lock.Mode != RetentionGovernance && lock.Mode != RetentionCompliance) || (lock.Days > 0) == (lock.Years > 0) {
+		return errInvalidRetention
+	}
+	return nil
+}
+
+// objectLockStatus is how the current revision of an object is locked, as reported when heading it
+type objectLockStatus struct {
+	mode        string
+	retainUntil time.Time
+	legalHold   bool
+}
+
+func lockStatus(header http.Header) objectLockStatus {
+	status := objectLockStatus{
+		mode:      header.Get(objectLockModeHeader),
+		legalHold: header.Get(objectLockLegalHoldHeader) == legalHoldOn,
+	}
+	status.retainUntil, _ = time.Parse(time.RFC3339, header.Get(objectLockRetainHeader))
+	return status
+}
+
+// err returns ErrLocked if the revision may not be deleted at now
+func (status objectLockStatus) err(entry Entry, now time.Time) error {
+	switch {
+	case status.legalHold:
+		return wrapErr(ErrLocked, lockedErrCode, fmt.Errorf("%s is under a legal hold", entry.ID))
+	case status.mode != "" && now.Before(status.retainUntil):
+		return wrapErr(ErrLocked, lockedErrCode, fmt.Errorf("%s is retained in %s mode until %s",
+			entry.ID, status.mode, status.retainUntil.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// createLockedBucket creates the client's bucket with object lock enabled, then sets its default retention
+func (client *AS3) createLockedBucket(ctx context.Context, svc *s3.S3, input *s3.CreateBucketInput) error {
+	if err := client.Lock.validate(); err != nil {
+		return err
+	}
+
+	req, _ := svc.CreateBucketRequest(input)
+	req.SetContext(ctx)
+	req.HTTPRequest.Header.Set(objectLockEnabledHeader, "true")
+	if err := req.Send(); err != nil {
+		return evalErr(err)
+	}
+
+	rule := &objectLockRule{DefaultRetention: &objectLockRetention{Mode: aws.String(client.Lock.Mode)}}
+	if client.Lock.Days > 0 {
+		rule.DefaultRetention.Days = aws.Int64(client.Lock.Days)
+	} else {
+		rule.DefaultRetention.Years = aws.Int64(client.Lock.Years)
+	}
+	req = svc.NewRequest(&request.Operation{
+		Name:       "PutObjectLockConfiguration",
+		HTTPMethod: http.MethodPut,
+		HTTPPath:   "/{Bucket}?object-lock",
+	}, &putObjectLockConfigurationInput{
+		Bucket: aws.String(client.Bucket),
+		ObjectLockConfiguration: &objectLockConfiguration{
+			ObjectLockEnabled: aws.String("Enabled"),
+			Rule:              rule,
+		},
+	}, nil)
+	return evalErr(sendWithMD5(ctx, req))
+}
+
+// SetLegalHold places a legal hold on the current revision of entry's data, or lifts it
+// While held, the revision cannot be deleted whatever its retention, and Delete returns ErrLocked
+// NOTE: the bucket must have been created with object lock
+func (client *AS3) SetLegalHold(ctx context.Context, entry Entry, hold bool) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	status := legalHoldOff
+	if hold {
+		status = legalHoldOn
+	}
+	req := svc.NewRequest(&request.Operation{
+		Name:       "PutObjectLegalHold",
+		HTTPMethod: http.MethodPut,
+		HTTPPath:   "/{Bucket}/{Key+}?legal-hold",
+	}, &putObjectLegalHoldInput{
+		Bucket:    aws.String(client.Bucket),
+		Key:       aws.String(entry.ID),
+		LegalHold: &objectLegalHold{Status: aws.String(status)},
+	}, nil)
+	return evalErr(sendWithMD5(ctx, req))
+}
+
+// LegalHold reports whether the current revision of entry's data is under a legal hold
+func (client *AS3) LegalHold(ctx context.Context, entry Entry) (bool, error) {
+	svc, err := client.svc()
+	if err != nil {
+		return false, err
+	}
+
+	output := &getObjectLegalHoldOutput{}
+	req := svc.NewRequest(&request.Operation{
+		Name:       "GetObjectLegalHold",
+		HTTPMethod: http.MethodGet,
+		HTTPPath:   "/{Bucket}/{Key+}?legal-hold",
+	}, &getObjectLegalHoldInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(entry.ID),
+	}, output)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchObjectLockConfiguration" {
+			return false, nil // never held
+		}
+		return false, evalErr(err)
+	}
+	return output.LegalHold != nil && aws.StringValue(output.LegalHold.Status) == legalHoldOn, nil
+}
+
+// refusedByLock reports whether S3 refused to remove a revision because object lock protects
+// it, going by the code and HTTP status it answered with; status is 0 for the failures a batch
+// delete reports per key
+// NOTE: only deletes should check for InvalidRequest, which other requests fail with too
+func refusedByLock(code string, status int) bool {
+	switch code {
+	case lockedErrCode:
+		return status == 0 || status == http.StatusForbidden || status == http.StatusBadRequest
+	case "InvalidRequest":
+		return status == 0 || status == http.StatusBadRequest
+	}
+	return false
+}
+
+// requestStatus returns the HTTP status S3 answered with in err, or 0 if it gave none
+func requestStatus(err error) int {
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		return rerr.StatusCode()
+	}
+	return 0
+}
+
+// headLocked heads the current revision of entry, reporting how it is locked as well
+func (client *AS3) headLocked(ctx context.Context, svc *s3.S3, entry Entry) (*s3.HeadObjectOutput, objectLockStatus, error) {
+	req, result := svc.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(entry.ID),
+	})
+	req.SetContext(ctx)
+	if err := evalErr(req.Send()); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return &s3.HeadObjectOutput{}, objectLockStatus{}, nil
+		}
+		return nil, objectLockStatus{}, err
+	}
+	return result, lockStatus(req.HTTPResponse.Header), nil
+}
+
+// sendWithMD5 sends req, a request described here rather than by the SDK, with the
+// Content-MD5 header S3 requires of it; the response body is discarded
+func sendWithMD5(ctx context.Context, req *request.Request) error {
+	req.SetContext(ctx)
+	addContentMD5(req)
+	req.Handlers.Unmarshal.Remove(restxml.UnmarshalHandler)
+	req.Handlers.Unmarshal.PushBackNamed(protocol.UnmarshalDiscardBodyHandler)
+	return req.Send()
+}
+
+// addContentMD5 has req send a Content-MD5 header for its body, for requests S3 requires
+// it of that the SDK vendored does not know to add it to
+func addContentMD5(req *request.Request) {
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		if r.Error != nil || r.Body == nil {
+			return
+		}
+		h := md5.New()
+		if _, err := io.Copy(h, r.Body); err != nil {
+			r.Error = err
+			return
+		}
+		if _, err := r.Body.Seek(0, io.SeekStart); err != nil {
+			r.Error = err
+			return
+		}
+		r.HTTPRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	})
+}
+
+// The SDK vendored predates object lock and public access blocks, so their requests are
+// described here as the SDK's generated code would describe them
+
+type putObjectLockConfigurationInput struct {
+	_ struct{} `type:"structure" payload:"ObjectLockConfiguration"`
+
+	Bucket                  *string                  `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	ObjectLockConfiguration *objectLockConfiguration `locationName:"ObjectLockConfiguration" type:"structure" xmlURI:"http://s3.amazonaws.com/doc/2006-03-01/"`
+}
+
+type objectLockConfiguration struct {
+	_ struct{} `type:"structure"`
+
+	ObjectLockEnabled *string         `type:"string"`
+	Rule              *objectLockRule `type:"structure"`
+}
+
+type objectLockRule struct {
+	_ struct{} `type:"structure"`
+
+	DefaultRetention *objectLockRetention `type:"structure"`
+}
+
+type objectLockRetention struct {
+	_ struct{} `type:"structure"`
+
+	Mode  *string `type:"string"`
+	Days  *int64  `type:"integer"`
+	Years *int64  `type:"integer"`
+}
+
+type putObjectLegalHoldInput struct {
+	_ struct{} `type:"structure" payload:"LegalHold"`
+
+	Bucket    *string          `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	Key       *string          `location:"uri" locationName:"Key" min:"1" type:"string" required:"true"`
+	LegalHold *objectLegalHold `locationName:"LegalHold" type:"structure" xmlURI:"http://s3.amazonaws.com/doc/2006-03-01/"`
+}
+
+type getObjectLegalHoldInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	Key    *string `location:"uri" locationName:"Key" min:"1" type:"string" required:"true"`
+}
+
+type getObjectLegalHoldOutput struct {
+	_ struct{} `type:"structure" payload:"LegalHold"`
+
+	LegalHold *objectLegalHold `type:"structure"`
+}
+
+type objectLegalHold struct {
+	_ struct{} `type:"structure"`
+
+	Status *string `type:"string"`
+}
+
+type putPublicAccessBlockInput struct {
+	_ struct{} `type:"structure" payload:"PublicAccessBlockConfiguration"`
+
+	Bucket                         *string                         `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	PublicAccessBlockConfiguration *publicAccessBlockConfiguration `locationName:"PublicAccessBlockConfiguration" type:"structure" xmlURI:"http://s3.amazonaws.com/doc/2006-03-01/"`
+}
+
+type publicAccessBlockConfiguration struct {
+	_ struct{} `type:"structure"`
+
+	BlockPublicAcls       *bool `type:"boolean"`
+	IgnorePublicAcls      *bool `type:"boolean"`
+	BlockPublicPolicy     *bool `type:"boolean"`
+	RestrictPublicBuckets *bool `type:"boolean"`
+}
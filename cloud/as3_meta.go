@@ -0,0 +1,158 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// User metadata keys, in the canonical form the SDK returns them in
+	metaHeader        = "Lameta"         // Entry's encrypted metadata
+	metaSidecarHeader = "Lameta-Sidecar" // present when encrypted metadata lives in a sidecar object
+	checksumHeader    = "Lachecksum"     // Entry's checksum, for verifying downloads without metadata
+
+	metaSidecarPrefix = "meta/" // key prefix of sidecar metadata objects; hidden from List
+	maxMetaHeaderSize = 2 << 10 // S3's limit on the size of an object's user metadata
+)
+
+// encodeMeta returns the user metadata to store with entry's object: its checksum and
+// encrypted metadata, which is written to a sidecar object instead when too large to fit
+// NOTE: encrypted metadata is left out if client has no Key to encrypt with
+func (client *AS3) encodeMeta(ctx context.Context, svc *s3.S3, entry Entry) (map[string]*string, error) {
+	var sealed string
+	if client.Key != nil {
+		meta, err := entry.Meta(client.Key)
+		if err != nil {
+			return nil, err
+		}
+		sealed = meta
+	}
+	return client.encodeSealedMeta(ctx, svc, entry, sealed)
+}
+
+// encodeSealedMeta is encodeMeta for metadata already encrypted; sealed may be empty
+func (client *AS3) encodeSealedMeta(ctx context.Context, svc *s3.S3, entry Entry, sealed string) (map[string]*string, error) {
+	metadata := make(map[string]*string)
+	if entry.Checksum != "" {
+		metadata[checksumHeader] = aws.String(entry.Checksum)
+	}
+	if sealed == "" {
+		return metadata, nil
+	}
+
+	if len(checksumHeader)+len(entry.Checksum)+len(metaHeader)+len(sealed) <= maxMetaHeaderSize {
+		metadata[metaHeader] = aws.String(sealed)
+		return metadata, nil
+	}
+
+	sum := sha256.Sum256([]byte(sealed))
+	name := hex.EncodeToString(sum[:])
+	_, err := svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(sidecarKey(entry, name)),
+		Body:   strings.NewReader(sealed),
+	})
+	if err != nil {
+		return nil, evalErr(err)
+	}
+
+	metadata[metaSidecarHeader] = aws.String(name)
+	return metadata, nil
+}
+
+// sidecarKey returns the key of entry's sidecar object with the given name
+// Each sidecar is named for the metadata it holds, so every revision of an object (including
+// one put back by Restore) keeps pointing at its own metadata
+// NOTE: sidecars are never removed along with an object, as earlier revisions may still refer
+// to them; they're deleted with the rest of the archive by PurgeArchive
+func sidecarKey(entry Entry, name string) string {
+	return metaSidecarPrefix + entry.ID + "/" + name
+}
+
+// decodeMeta decrypts the metadata found on an object (or its sidecar) into entry
+func (client *AS3) decodeMeta(ctx context.Context, svc *s3.S3, entry *Entry, metadata map[string]*string) error {
+	if client.Key == nil {
+		return nil
+	}
+
+	sealed, err := client.sealedMeta(ctx, svc, *entry, metadata)
+	if err != nil || sealed == "" {
+		return err
+	}
+	return entry.UpdateMeta(sealed, client.Key)
+}
+
+// sealedMeta returns the encrypted metadata found on an object (or its sidecar) as stored;
+// empty if there is none
+func (client *AS3) sealedMeta(ctx context.Context, svc *s3.S3, entry Entry, metadata map[string]*string) (string, error) {
+	if meta, inline := metadata[metaHeader]; inline {
+		return aws.StringValue(meta), nil
+	}
+	name, sidecar := metadata[metaSidecarHeader]
+	if !sidecar {
+		return "", nil // no metadata stored
+	}
+
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(sidecarKey(entry, aws.StringValue(name))),
+	})
+	if err != nil {
+		return "", evalErr(err)
+	}
+	defer result.Body.Close()
+
+	data, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// HeadSealed fills in entry's properties and checksum, returning its encrypted metadata
+// as stored; the metadata is never decrypted, so no Key is needed
+func (client *AS3) HeadSealed(ctx context.Context, entry *Entry) (string, error) {
+	svc, err := client.svc()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := client.head(ctx, svc, entry)
+	if err != nil {
+		return "", err
+	}
+	entry.Checksum = aws.StringValue(result.Metadata[checksumHeader])
+
+	return client.sealedMeta(ctx, svc, *entry, result.Metadata)
+}
+
+// UploadSealed stores entry's data along with encrypted metadata exactly as given
+func (client *AS3) UploadSealed(ctx context.Context, entry Entry, sealed string, file File) error {
+	return client.upload(ctx, entry, file, sealed, func(svc *s3.S3) (map[string]*string, error) {
+		return client.encodeSealedMeta(ctx, svc, entry, sealed)
+	})
+}
+
+// headStored returns the properties of entry's stored object, which are empty if there is none yet
+func (client *AS3) headStored(ctx context.Context, svc *s3.S3, entry Entry) (*s3.HeadObjectOutput, error) {
+	result, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(entry.ID),
+	})
+	if err = evalErr(err); errors.Is(err, ErrNotFound) {
+		return &s3.HeadObjectOutput{}, nil
+	}
+	return result, err
+}
+
+// isMetaSidecar reports whether key belongs to a sidecar metadata object
+func isMetaSidecar(key string) bool {
+	return strings.HasPrefix(key, metaSidecarPrefix)
+}
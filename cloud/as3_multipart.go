@@ -0,0 +1,391 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultPartSize    = 8 << 20 // 8 MiB
+	minPartSize        = 5 << 20 // smallest part S3 accepts, other than the last
+	maxPartCount       = 10000   // most parts S3 accepts in one upload
+	defaultConcurrency = 4
+
+	uploadStateExt = ".upload"
+)
+
+// as3UploadState is saved to StateDir so an interrupted multipart upload can resume
+type as3UploadState struct {
+	UploadID string    `json:"upload_id"`
+	Size     int64     `json:"size"`      // size of file being uploaded
+	ModTime  time.Time `json:"mod_time"`  // modification time of file being uploaded
+	PartSize int64     `json:"part_size"` // part size used when upload began
+	Entry    string    `json:"entry"`     // uploadFingerprint of what the upload began with
+}
+
+// AbortStaleUploads aborts multipart uploads begun more than maxAge ago,
+// removing any saved state for them; these would otherwise be billed indefinitely
+func (client *AS3) AbortStaleUploads(ctx context.Context, maxAge time.Duration) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	var (
+		cutoff = time.Now().Add(-maxAge)
+		stale  []*s3.MultipartUpload
+	)
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(client.Bucket),
+	}
+	if err := svc.ListMultipartUploadsPagesWithContext(ctx, input, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if aws.TimeValue(upload.Initiated).Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+		return aws.BoolValue(page.IsTruncated)
+	}); err != nil {
+		return evalErr(err)
+	}
+
+	for _, upload := range stale {
+		id := aws.StringValue(upload.Key)
+		if err := client.abortUpload(ctx, svc, id, aws.StringValue(upload.UploadId)); err != nil {
+			return err
+		}
+		if state, err := client.loadUploadState(id); err == nil && state.UploadID == aws.StringValue(upload.UploadId) {
+			client.removeUploadState(id)
+		}
+	}
+	return nil
+}
+
+// uploadMultipart sends file in parts, in parallel, resuming a previous attempt if one was saved
+// fingerprint identifies the Entry and metadata being uploaded; see uploadFingerprint
+func (client *AS3) uploadMultipart(ctx context.Context, svc *s3.S3, entry Entry, file File, info os.FileInfo, metadata map[string]*string, fingerprint string) error {
+	state, completed, err := client.resumeUpload(ctx, svc, entry, info, metadata, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	parts, err := client.uploadParts(ctx, svc, entry, file, state, completed)
+	if err != nil {
+		if client.StateDir == "" {
+			// Nothing to resume from later, so don't leave parts behind
+			// (even when ctx was canceled, which is why it isn't used here)
+			client.abortUpload(context.Background(), svc, entry.ID, state.UploadID)
+		}
+		return err
+	}
+
+	_, err = svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(client.Bucket),
+		Key:             aws.String(entry.ID),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return evalErr(err)
+	}
+
+	client.removeUploadState(entry.ID)
+	return nil
+}
+
+// resumeUpload returns the saved upload for entry along with its finished parts,
+// or begins a new upload if there is nothing valid to resume
+// An upload's metadata is fixed as it begins, so one begun for an Entry that has changed
+// since, or with a different storage class, is abandoned rather than resumed
+func (client *AS3) resumeUpload(ctx context.Context, svc *s3.S3, entry Entry, info os.FileInfo, metadata map[string]*string, fingerprint string) (*as3UploadState, map[int64]*s3.CompletedPart, error) {
+	if state, err := client.loadUploadState(entry.ID); err == nil {
+		if state.Size == info.Size() && state.ModTime.Equal(info.ModTime()) && state.Entry == fingerprint {
+			completed, err := client.listParts(ctx, svc, entry, state)
+			if err == nil {
+				return state, completed, nil
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return nil, nil, err
+			}
+		} else {
+			// File or Entry changed since the upload began; its parts are of no use
+			client.abortUpload(ctx, svc, entry.ID, state.UploadID)
+		}
+		client.removeUploadState(entry.ID)
+	}
+
+	result, err := svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(client.Bucket),
+		Key:          aws.String(entry.ID),
+		Metadata:     metadata,
+		StorageClass: client.storageClass(entry),
+		Tagging:      tagging(entry),
+	})
+	if err != nil {
+		return nil, nil, evalErr(err)
+	}
+
+	state := &as3UploadState{
+		UploadID: aws.StringValue(result.UploadId),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		PartSize: client.partSizeFor(info.Size()),
+		Entry:    fingerprint,
+	}
+	if err := client.saveUploadState(entry.ID, state); err != nil {
+		client.abortUpload(ctx, svc, entry.ID, state.UploadID)
+		return nil, nil, err
+	}
+
+	return state, make(map[int64]*s3.CompletedPart), nil
+}
+
+// uploadFingerprint identifies what an upload of entry stores besides its data: the Entry
+// itself, the storage class it goes to and, when given, its metadata already encrypted
+// Encrypting metadata again gives different ciphertext each time, so the Entry is compared instead
+func (client *AS3) uploadFingerprint(entry Entry, sealed string) (string, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte{0})
+	h.Write([]byte(aws.StringValue(client.storageClass(entry))))
+	h.Write([]byte{0})
+	h.Write([]byte(sealed))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listParts returns the parts S3 has already received for an upload, keyed by part number
+func (client *AS3) listParts(ctx context.Context, svc *s3.S3, entry Entry, state *as3UploadState) (map[int64]*s3.CompletedPart, error) {
+	completed := make(map[int64]*s3.CompletedPart)
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(client.Bucket),
+		Key:      aws.String(entry.ID),
+		UploadId: aws.String(state.UploadID),
+	}
+	err := svc.ListPartsPagesWithContext(ctx, input, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			number := aws.Int64Value(part.PartNumber)
+			if aws.Int64Value(part.Size) != state.partLength(number) {
+				continue // incomplete or mismatched; send it again
+			}
+			completed[number] = &s3.CompletedPart{
+				ETag:       part.ETag,
+				PartNumber: part.PartNumber,
+			}
+		}
+		return aws.BoolValue(page.IsTruncated)
+	})
+	return completed, evalErr(err)
+}
+
+// uploadParts sends every part not yet completed using Concurrency workers and
+// returns the full, ordered list of completed parts
+func (client *AS3) uploadParts(ctx context.Context, svc *s3.S3, entry Entry, file File, state *as3UploadState, completed map[int64]*s3.CompletedPart) ([]*s3.CompletedPart, error) {
+	var (
+		mutex    sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		numbers  = make(chan int64)
+	)
+
+	for i := 0; i < client.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range numbers {
+				etag, err := client.uploadPart(ctx, svc, entry, state, state.partReader(file, number), number)
+
+				mutex.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = evalErr(err)
+					}
+				} else {
+					completed[number] = &s3.CompletedPart{
+						ETag:       etag,
+						PartNumber: aws.Int64(number),
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+queue:
+	for number := int64(1); number <= state.partCount(); number++ {
+		mutex.Lock()
+		_, done := completed[number]
+		failed := firstErr != nil
+		mutex.Unlock()
+
+		if failed {
+			break
+		}
+		if !done {
+			select {
+			case numbers <- number:
+			case <-ctx.Done():
+				break queue // parts in flight fail with ctx's error
+			}
+		}
+	}
+	close(numbers)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	parts := make([]*s3.CompletedPart, 0, len(completed))
+	for _, part := range completed {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+	return parts, nil
+}
+
+// uploadPart sends one part of a multipart upload, returning its ETag
+// The part is read into memory once so its hashes can be sent along: S3 rejects
+// it if the data it receives doesn't match its MD5, and signing needs its SHA-256
+func (client *AS3) uploadPart(ctx context.Context, svc *s3.S3, entry Entry, state *as3UploadState, part *io.SectionReader, number int64) (*string, error) {
+	data := make([]byte, part.Size())
+	if _, err := io.ReadFull(part, data); err != nil {
+		return nil, err
+	}
+	contentMD5 := md5.Sum(data)
+	contentSHA256 := sha256.Sum256(data)
+
+	req, result := svc.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:     aws.String(client.Bucket),
+		Key:        aws.String(entry.ID),
+		UploadId:   aws.String(state.UploadID),
+		PartNumber: aws.Int64(number),
+		Body:       bytes.NewReader(data),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(contentMD5[:])),
+	})
+	req.SetContext(ctx)
+	meterBody(ctx, req)
+	req.HTTPRequest.Header.Set(contentSHA256Header, hex.EncodeToString(contentSHA256[:]))
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return result.ETag, nil
+}
+
+// abortUpload cancels a multipart upload so S3 discards its parts
+func (client *AS3) abortUpload(ctx context.Context, svc *s3.S3, id, uploadID string) error {
+	_, err := svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(client.Bucket),
+		Key:      aws.String(id),
+		UploadId: aws.String(uploadID),
+	})
+	if err = evalErr(err); errors.Is(err, ErrNotFound) {
+		return nil // already gone
+	}
+	return err
+}
+
+func (client *AS3) loadUploadState(id string) (*as3UploadState, error) {
+	if client.StateDir == "" {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := ioutil.ReadFile(client.uploadStatePath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	state := &as3UploadState{}
+	return state, json.Unmarshal(data, state)
+}
+
+func (client *AS3) saveUploadState(id string, state *as3UploadState) error {
+	if client.StateDir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(client.uploadStatePath(id), data, 0600)
+}
+
+func (client *AS3) removeUploadState(id string) {
+	if client.StateDir != "" {
+		os.Remove(client.uploadStatePath(id))
+	}
+}
+
+// uploadStatePath names the resume file after a hash of the whole id, so ids that share a
+// base name (or would not make a valid file name) each get their own
+func (client *AS3) uploadStatePath(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(client.StateDir, hex.EncodeToString(sum[:])+uploadStateExt)
+}
+
+// partSize returns the configured part size, respecting S3's minimum
+func (client *AS3) partSize() int64 {
+	if client.PartSize == 0 {
+		return defaultPartSize
+	}
+	if client.PartSize < minPartSize {
+		return minPartSize
+	}
+	return client.PartSize
+}
+
+// partSizeFor returns the part size to use for a file of the given size,
+// growing it if needed to stay within S3's part count limit
+func (client *AS3) partSizeFor(size int64) int64 {
+	partSize := client.partSize()
+	for size > partSize*maxPartCount {
+		partSize *= 2
+	}
+	return partSize
+}
+
+func (client *AS3) concurrency() int {
+	if client.Concurrency < 1 {
+		return defaultConcurrency
+	}
+	return client.Concurrency
+}
+
+func (state as3UploadState) partCount() int64 {
+	return (state.Size + state.PartSize - 1) / state.PartSize
+}
+
+// partLength returns the expected size of the numbered part; parts are numbered from 1
+func (state as3UploadState) partLength(number int64) int64 {
+	offset := (number - 1) * state.PartSize
+	if remaining := state.Size - offset; remaining < state.PartSize {
+		return remaining
+	}
+	return state.PartSize
+}
+
+func (state as3UploadState) partReader(file File, number int64) *io.SectionReader {
+	return io.NewSectionReader(file, (number-1)*state.PartSize, state.partLength(number))
+}
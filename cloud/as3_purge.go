@@ -0,0 +1,172 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	maxDeleteBatch = 1000 // most keys S3 deletes in one request
+
+	uploadItemPrefix = "upload:" // distinguishes unfinished uploads from versions in a report's token
+)
+
+// PlanRemoval reports everything PurgeArchive would permanently delete from the bucket,
+// along with the token needed to go through with it; nothing is changed
+func (client *AS3) PlanRemoval(ctx context.Context) (*RemovalReport, error) {
+	svc, err := client.svc()
+	if err != nil {
+		return nil, err
+	}
+
+	report, _, _, _, err := client.planRemoval(ctx, svc)
+	return report, err
+}
+
+// planRemoval lists the bucket into a RemovalReport, returning what it lists as well
+func (client *AS3) planRemoval(ctx context.Context, svc *s3.S3) (*RemovalReport, []*s3.ObjectVersion, []*s3.DeleteMarkerEntry, []*s3.MultipartUpload, error) {
+	versions, markers, uploads, err := client.listAll(ctx, svc)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	var items []removalItem
+	for _, version := range versions {
+		items = append(items, removalItem{
+			key:       aws.StringValue(version.Key),
+			versionID: aws.StringValue(version.VersionId),
+			size:      aws.Int64Value(version.Size),
+		})
+	}
+	for _, marker := range markers {
+		items = append(items, removalItem{
+			key:       aws.StringValue(marker.Key),
+			versionID: aws.StringValue(marker.VersionId),
+		})
+	}
+	for _, upload := range uploads {
+		items = append(items, removalItem{
+			key:       uploadItemPrefix + aws.StringValue(upload.Key),
+			versionID: aws.StringValue(upload.UploadId),
+		})
+	}
+
+	report := newRemovalReport(client.Bucket, items)
+	report.Versions = len(versions)
+	report.DeleteMarkers = len(markers)
+	report.Uploads = len(uploads)
+	for _, version := range versions {
+		if aws.BoolValue(version.IsLatest) {
+			report.Objects++
+		}
+		report.Size += aws.Int64Value(version.Size)
+	}
+	return report, versions, markers, uploads, nil
+}
+
+// PurgeArchive permanently deletes every object, version, delete marker and unfinished
+// upload in the bucket, then the bucket itself
+// token must come from a PlanRemoval report made since the bucket last changed, or
+// ErrConfirmation is returned and nothing is deleted
+// Only what the confirmed report counted is deleted; anything written since is left, and
+// the bucket with it, failing with ErrArchiveNotEmpty
+func (client *AS3) PurgeArchive(ctx context.Context, token string) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	report, versions, markers, uploads, err := client.planRemoval(ctx, svc)
+	if err != nil {
+		return err
+	}
+	if err := report.confirm(token); err != nil {
+		return err
+	}
+
+	for _, upload := range uploads {
+		if err := client.abortUpload(ctx, svc, aws.StringValue(upload.Key), aws.StringValue(upload.UploadId)); err != nil {
+			return err
+		}
+		client.removeUploadState(aws.StringValue(upload.Key))
+	}
+
+	var objects []*s3.ObjectIdentifier
+	for _, version := range versions {
+		objects = append(objects, &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+	}
+	for _, marker := range markers {
+		objects = append(objects, &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+	}
+	for start := 0; start < len(objects); start += maxDeleteBatch {
+		end := start + maxDeleteBatch
+		if end > len(objects) {
+			end = len(objects)
+		}
+		if err := client.deleteBatch(ctx, svc, objects[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return client.RemoveArchive(ctx)
+}
+
+// listAll returns every version, delete marker and unfinished multipart upload in the bucket
+func (client *AS3) listAll(ctx context.Context, svc *s3.S3) ([]*s3.ObjectVersion, []*s3.DeleteMarkerEntry, []*s3.MultipartUpload, error) {
+	var (
+		versions []*s3.ObjectVersion
+		markers  []*s3.DeleteMarkerEntry
+		uploads  []*s3.MultipartUpload
+	)
+
+	err := svc.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(client.Bucket),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		versions = append(versions, page.Versions...)
+		markers = append(markers, page.DeleteMarkers...)
+		return aws.BoolValue(page.IsTruncated)
+	})
+	if err != nil {
+		return nil, nil, nil, evalErr(err)
+	}
+
+	err = svc.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(client.Bucket),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		uploads = append(uploads, page.Uploads...)
+		return aws.BoolValue(page.IsTruncated)
+	})
+	if err != nil {
+		return nil, nil, nil, evalErr(err)
+	}
+
+	return versions, markers, uploads, nil
+}
+
+// deleteBatch permanently deletes up to maxDeleteBatch object versions in one request
+func (client *AS3) deleteBatch(ctx context.Context, svc *s3.S3, objects []*s3.ObjectIdentifier) error {
+	result, err := svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(client.Bucket),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true), // only report failures
+		},
+	})
+	if err != nil {
+		return evalErr(err)
+	}
+
+	if len(result.Errors) > 0 {
+		failure := result.Errors[0]
+		err := fmt.Errorf("%d objects could not be deleted, including %s (version %s): %s",
+			len(result.Errors), aws.StringValue(failure.Key), aws.StringValue(failure.VersionId), aws.StringValue(failure.Message))
+		if refusedByLock(aws.StringValue(failure.Code), 0) {
+			return wrapErr(ErrLocked, aws.StringValue(failure.Code), err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package cloud
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// MaxShareExpiry is the longest a pre-signed link can stay valid; S3 allows no more
+const MaxShareExpiry = 7 * 24 * time.Hour
+
+var errShareExpiry = errors.New("share links must expire within 7 days")
+
+// Presigner is a Client able to hand out links downloading an Entry's data without credentials
+type Presigner interface {
+	PresignDownload(entry Entry, expires time.Duration) (string, error)
+}
+
+// PresignDownload returns a link anyone can download entry's encrypted data from until expires passes
+// NOTE: the link is signed with the client's credentials and stops working if they are revoked
+// or expire first; data in Glacier or Deep Archive must be restored before it can be downloaded
+func (client *AS3) PresignDownload(entry Entry, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > MaxShareExpiry {
+		return "", errShareExpiry
+	}
+
+	svc, err := client.svc()
+	if err != nil {
+		return "", err
+	}
+
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(client.Bucket),
+		Key:    aws.String(entry.ID),
+	})
+	url, err := req.Presign(expires)
+	return url, evalErr(err)
+}
@@ -1,67 +1,715 @@
 package cloud_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
 )
 
 func TestAS3(t *testing.T) {
+	client, close := setupAS3(t)
+	defer close()
+
+	runClientTests(t, client)
+
+	purgeAS3(t, client, cloud.Entry{ID: "123"})
+	teardown(t, client)
+}
+
+func setupAS3(t *testing.T) (client *cloud.AS3, close func()) {
+	client, close = newTestAS3(t, "lockedarchive-test")
+	if err := client.CreateArchive(context.Background()); err != nil {
+		close()
+		t.Fatal(err)
+	}
+	t.Log("success: created archive with AS3")
+	return
+}
+
+func teardown(t *testing.T, client *cloud.AS3) {
+	if err := client.RemoveArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("success: removed archive with AS3")
+}
+
+func TestAS3Multipart(t *testing.T) {
+	client, stub, close := newStubAS3(t, "lockedarchive-multipart")
+	defer close()
+
+	stateDir, err := ioutil.TempDir("", "lockedarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	client.StateDir = stateDir
+	client.PartSize = 5 << 20
+	client.Concurrency = 1 // so the interruption lands at a predictable part
+
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body := make([]byte, 3*client.PartSize-1024) // 3 parts, last one short
+	if _, err := rand.Read(body); err != nil {
+		t.Fatal(err)
+	}
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	entry := cloud.Entry{ID: "multipart"}
+
+	t.Run("Interrupted", func(t *testing.T) {
+		stub.failPartsFrom = 2
+		if err := client.Upload(context.Background(), entry, file); err == nil {
+			t.Fatal("expected upload to fail partway")
+		}
+		if count := countUploadStates(t, stateDir); count != 1 {
+			t.Fatalf("expected upload state to be saved, found %d", count)
+		}
+	})
+	t.Run("Resumed", func(t *testing.T) {
+		stub.failPartsFrom = 0
+		if err := client.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+		if stub.partsReceived != 3 {
+			t.Errorf("expected 3 parts to be sent in total, sent %d", stub.partsReceived)
+		}
+		if count := countUploadStates(t, stateDir); count != 0 {
+			t.Errorf("expected upload state to be removed once complete, found %d", count)
+		}
+
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Error("downloaded data does not match uploaded data")
+		}
+	})
+	changed := cloud.Entry{ID: "changed"}
+	t.Run("ChangedEntry", func(t *testing.T) {
+		stub.failPartsFrom = stub.partsReceived + 1
+		if err := client.Upload(context.Background(), changed, file); err == nil {
+			t.Fatal("expected upload to fail partway")
+		}
+
+		// Metadata is fixed as an upload begins, so resuming would store what changed.StorageClass replaces
+		changed.StorageClass = cloud.StorageClassStandardIA
+		stub.failPartsFrom = 0
+		sent := stub.partsReceived
+		if err := client.Upload(context.Background(), changed, file); err != nil {
+			t.Fatal(err)
+		}
+		if sent := stub.partsReceived - sent; sent != 3 {
+			t.Errorf("expected the upload to begin again with all 3 parts, sent %d", sent)
+		}
+		if len(stub.uploads) != 0 {
+			t.Errorf("expected the upload begun for the old Entry to be aborted, %d remain", len(stub.uploads))
+		}
+		versions := stub.buckets["lockedarchive-multipart"].objects[changed.ID]
+		if class := versions[len(versions)-1].storageClass; class != cloud.StorageClassStandardIA {
+			t.Errorf("expected %s, stored as %s", cloud.StorageClassStandardIA, class)
+		}
+	})
+	t.Run("AbortStaleUploads", func(t *testing.T) {
+		// IDs sharing a base name must not share (and clobber) a resume file
+		stub.failPartsFrom = stub.partsReceived
+		for _, id := range []string{"first/abandoned", "second/abandoned"} {
+			if err := client.Upload(context.Background(), cloud.Entry{ID: id}, file); err == nil {
+				t.Fatal("expected upload to fail")
+			}
+		}
+		if count := countUploadStates(t, stateDir); count != 2 {
+			t.Fatalf("expected a saved upload state for each abandoned upload, found %d", count)
+		}
+		if err := client.AbortStaleUploads(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+		if len(stub.uploads) != 0 {
+			t.Errorf("expected all multipart uploads to be aborted, %d remain", len(stub.uploads))
+		}
+		if count := countUploadStates(t, stateDir); count != 0 {
+			t.Errorf("expected upload state to be removed once aborted, found %d", count)
+		}
+	})
+
+	purgeAS3(t, client, entry, changed)
+	teardown(t, client)
+}
+
+// countUploadStates reports how many multipart resume files are held in stateDir
+func countUploadStates(t *testing.T, stateDir string) int {
+	matches, err := filepath.Glob(filepath.Join(stateDir, "*.upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestAS3Meta(t *testing.T) {
+	client, close := newTestAS3(t, "lockedarchive-meta")
+	defer close()
+
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+	client.Key = kc
+
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := cloud.Entry{ID: "meta"}
+	runMetaTests(t, client, entry)
+
+	purgeArchive(t, client)
+}
+
+func TestAS3Versions(t *testing.T) {
+	client, close := newTestAS3(t, "lockedarchive-versions")
+	defer close()
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
 	var (
-		client = setupAS3(t)
-		entry  = Entry{
-			Key:   "123",
-			IsDir: true,
+		entry    = cloud.Entry{ID: "versioned"}
+		original = []byte("original tax document")
+		mistake  = []byte("overwritten by mistake")
+	)
+	for _, body := range [][]byte{original, mistake} {
+		file := makeBodyFile(t, body)
+		err := client.Upload(context.Background(), entry, file)
+		file.Close()
+		os.Remove(file.Name())
+		if err != nil {
+			t.Fatal(err)
 		}
+	}
+
+	versions, err := client.ListVersions(context.Background(), entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Size != int64(len(original)) {
+		t.Fatalf("expected 2 versions with the original last: %+v", versions)
+	}
+
+	t.Run("DownloadVersion", func(t *testing.T) {
+		rc, err := client.DownloadVersion(context.Background(), entry, versions[1].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, original)
+	})
+	t.Run("Restore", func(t *testing.T) {
+		if err := client.Restore(context.Background(), entry, versions[1].ID); err != nil {
+			t.Fatal(err)
+		}
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, original)
+	})
+	t.Run("RestoreDeleted", func(t *testing.T) {
+		if err := client.Delete(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		versions, err := client.ListVersions(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !versions[0].IsDeleted {
+			t.Fatalf("expected latest version to mark entry as deleted: %+v", versions)
+		}
+		if err := client.Restore(context.Background(), entry, versions[1].ID); err != nil {
+			t.Fatal(err)
+		}
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, original)
+	})
+
+	purgeAS3(t, client, entry)
+	teardown(t, client)
+}
+
+func TestAS3VersionsSidecar(t *testing.T) {
+	client, close := newTestAS3(t, "lockedarchive-versions-sidecar")
+	defer close()
+
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+	client.Key = kc
+
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Names this long leave the metadata too large for S3's headers, so it goes in a sidecar
+	var (
+		original = cloud.Entry{ID: "versioned", Name: strings.Repeat("original tax document ", 100)}
+		mistake  = cloud.Entry{ID: "versioned", Name: strings.Repeat("overwritten by mistake ", 100)}
 	)
+	for _, entry := range []cloud.Entry{original, mistake} {
+		file := makeBodyFile(t, []byte(entry.Name))
+		err := client.Upload(context.Background(), entry, file)
+		file.Close()
+		os.Remove(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	t.Run("Upload", func(t *testing.T) {
-		if err := client.Upload(entry); err != nil {
-			t.Error(err)
+	versions, err := client.ListVersions(context.Background(), original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions: %+v", versions)
+	}
+	if err := client.Restore(context.Background(), original, versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	assertHeadMatches(t, client, original)
+
+	t.Run("RestoreDeleted", func(t *testing.T) {
+		if err := client.Delete(context.Background(), original); err != nil {
+			t.Fatal(err)
+		}
+		// Newest first: the delete marker, the restored original, then the mistake
+		versions, err := client.ListVersions(context.Background(), original)
+		if err != nil {
+			t.Fatal(err)
 		}
+		if err := client.Restore(context.Background(), original, versions[2].ID); err != nil {
+			t.Fatal(err)
+		}
+		assertHeadMatches(t, client, mistake)
 	})
+
+	purgeArchive(t, client)
+}
+
+// purgeArchive permanently deletes everything in client's bucket, then the bucket itself
+func purgeArchive(t *testing.T, client *cloud.AS3) {
+	report, err := client.PlanRemoval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PurgeArchive(context.Background(), report.Token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// purgeAS3 permanently deletes every version of each entry so the bucket can be removed
+func purgeAS3(t *testing.T, client *cloud.AS3, entries ...cloud.Entry) {
+	for _, entry := range entries {
+		versions, err := client.ListVersions(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, version := range versions {
+			if err := client.DeleteVersion(context.Background(), entry, version.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestAS3ColdStorage(t *testing.T) {
+	client, stub, close := newStubAS3(t, "lockedarchive-cold")
+	defer close()
+	client.StorageClass = cloud.StorageClassGlacier
+	client.Transitions = []cloud.Transition{{Days: 90, StorageClass: cloud.StorageClassDeepArchive}}
+
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lifecycle := string(stub.buckets[client.Bucket].lifecycle); !strings.Contains(lifecycle, cloud.StorageClassDeepArchive) {
+		t.Errorf("expected lifecycle transition to be applied: %s", lifecycle)
+	}
+
+	body := []byte("scanned birth certificate")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	entry := cloud.Entry{ID: "cold"}
+	if err := client.Upload(context.Background(), entry, file); err != nil {
+		t.Fatal(err)
+	}
+
 	t.Run("Head", func(t *testing.T) {
-		if err := client.Head(entry); err != nil {
-			t.Error(err)
+		headed := cloud.Entry{ID: entry.ID}
+		if err := client.Head(context.Background(), &headed); err != nil {
+			t.Fatal(err)
+		}
+		if headed.StorageClass != cloud.StorageClassGlacier {
+			t.Errorf("expected storage class %s, received %s", cloud.StorageClassGlacier, headed.StorageClass)
 		}
 	})
-	t.Run("Download", func(t *testing.T) {
-		if err := client.Download(entry); err != nil {
-			t.Error(err)
+	t.Run("Update", func(t *testing.T) {
+		if err := client.Update(context.Background(), entry); !errors.Is(err, cloud.ErrArchived) {
+			t.Errorf("expected %v, received %v", cloud.ErrArchived, err)
 		}
 	})
-	t.Run("List", func(t *testing.T) {
-		entries := make(chan Entry)
-		go func() {
-			if err := client.List(entries); err != nil {
-				t.Error(err)
+	t.Run("RestorePending", func(t *testing.T) {
+		for i := 0; i < 2; i++ { // starts the restore, then finds it in progress
+			if _, err := client.Download(context.Background(), entry); !errors.Is(err, cloud.ErrRestorePending) {
+				t.Errorf("expected %v, received %v", cloud.ErrRestorePending, err)
 			}
-		}()
-		for entry := range entries {
-			t.Logf("list: %+v", entry)
 		}
 	})
-	t.Run("Delete", func(t *testing.T) {
-		if err := client.Delete(entry); err != nil {
-			t.Error(err)
+	t.Run("Restored", func(t *testing.T) {
+		stub.finishRestores()
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, body)
+	})
+	control := cloud.Entry{ID: "manifest~head"}
+	t.Run("ControlObjects", func(t *testing.T) {
+		if _, err := file.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Upload(context.Background(), control, file); err != nil {
+			t.Fatal(err)
+		}
+		objects := stub.buckets[client.Bucket].objects
+		if stored := objects[control.ID][0]; stored.storageClass != cloud.StorageClassStandard || stored.tagging != "" {
+			t.Errorf("expected control object kept in %s untagged, stored in %s tagged %q", cloud.StorageClassStandard, stored.storageClass, stored.tagging)
+		}
+		if stored := objects[entry.ID][0]; stored.tagging != "lockedarchive=data" {
+			t.Errorf("expected data tagged for lifecycle rules, tagged %q", stored.tagging)
 		}
 	})
 
+	purgeAS3(t, client, entry, control)
 	teardown(t, client)
 }
 
-func setupAS3(t *testing.T) (client cloud.Client) {
-	client = cloud.AS3Client("lockedarchive-test", "us-east-1")
-	if err := client.CreateArchive(); err != nil {
+func TestAS3Purge(t *testing.T) {
+	client, stub, close := newStubAS3(t, "lockedarchive-purge")
+	defer close()
+
+	if err := client.CreateArchive(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	t.Log("success: created archive with AS3")
-	return
+
+	body := []byte("tax returns, 2009 through 2016")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	kept, deleted := cloud.Entry{ID: "kept"}, cloud.Entry{ID: "deleted"}
+	for _, entry := range []cloud.Entry{kept, kept, deleted} {
+		if _, err := file.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Delete(context.Background(), deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := client.PlanRemoval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 1 || report.Versions != 3 || report.DeleteMarkers != 1 || report.Size != 3*int64(len(body)) {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	t.Run("WrongToken", func(t *testing.T) {
+		if err := client.PurgeArchive(context.Background(), "not the token"); !errors.Is(err, cloud.ErrConfirmation) {
+			t.Errorf("expected %v, received %v", cloud.ErrConfirmation, err)
+		}
+	})
+	t.Run("StaleToken", func(t *testing.T) {
+		if _, err := file.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Upload(context.Background(), cloud.Entry{ID: "late"}, file); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.PurgeArchive(context.Background(), report.Token); !errors.Is(err, cloud.ErrConfirmation) {
+			t.Errorf("expected %v, received %v", cloud.ErrConfirmation, err)
+		}
+	})
+	t.Run("WrittenDuringPurge", func(t *testing.T) {
+		report, err := client.PlanRemoval(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Lands after the purge confirms its token against what it lists, before it deletes
+		stub.afterListVersions = func(bucket *s3StubBucket) {
+			stub.afterListVersions = nil
+			stub.put(bucket, "written-during-purge", &s3StubObject{data: body})
+		}
+		if err := client.PurgeArchive(context.Background(), report.Token); !errors.Is(err, cloud.ErrArchiveNotEmpty) {
+			t.Errorf("expected %v, received %v", cloud.ErrArchiveNotEmpty, err)
+		}
+		if objects := stub.buckets[client.Bucket].objects; len(objects) != 1 || objects["written-during-purge"] == nil {
+			t.Errorf("expected only what was written during the purge to be left, %d objects remain", len(objects))
+		}
+	})
+	t.Run("Purge", func(t *testing.T) {
+		report, err := client.PlanRemoval(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.PurgeArchive(context.Background(), report.Token); err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := stub.buckets[client.Bucket]; exists {
+			t.Error("expected bucket to be removed")
+		}
+	})
 }
 
-func teardown(t *testing.T, client cloud.Client) {
-	if err := client.RemoveArchive(); err != nil {
+func TestAS3ObjectLock(t *testing.T) {
+	client, stub, close := newStubAS3(t, "lockedarchive-locked")
+	defer close()
+
+	client.Lock = &cloud.ObjectLock{Mode: "FOREVER", Days: 30}
+	if err := client.CreateArchive(context.Background()); err == nil {
+		t.Fatal("expected an unknown retention mode to be refused")
+	}
+	client.Lock.Mode = cloud.RetentionGovernance
+	if err := client.CreateArchive(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	t.Log("success: removed archive with AS3")
+	if bucket := stub.buckets[client.Bucket]; !bucket.locking || bucket.retention.Mode != cloud.RetentionGovernance || bucket.retention.Days != 30 {
+		t.Fatalf("expected object lock with default retention, found %+v", bucket.retention)
+	}
+
+	body := []byte("signed mortgage agreement")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	entry := cloud.Entry{ID: "mortgage"}
+	if err := client.Upload(context.Background(), entry, file); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Retention", func(t *testing.T) {
+		err := client.Delete(context.Background(), entry)
+		if !errors.Is(err, cloud.ErrLocked) {
+			t.Fatalf("expected %v, received %v", cloud.ErrLocked, err)
+		}
+		if !strings.Contains(err.Error(), cloud.RetentionGovernance) {
+			t.Errorf("expected the error to name the retention mode, received %v", err)
+		}
+
+		// Nor can the revision itself be removed behind Delete's back
+		report, err := client.PlanRemoval(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.PurgeArchive(context.Background(), report.Token); !errors.Is(err, cloud.ErrLocked) {
+			t.Errorf("expected %v, received %v", cloud.ErrLocked, err)
+		}
+	})
+
+	// As if the retention period had passed
+	stub.buckets[client.Bucket].latest(entry.ID).retainUntil = time.Now().Add(-time.Hour)
+
+	t.Run("LegalHold", func(t *testing.T) {
+		if held, err := client.LegalHold(context.Background(), entry); err != nil || held {
+			t.Fatalf("expected no legal hold yet, received %v, %v", held, err)
+		}
+		if err := client.SetLegalHold(context.Background(), entry, true); err != nil {
+			t.Fatal(err)
+		}
+		if held, err := client.LegalHold(context.Background(), entry); err != nil || !held {
+			t.Fatalf("expected a legal hold, received %v, %v", held, err)
+		}
+		if err := client.Delete(context.Background(), entry); !errors.Is(err, cloud.ErrLocked) {
+			t.Errorf("expected %v, received %v", cloud.ErrLocked, err)
+		}
+
+		if err := client.SetLegalHold(context.Background(), entry, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Delete(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestAS3Harden(t *testing.T) {
+	client, stub, close := newStubAS3(t, "lockedarchive-hardened")
+	defer close()
+	client.Harden = true
+	client.Transitions = []cloud.Transition{{Days: 90, StorageClass: cloud.StorageClassGlacier}}
+
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := stub.buckets[client.Bucket]
+	if !bucket.versioned {
+		t.Error("expected versioning to be enabled")
+	}
+	for subresource, expected := range map[string][]string{
+		"publicAccessBlock": {
+			"<BlockPublicAcls>true</BlockPublicAcls>",
+			"<IgnorePublicAcls>true</IgnorePublicAcls>",
+			"<BlockPublicPolicy>true</BlockPublicPolicy>",
+			"<RestrictPublicBuckets>true</RestrictPublicBuckets>",
+		},
+		"encryption": {"<SSEAlgorithm>AES256</SSEAlgorithm>"},
+		"policy":     {`"aws:SecureTransport":"false"`, `"Effect":"Deny"`, "arn:aws:s3:::" + client.Bucket + "/*"},
+	} {
+		for _, setting := range expected {
+			if !strings.Contains(string(bucket.settings[subresource]), setting) {
+				t.Errorf("expected %s to include %s, received %s", subresource, setting, bucket.settings[subresource])
+			}
+		}
+	}
+	lifecycle := string(bucket.lifecycle)
+	if !strings.Contains(lifecycle, "<DaysAfterInitiation>7</DaysAfterInitiation>") || !strings.Contains(lifecycle, cloud.StorageClassGlacier) {
+		t.Errorf("expected lifecycle to abort abandoned uploads and keep transitions, received %s", lifecycle)
+	}
+
+	t.Run("IAMPolicy", func(t *testing.T) {
+		data, err := client.IAMPolicy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var policy struct {
+			Statement []struct {
+				Effect   string
+				Action   []string
+				Resource []string
+			}
+		}
+		if err := json.Unmarshal(data, &policy); err != nil {
+			t.Fatal(err)
+		}
+		for _, statement := range policy.Statement {
+			for _, resource := range statement.Resource {
+				if resource != "arn:aws:s3:::"+client.Bucket && resource != "arn:aws:s3:::"+client.Bucket+"/*" {
+					t.Errorf("expected policy scoped to the bucket, found resource %s", resource)
+				}
+			}
+			for _, action := range statement.Action {
+				switch action {
+				case "s3:*", "s3:DeleteBucket", "s3:DeleteObjectVersion", "s3:PutBucketPolicy", "s3:PutLifecycleConfiguration", "s3:PutObjectLegalHold":
+					t.Errorf("expected no destructive or administrative actions, found %s", action)
+				}
+			}
+		}
+	})
+}
+
+func TestAS3PresignDownload(t *testing.T) {
+	client, _, close := newStubAS3(t, "lockedarchive-shared")
+	defer close()
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte("encrypted birth certificate")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	entry := cloud.Entry{ID: "birth-certificate"}
+	if err := client.Upload(context.Background(), entry, file); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.PresignDownload(entry, 8*24*time.Hour); err == nil {
+		t.Error("expected a link outliving what S3 allows to be refused")
+	}
+	url, err := client.PresignDownload(entry, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(url, "X-Amz-Expires=3600") {
+		t.Errorf("expected the link to expire in an hour: %s", url)
+	}
+
+	// Fetched without any credentials, as a recipient would
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(client.CACert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assertReaderEquals(t, resp.Body, body)
+}
+
+func TestAS3Connection(t *testing.T) {
+	client, stub, close := newStubAS3(t, "lockedarchive-connection")
+	defer close()
+	client.Region = "eu-west-1"
+
+	var err error
+	if client.AccessKey, err = secure.ProtectSecret([]byte("stored-access-key")); err != nil {
+		t.Fatal(err)
+	}
+	if client.SecretKey, err = secure.ProtectSecret([]byte("stored-secret-key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if location := stub.buckets[client.Bucket].location; location != client.Region {
+		t.Errorf("expected location constraint %s, received %q", client.Region, location)
+	}
+	if stub.accessKey != "stored-access-key" {
+		t.Errorf("expected requests signed with stored credentials, received %q", stub.accessKey)
+	}
+
+	teardown(t, client)
+
+	client.AccessKey.Destroy()
+	client.SecretKey.Destroy()
+	if err := client.CreateArchive(context.Background()); err == nil {
+		t.Error("expected an error once credentials are destroyed")
+	}
 }
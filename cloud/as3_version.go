@@ -0,0 +1,123 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ListVersions returns every stored revision of an Entry, newest first
+func (client *AS3) ListVersions(ctx context.Context, entry Entry) ([]Version, error) {
+	svc, err := client.svc()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(client.Bucket),
+		Prefix: aws.String(entry.ID),
+	}
+	err = svc.ListObjectVersionsPagesWithContext(ctx, input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			if aws.StringValue(version.Key) == entry.ID {
+				versions = append(versions, Version{
+					ID:           aws.StringValue(version.VersionId),
+					Size:         aws.Int64Value(version.Size),
+					LastModified: aws.TimeValue(version.LastModified),
+					IsLatest:     aws.BoolValue(version.IsLatest),
+				})
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			if aws.StringValue(marker.Key) == entry.ID {
+				versions = append(versions, Version{
+					ID:           aws.StringValue(marker.VersionId),
+					LastModified: aws.TimeValue(marker.LastModified),
+					IsLatest:     aws.BoolValue(marker.IsLatest),
+					IsDeleted:    true,
+				})
+			}
+		}
+		return aws.BoolValue(page.IsTruncated)
+	})
+	if err != nil {
+		return nil, evalErr(err)
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].IsLatest != versions[j].IsLatest {
+			return versions[i].IsLatest
+		}
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, nil
+}
+
+// Restore makes a previous revision of an Entry its current one by copying it
+// in place on S3; no data passes through this machine. The revision being
+// replaced is kept as a version of its own. The revision's metadata comes
+// back along with it, as its sidecar (if any) is left in place for it.
+// NOTE: S3 only copies objects of up to 5 GB in a single request
+func (client *AS3) Restore(ctx context.Context, entry Entry, versionID string) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:       aws.String(client.Bucket),
+		Key:          aws.String(entry.ID),
+		CopySource:   aws.String(client.copySource(entry, versionID)),
+		StorageClass: client.storageClass(entry),
+	})
+	return evalErr(err)
+}
+
+// DownloadVersion fetches a specific revision of entry's data from S3
+func (client *AS3) DownloadVersion(ctx context.Context, entry Entry, versionID string) (io.ReadCloser, error) {
+	svc, err := client.svc()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(client.Bucket),
+		Key:       aws.String(entry.ID),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return nil, evalErr(err)
+	}
+
+	return result.Body, nil
+}
+
+// DeleteVersion permanently removes a single revision of an Entry from S3
+func (client *AS3) DeleteVersion(ctx context.Context, entry Entry, versionID string) error {
+	svc, err := client.svc()
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket:    aws.String(client.Bucket),
+		Key:       aws.String(entry.ID),
+		VersionId: aws.String(versionID),
+	})
+	return evalErr(err)
+}
+
+// copySource returns the URL-encoded x-amz-copy-source for a revision of entry
+func (client *AS3) copySource(entry Entry, versionID string) string {
+	source := url.PathEscape(client.Bucket) + "/" + url.PathEscape(entry.ID)
+	if versionID == "" {
+		return source
+	}
+	return fmt.Sprintf("%s?versionId=%s", source, url.QueryEscape(versionID))
+}
@@ -0,0 +1,314 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// Kinds of AuditProblem
+const (
+	AuditMissing    = "missing"    // location lacks an Entry the others hold
+	AuditExtra      = "extra"      // location still holds an Entry that was deleted
+	AuditDifferent  = "different"  // location's size or checksum disagrees with the healthy copy
+	AuditCorrupt    = "corrupt"    // location's data does not match its own checksum; found by deep audits
+	AuditUnreadable = "unreadable" // location lists the Entry but could not be read; see the problem's Error
+)
+
+var (
+	errNoHealthyCopy = errors.New("no location holds a healthy copy")
+)
+
+// AuditOptions decide how thorough an audit is and whether it repairs what it finds
+type AuditOptions struct {
+	Deep            bool // download every copy of every Entry to check its data against its checksum; archived data is skipped
+	RestoreArchived bool // have deep audits start restores of archived data so a later audit can check it; restores are billed
+	Repair          bool // copy ciphertext from a healthy location over every problem found, and delete extras
+}
+
+// AuditReport is the outcome of comparing every location of a Mirror
+// It marshals to JSON, suitable for keeping as a record of the archive's health
+type AuditReport struct {
+	Started   time.Time      `json:"started"`
+	Finished  time.Time      `json:"finished"`
+	Deep      bool           `json:"deep"`
+	Locations []string       `json:"locations"`
+	Entries   int            `json:"entries"` // distinct Entries found across all locations
+	Problems  []AuditProblem `json:"problems"`
+}
+
+// AuditProblem is one Entry at one location disagreeing with the healthy copy
+type AuditProblem struct {
+	ID       string `json:"id"`
+	Location string `json:"location"`
+	Kind     string `json:"kind"`
+	Size     int64  `json:"size"`               // size found at the location
+	Checksum string `json:"checksum,omitempty"` // checksum found at the location
+	Source   string `json:"source,omitempty"`   // location holding the healthy copy
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"` // why the copy could not be read, or the problem repaired
+}
+
+// Healthy reports whether every location agreed, or every problem found was repaired
+func (report *AuditReport) Healthy() bool {
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Audit lists every location and compares the keys, stored sizes and checksums they hold
+// The healthy copy of an Entry is the one most locations up to date with it agree on,
+// the first by name winning ties; repairs copy its ciphertext as stored, never decrypting it
+func (client Mirror) Audit(ctx context.Context, options AuditOptions) (*AuditReport, error) {
+	report := &AuditReport{
+		Started:   time.Now(),
+		Deep:      options.Deep,
+		Locations: client.names(),
+	}
+
+	held := make(map[string]map[string]Entry) // by Entry ID, then location
+	for _, name := range report.Locations {
+		entries, err := listAll(ctx, client.Locations[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if held[entry.ID] == nil {
+				held[entry.ID] = make(map[string]Entry)
+			}
+			held[entry.ID][name] = entry
+		}
+	}
+	report.Entries = len(held)
+
+	for _, id := range sortedKeys(held) {
+		problems, err := client.auditEntry(ctx, id, held[id], options)
+		if err != nil {
+			return nil, err
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// auditEntry compares the copies of one Entry as stored at each location listing it
+func (client Mirror) auditEntry(ctx context.Context, id string, listed map[string]Entry, options AuditOptions) ([]AuditProblem, error) {
+	copies := make(map[string]Entry)
+	var problems []AuditProblem
+	for _, name := range client.names() {
+		stored, exists := listed[name]
+		if !exists {
+			continue
+		}
+		if client.Log.deleted(id) {
+			problems = append(problems, newAuditProblem(AuditExtra, name, stored))
+			continue
+		}
+
+		entry, err := headStored(ctx, client.Locations[name], stored)
+		if err == nil && options.Deep && (options.RestoreArchived || !archivedClass(entry.StorageClass)) {
+			err = verifyData(ctx, client.Locations[name], entry)
+		}
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case errors.Is(err, ErrIntegrity):
+			problems = append(problems, newAuditProblem(AuditCorrupt, name, entry))
+			continue
+		case errors.Is(err, ErrRestorePending), errors.Is(err, ErrArchived):
+			// archived data can only be checked once restored; compare what can be
+		case errors.Is(err, ErrNotFound):
+			continue // deleted since it was listed, so missing
+		case err != nil:
+			problem := newAuditProblem(AuditUnreadable, name, stored)
+			problem.Error = err.Error()
+			problems = append(problems, problem)
+			continue
+		}
+		copies[name] = entry
+	}
+
+	source, healthy := client.healthyCopy(id, copies)
+	for _, name := range client.names() {
+		entry, exists := copies[name]
+		switch {
+		case exists && sameData(entry, healthy):
+			continue
+		case exists:
+			problems = append(problems, newAuditProblem(AuditDifferent, name, entry))
+		case !client.Log.deleted(id) && !hasProblem(problems, name):
+			problems = append(problems, newAuditProblem(AuditMissing, name, Entry{ID: id}))
+		}
+	}
+
+	for i := range problems {
+		if problems[i].Kind != AuditExtra {
+			problems[i].Source = source
+		}
+		if options.Repair {
+			client.repair(ctx, &problems[i])
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// headStored returns the copy of an Entry location listed as stored, with the checksum and
+// storage class stored alongside it; its size stays the size of the data as listed, which
+// Head would replace with the size of the Entry's plaintext
+func headStored(ctx context.Context, location Client, stored Entry) (Entry, error) {
+	headed := Entry{ID: stored.ID}
+	if sealer, ok := location.(SealedClient); ok {
+		if _, err := sealer.HeadSealed(ctx, &headed); err != nil {
+			return stored, err
+		}
+	}
+	if headed.Checksum == "" {
+		// Some locations keep checksums only within encrypted metadata
+		if err := location.Head(ctx, &headed); err != nil {
+			return stored, err
+		}
+	}
+
+	stored.Checksum = headed.Checksum
+	stored.StorageClass = headed.StorageClass
+	return stored, nil
+}
+
+// healthyCopy picks the copy of an Entry most locations up to date with it agree on
+// Returns no source if there is no copy to pick
+func (client Mirror) healthyCopy(id string, copies map[string]Entry) (source string, healthy Entry) {
+	best := 0
+	for _, name := range client.names() {
+		entry, exists := copies[name]
+		if !exists || !client.Log.synced(id, name) {
+			continue
+		}
+		agreeing := 0
+		for _, other := range copies {
+			if sameData(entry, other) {
+				agreeing++
+			}
+		}
+		if agreeing > best {
+			source, healthy, best = name, entry, agreeing
+		}
+	}
+	return
+}
+
+// repair fixes problem, noting whether it succeeded
+func (client Mirror) repair(ctx context.Context, problem *AuditProblem) {
+	target := client.Locations[problem.Location]
+	entry := Entry{ID: problem.ID}
+
+	var err error
+	switch {
+	case problem.Kind == AuditExtra:
+		err = target.Delete(ctx, entry)
+		if err == nil {
+			err = client.Log.record(problem.ID, ReplicaDelete, []string{problem.Location}, nil)
+		}
+	case problem.Source == "":
+		err = errNoHealthyCopy
+	default:
+		var (
+			sealed string
+			file   *os.File
+		)
+		entry, sealed, file, err = client.stageFrom(ctx, client.Locations[problem.Source], problem.ID)
+		if err == nil {
+			err = uploadStaged(ctx, target, entry, sealed, file)
+			file.Close()
+			os.Remove(file.Name())
+		}
+		if err == nil {
+			err = client.Log.record(problem.ID, ReplicaUpload, []string{problem.Location}, nil)
+		}
+	}
+
+	if err != nil {
+		problem.Error = err.Error()
+		return
+	}
+	problem.Repaired = true
+}
+
+func newAuditProblem(kind, location string, entry Entry) AuditProblem {
+	return AuditProblem{
+		ID:       entry.ID,
+		Location: location,
+		Kind:     kind,
+		Size:     entry.Size,
+		Checksum: entry.Checksum,
+	}
+}
+
+func hasProblem(problems []AuditProblem, location string) bool {
+	for _, problem := range problems {
+		if problem.Location == location {
+			return true
+		}
+	}
+	return false
+}
+
+// sameData reports whether two copies of an Entry hold the same data, as far as can be told
+// without reading it: stored sizes must match, and checksums too when both are known
+func sameData(a, b Entry) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	return a.Checksum == "" || b.Checksum == "" || a.Checksum == b.Checksum
+}
+
+// archivedClass reports whether data in storageClass must be restored before it can be read
+func archivedClass(storageClass string) bool {
+	return storageClass == StorageClassGlacier || storageClass == StorageClassDeepArchive
+}
+
+// verifyData reads all of entry's data from location, which checks it against entry's checksum
+func verifyData(ctx context.Context, location Client, entry Entry) error {
+	rc, err := location.Download(ctx, entry)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(ioutil.Discard, rc)
+	return err
+}
+
+// listAll collects every Entry a Client lists
+func listAll(ctx context.Context, client Client) ([]Entry, error) {
+	entries := make(chan Entry)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.List(ctx, entries)
+	}()
+
+	var listed []Entry
+	for entry := range entries {
+		listed = append(listed, entry)
+	}
+	return listed, <-errc
+}
+
+func sortedKeys(held map[string]map[string]Entry) []string {
+	ids := make([]string, 0, len(held))
+	for id := range held {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
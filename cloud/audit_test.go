@@ -0,0 +1,262 @@
+package cloud_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+func TestAudit(t *testing.T) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	locations := make(map[string]cloud.Client)
+	for _, name := range []string{"a", "b", "c"} {
+		local := setupLocal(t).(*cloud.Local)
+		defer os.RemoveAll(filepath.Dir(local.Path))
+		local.Key = kc
+		locations[name] = local
+	}
+	replication, err := cloud.OpenReplicationLog(filepath.Join(filepath.Dir(locations["a"].(*cloud.Local).Path), "replication.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lagging := &outageClient{Client: locations["c"]}
+	mirror := &cloud.Mirror{Locations: locations, Log: replication}
+
+	upload := func(client cloud.Client, id string, body []byte) {
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		checksum := cloud.NewChecksum()
+		checksum.Write(body)
+		if err := client.Upload(context.Background(), cloud.Entry{ID: id, Checksum: checksum.String()}, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload(mirror, "healthy", []byte("passport scan"))
+	upload(mirror, "different", []byte("insurance policy"))
+	upload(locations["b"], "different", []byte("insurance policy, tampered"))
+	upload(mirror, "corrupt", []byte("deed to the house"))
+	upload(locations["a"], "missing", []byte("only written to one location"))
+
+	// Flip a byte on disk, keeping the size and stored checksum as they were
+	if err := ioutil.WriteFile(filepath.Join(locations["c"].(*cloud.Local).Path, "corrupt"), []byte("deed to the mouse"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mirror.Locations["c"] = lagging
+	lagging.down = true
+	if err := mirror.Delete(context.Background(), cloud.Entry{ID: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+	lagging.down = false
+
+	expected := map[string]string{
+		"b/different": cloud.AuditDifferent,
+		"b/missing":   cloud.AuditMissing,
+		"c/missing":   cloud.AuditMissing,
+		"c/corrupt":   cloud.AuditCorrupt,
+		"c/healthy":   cloud.AuditExtra,
+	}
+
+	report, err := mirror.Audit(context.Background(), cloud.AuditOptions{Deep: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProblems(t, report, expected)
+	if report.Healthy() {
+		t.Error("expected report to be unhealthy")
+	}
+	if _, err := json.Marshal(report); err != nil {
+		t.Error(err)
+	}
+
+	repaired, err := mirror.Audit(context.Background(), cloud.AuditOptions{Deep: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProblems(t, repaired, expected)
+	if !repaired.Healthy() {
+		t.Errorf("expected every problem to be repaired: %+v", repaired.Problems)
+	}
+
+	clean, err := mirror.Audit(context.Background(), cloud.AuditOptions{Deep: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProblems(t, clean, nil)
+	if clean.Entries != 3 {
+		t.Errorf("expected 3 entries, received %d", clean.Entries)
+	}
+}
+
+func TestAuditStoredData(t *testing.T) {
+	mirror, cleanup := setupAuditMirror(t, "a", "b", "c")
+	defer cleanup()
+	lagging := &outageClient{Client: mirror.Locations["c"]}
+	mirror.Locations["c"] = lagging
+
+	body := []byte("birth certificate")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	checksum := cloud.NewChecksum()
+	checksum.Write(body)
+	entry := cloud.Entry{ID: "certificate", Size: int64(len(body)), Checksum: checksum.String()}
+	if err := mirror.Upload(context.Background(), entry, file); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		// Metadata, and the size within it, stay as they were
+		path := filepath.Join(mirror.Locations["a"].(*cloud.Local).Path, entry.ID)
+		if err := os.Truncate(path, int64(len(body)-1)); err != nil {
+			t.Fatal(err)
+		}
+		report, err := mirror.Audit(context.Background(), cloud.AuditOptions{Repair: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertProblems(t, report, map[string]string{"a/certificate": cloud.AuditDifferent})
+		if !report.Healthy() {
+			t.Errorf("expected the truncated copy to be repaired: %+v", report.Problems)
+		}
+		if report.Problems[0].Size != int64(len(body)-1) {
+			t.Errorf("expected the size stored, %d, received %d", len(body)-1, report.Problems[0].Size)
+		}
+	})
+	t.Run("Unreadable", func(t *testing.T) {
+		lagging.unreadable = true
+		report, err := mirror.Audit(context.Background(), cloud.AuditOptions{Repair: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertProblems(t, report, map[string]string{"c/certificate": cloud.AuditUnreadable})
+		if report.Problems[0].Error == "" || !report.Healthy() {
+			t.Errorf("expected the unreadable copy to be reported and repaired: %+v", report.Problems)
+		}
+
+		lagging.unreadable = false
+		clean, err := mirror.Audit(context.Background(), cloud.AuditOptions{Deep: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertProblems(t, clean, nil)
+	})
+}
+
+func TestAuditArchived(t *testing.T) {
+	locations := make(map[string]cloud.Client)
+	buckets := make(map[string]*s3StubBucket)
+	for _, name := range []string{"a", "b"} {
+		client, stub, close := newStubAS3(t, "lockedarchive-audit-"+name)
+		defer close()
+		if err := client.CreateArchive(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		locations[name] = client
+		buckets[name] = stub.buckets[client.Bucket]
+	}
+	dir, err := ioutil.TempDir("", "lockedarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replication, err := cloud.OpenReplicationLog(filepath.Join(dir, "replication.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror := &cloud.Mirror{Locations: locations, Log: replication}
+
+	file := makeBodyFile(t, []byte("tax returns, 1998"))
+	defer os.Remove(file.Name())
+	defer file.Close()
+	entry := cloud.Entry{ID: "returns", StorageClass: cloud.StorageClassDeepArchive}
+	if err := mirror.Upload(context.Background(), entry, file); err != nil {
+		t.Fatal(err)
+	}
+	restores := func() (started int) {
+		for _, bucket := range buckets {
+			for _, object := range bucket.objects[entry.ID] {
+				if object.restore != "" {
+					started++
+				}
+			}
+		}
+		return
+	}
+
+	report, err := mirror.Audit(context.Background(), cloud.AuditOptions{Deep: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProblems(t, report, nil)
+	if started := restores(); started != 0 {
+		t.Errorf("expected a deep audit to leave archived data be, %d restores started", started)
+	}
+
+	if _, err := mirror.Audit(context.Background(), cloud.AuditOptions{Deep: true, RestoreArchived: true}); err != nil {
+		t.Fatal(err)
+	}
+	if started := restores(); started != 2 {
+		t.Errorf("expected restores of both copies when asked for, %d started", started)
+	}
+}
+
+// setupAuditMirror returns a Mirror over a Local location for each of names, sharing a key;
+// caller responsible for calling cleanup once done
+func setupAuditMirror(t *testing.T, names ...string) (mirror *cloud.Mirror, cleanup func()) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanups := []func(){kc.Destroy}
+	cleanup = func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+
+	locations := make(map[string]cloud.Client)
+	for _, name := range names {
+		local := setupLocal(t).(*cloud.Local)
+		dir := filepath.Dir(local.Path)
+		cleanups = append(cleanups, func() { os.RemoveAll(dir) })
+		local.Key = kc
+		locations[name] = local
+	}
+	replication, err := cloud.OpenReplicationLog(filepath.Join(filepath.Dir(locations[names[0]].(*cloud.Local).Path), "replication.json"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return &cloud.Mirror{Locations: locations, Log: replication}, cleanup
+}
+
+// assertProblems checks report found exactly the expected problems, keyed by location/id
+func assertProblems(t *testing.T, report *cloud.AuditReport, expected map[string]string) {
+	found := make(map[string]string)
+	for _, problem := range report.Problems {
+		found[problem.Location+"/"+problem.ID] = problem.Kind
+	}
+	if len(found) != len(expected) {
+		t.Errorf("expected problems %v, received %v", expected, found)
+		return
+	}
+	for key, kind := range expected {
+		if found[key] != kind {
+			t.Errorf("expected %s to be %s, received %q", key, kind, found[key])
+		}
+	}
+}
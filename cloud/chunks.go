@@ -0,0 +1,177 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+const (
+	chunkIDPrefix = "chunk~" // IDs of chunk objects
+	chunkRefsID   = chunkIDPrefix + "refs"
+)
+
+var (
+	errChunkNoKey = errors.New("chunk store needs the archive key to encrypt its reference counts")
+)
+
+// ChunkRef is one content-defined chunk of an Entry's data
+type ChunkRef struct {
+	ID   string `json:"i"` // keyed hash of the chunk's plaintext, hex-encoded
+	Size int64  `json:"s"` // bytes of plaintext in the chunk
+}
+
+// ChunkStore keeps the chunks of deduplicated Entries in a Client, each stored once however
+// many Entries hold it. References to each chunk are counted, in an object encrypted with
+// Key, so chunks no Entry holds any longer can be collected safely
+// NOTE: counts are only kept straight with a single writer to the archive at a time
+type ChunkStore struct {
+	Client  Client
+	Key     *secure.KeyContainer // archive key used to encrypt the reference counts
+	TempDir string               // where counts are staged before sending; defaults to the system's
+
+	mutex sync.Mutex
+	refs  map[string]int // references to each stored chunk, by ID; nil until loaded
+	dirty bool           // refs has changes yet to be saved
+}
+
+// Put counts a reference to the chunk with id, calling seal for its encrypted data and
+// uploading it only if it is not stored yet; reports whether it was uploaded
+// The reference counts at once, so Collect never removes a chunk an Entry being written relies on
+func (store *ChunkStore) Put(ctx context.Context, id string, seal func() ([]byte, error)) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.load(ctx); err != nil {
+		return false, err
+	}
+
+	if _, stored := store.refs[id]; stored {
+		store.refs[id]++
+		store.dirty = true
+		return false, nil
+	}
+
+	data, err := seal()
+	if err != nil {
+		return false, err
+	}
+	if err := uploadBytes(ctx, store.Client, store.TempDir, chunkIDPrefix+id, data); err != nil {
+		return false, err
+	}
+	store.refs[id] = 1
+	store.dirty = true
+	return true, nil
+}
+
+// Get opens the encrypted data of the chunk with id; caller responsible for closing
+func (store *ChunkStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	return store.Client.Download(ctx, Entry{ID: chunkIDPrefix + id})
+}
+
+// Release drops entry's references to its chunks, once entry itself is deleted or was never stored
+func (store *ChunkStore) Release(ctx context.Context, entry Entry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.load(ctx); err != nil {
+		return err
+	}
+
+	for _, chunk := range entry.Chunks {
+		if store.refs[chunk.ID] > 0 {
+			store.refs[chunk.ID]--
+			store.dirty = true
+		}
+	}
+	return nil
+}
+
+// Flush saves the reference counts; Entries whose chunks were Put since should not be
+// uploaded until it returns, or their chunks could be collected out from under them
+func (store *ChunkStore) Flush(ctx context.Context) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.load(ctx); err != nil {
+		return err
+	}
+	return store.flush(ctx)
+}
+
+// flush saves the reference counts, then flushes Client if it holds writes back
+func (store *ChunkStore) flush(ctx context.Context) error {
+	if store.dirty {
+		if err := saveSealed(ctx, store.Client, store.Key, store.TempDir, chunkRefsID, store.refs); err != nil {
+			return err
+		}
+		store.dirty = false
+	}
+	if flusher, ok := store.Client.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Collect deletes every chunk no Entry references any longer, along with any chunk the
+// counts do not know of, such as one left behind by an interrupted write; returns how many
+func (store *ChunkStore) Collect(ctx context.Context) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.load(ctx); err != nil {
+		return 0, err
+	}
+
+	stored, err := listAll(ctx, store.Client)
+	if err != nil {
+		return 0, err
+	}
+	var garbage []string
+	for _, entry := range stored {
+		if !strings.HasPrefix(entry.ID, chunkIDPrefix) || entry.ID == chunkRefsID {
+			continue
+		}
+		if id := strings.TrimPrefix(entry.ID, chunkIDPrefix); store.refs[id] == 0 {
+			delete(store.refs, id)
+			store.dirty = true
+			garbage = append(garbage, entry.ID)
+		}
+	}
+
+	for id, refs := range store.refs {
+		if refs == 0 {
+			delete(store.refs, id) // already gone
+			store.dirty = true
+		}
+	}
+
+	// Forget the chunks before deleting them, so a failure part way never leaves counts
+	// claiming a chunk is stored when it is not
+	if err := store.flush(ctx); err != nil {
+		return 0, err
+	}
+	for i, id := range garbage {
+		if err := store.Client.Delete(ctx, Entry{ID: id}); err != nil {
+			return i, err
+		}
+	}
+	return len(garbage), nil
+}
+
+// load reads and decrypts the reference counts, if not already loaded
+func (store *ChunkStore) load(ctx context.Context) error {
+	if store.refs != nil {
+		return nil
+	}
+	if store.Key == nil {
+		return errChunkNoKey
+	}
+
+	refs := make(map[string]int)
+	if err := loadSealed(ctx, store.Client, store.Key, chunkRefsID, &refs); err != nil {
+		return err
+	}
+	store.refs = refs
+	return nil
+}
@@ -2,53 +2,131 @@
 package cloud
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jonathan-robertson/lockedarchive/secure"
+	"github.com/jonathan-robertson/lockedarchive/stream"
 )
 
+// MetaPadding is how Entries' metadata is padded before it is encrypted, so how long
+// their names are says little about them
+const MetaPadding = stream.PowerOfTwo
+
 var (
 	errNoEncryptionKey = errors.New("no encryption key to decrypt for entry")
+	errInvalidRange    = errors.New("range must have a non-negative offset and positive length")
+	errNoSuchVersion   = errors.New("version does not exist for entry")
 )
 
 // Client represents an object storage provider's service
 // NOTE: Uploading and downloading bytes expected to interact with
 // local file system (cache folder)
+// Cancelling the context passed to a method stops its network or disk work and
+// returns the context's error
+// NOTE: DownloadRange offsets are into the data as stored, which for Entries written by
+// cache.Write is compressed, padded and encrypted, so there is no mapping a range of the
+// original file onto it; ranged reads serve ciphertext (e.g. shards and packed members) only
 type Client interface {
-	CreateArchive() error
-	RemoveArchive() error
+	CreateArchive(context.Context) error
+	RemoveArchive(context.Context) error
+
+	List(context.Context, chan Entry) error
 
-	List(chan Entry) error
+	Upload(context.Context, Entry, File) error
+	Head(context.Context, *Entry) error
+	Download(context.Context, Entry) (io.ReadCloser, error)
+	DownloadRange(ctx context.Context, entry Entry, offset, length int64) (io.ReadCloser, error)
+	Update(context.Context, Entry) error
+	Delete(context.Context, Entry) error
 
-	Upload(Entry, *os.File) error
-	Head(Entry) error
-	Download(Entry) (io.ReadCloser, error)
-	Update(Entry) error
-	Delete(Entry) error
+	ListVersions(context.Context, Entry) ([]Version, error)
+	Restore(ctx context.Context, entry Entry, versionID string) error
+}
 
-	// TODO: add these in later
-	// Restore(Entry, int) error
+// File is the data given to Upload; *os.File satisfies it, as do wrappers
+// such as the one Transfer uses to meter reads
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	Stat() (os.FileInfo, error)
 }
 
 // Entry represents a standard object compatible with cloud operations
 type Entry struct {
 	ID string `json:"-"` // ID representing this Entry
 
-	Key          string      `json:"k"` // Encrypted encryption key used to encrypt/decrypt this data
-	ParentID     string      `json:"p"` // ID representing Entry containing this one
-	Name         string      `json:"n"` // Name of this Entry
-	IsDir        bool        `json:"d"` // Whether or not this Entry contains others
-	Size         int64       `json:"s"` // Size of Entry's data
-	LastModified time.Time   `json:"m"` // Last time Entry was updated
-	Mode         os.FileMode `json:"f"` // File Mode
+	Key          string         `json:"k"`           // Encrypted encryption key used to encrypt/decrypt this data
+	ParentID     string         `json:"p"`           // ID representing Entry containing this one
+	Name         string         `json:"n"`           // Name of this Entry
+	IsDir        bool           `json:"d"`           // Whether or not this Entry contains others
+	Size         int64          `json:"s"`           // Size of Entry's data
+	LastModified time.Time      `json:"m"`           // Last time Entry was updated
+	Mode         os.FileMode    `json:"f"`           // File Mode
+	Tags         []string       `json:"t"`           // Labels used to organize Entries
+	Checksum     string         `json:"c"`           // SHA-256 of Entry's encrypted data, base64-encoded
+	Chunks       []ChunkRef     `json:"h,omitempty"` // chunks in a ChunkStore holding Entry's data, in order; empty unless deduplicated
+	Padding      stream.Padding `json:"b,omitempty"` // how Entry's data was padded before it was encrypted; NoPadding if it was not
+
+	StorageClass string `json:"-"` // Provider's storage class for this Entry's data; empty for the archive's default
+}
+
+// Version represents one stored revision of an Entry's data
+type Version struct {
+	ID           string    // Provider's identifier for this revision
+	Size         int64     // Size of this revision's data
+	LastModified time.Time // When this revision was stored
+	IsLatest     bool      // Whether this is the Entry's current revision
+	IsDeleted    bool      // Whether this revision marks the Entry as deleted
+}
+
+// Checksum hashes an Entry's encrypted data as it is written
+type Checksum struct {
+	hash.Hash
+}
+
+// NewChecksum returns an empty Checksum
+func NewChecksum() *Checksum {
+	return &Checksum{Hash: sha256.New()}
+}
+
+// String returns the checksum of the data written so far, in the form kept in Entry
+func (checksum *Checksum) String() string {
+	return base64.StdEncoding.EncodeToString(checksum.Sum(nil))
+}
+
+// verifyingReader returns ErrIntegrity in place of io.EOF if the data read does not match expected
+type verifyingReader struct {
+	io.ReadCloser
+	checksum *Checksum
+	expected string
+}
+
+// verify wraps rc so its data is checked against expected once fully read; rc is returned as is without an expected checksum
+func verify(rc io.ReadCloser, expected string) io.ReadCloser {
+	if expected == "" {
+		return rc
+	}
+	return &verifyingReader{ReadCloser: rc, checksum: NewChecksum(), expected: expected}
+}
 
-	// TODO: add these in later
-	// Tags []string
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.checksum.Write(p[:n])
+	if err == io.EOF && r.checksum.String() != r.expected {
+		return n, ErrIntegrity
+	}
+	return n, err
 }
 
 // Meta returns Entry's encrypted metadata
@@ -60,6 +138,9 @@ func (entry Entry) Meta(kc *secure.KeyContainer) (encryptedMeta string, err erro
 	if err != nil {
 		return
 	}
+	if plaintext, err = stream.PadBytes(MetaPadding, plaintext); err != nil {
+		return
+	}
 
 	nonce, err := secure.GenerateNonce()
 	if err != nil {
@@ -87,9 +168,75 @@ func (entry *Entry) UpdateMeta(encryptedMeta string, kc *secure.KeyContainer) er
 		return err
 	}
 
+	if plaintext, err = stream.UnpadBytes(MetaPadding, plaintext); err != nil {
+		return err
+	}
 	return json.Unmarshal(plaintext, entry)
 }
 
+// loadSealed downloads the object with id from client, decrypting it with kc into v as JSON
+// v is left as is if there is no such object
+func loadSealed(ctx context.Context, client Client, kc *secure.KeyContainer, id string, v interface{}) error {
+	rc, err := client.Download(ctx, Entry{ID: id})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	ciphertext, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	plaintext, err := secure.Decrypt(kc, ciphertext)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// isControlID reports whether id names one of the objects kept to find Entries by, such as
+// an index or the manifest, rather than holding any Entry's data
+// Every read of the archive relies on them, so they are never moved to cold storage
+func isControlID(id string) bool {
+	return id == packIndexID || id == chunkRefsID || strings.HasPrefix(id, manifestIDPrefix)
+}
+
+// saveSealed encrypts v as JSON with kc and uploads it to client as the object with id
+func saveSealed(ctx context.Context, client Client, kc *secure.KeyContainer, tempDir, id string, v interface{}) error {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	nonce, err := secure.GenerateNonce()
+	if err != nil {
+		return err
+	}
+	return uploadBytes(ctx, client, tempDir, id, secure.EncryptAndWipe(kc, nonce, plaintext))
+}
+
+// uploadBytes stages data in a temporary file under tempDir and uploads it to client as the object with id
+func uploadBytes(ctx context.Context, client Client, tempDir, id string, data []byte) error {
+	tmp, err := ioutil.TempFile(tempDir, "."+id)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	checksum := NewChecksum()
+	checksum.Write(data)
+	return client.Upload(ctx, Entry{ID: id, Checksum: checksum.String()}, tmp)
+}
+
 // TODO
 // func (entry Entry) decryptKey() (secure.Key, error) {
 // 	if len(entry.Key) == 0 {
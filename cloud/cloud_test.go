@@ -1,23 +1,317 @@
 package cloud_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
 )
 
 func TestEntry(t *testing.T) {
 	entry := cloud.Entry{
 		Key:          "123456789",
-		ParentKey:    "987654321",
+		ParentID:     "987654321",
 		Name:         "Important.doc",
 		IsDir:        false,
 		Size:         153432,
-		LastModified: time.Now(),
-		Mode:         nil,
+		LastModified: time.Now().Round(0),
+		Mode:         0600,
+		Tags:         []string{"taxes", "2017"},
 	}
 
-	t.Fail("not implemented")
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	meta, err := entry.Meta(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded cloud.Entry
+	if err := decoded.UpdateMeta(meta, kc); err != nil {
+		t.Fatal(err)
+	}
+
+	if !decoded.LastModified.Equal(entry.LastModified) {
+		t.Fatalf("LastModified before and after does not match\nbefore: %v\nafter: %v", entry.LastModified, decoded.LastModified)
+	}
+	decoded.LastModified = entry.LastModified
+	if !reflect.DeepEqual(decoded, entry) {
+		t.Fatalf("entry before and after metadata encryption does not match\nbefore: %+v\nafter: %+v", entry, decoded)
+	}
+
+	// Names of different lengths encrypt to metadata of the same length
+	renamed := entry
+	renamed.Name = "2017 Federal and State Tax Return.pdf"
+	renamedMeta, err := renamed.Meta(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renamedMeta) != len(meta) {
+		t.Errorf("expected padded metadata to hide name length, received %d and %d bytes", len(meta), len(renamedMeta))
+	}
+
+	t.Log("entry metadata encrypted and decrypted to get same result")
 	// TODO: need to finish deciding on how to encrypt/decrypt entry.Key first
 }
+
+// runClientTests exercises the behavior every Client is expected to share,
+// starting from and ending with an empty archive
+func runClientTests(t *testing.T, client cloud.Client) {
+	var (
+		entry = cloud.Entry{
+			ID: "123",
+		}
+		body = []byte("This is a test set of data and it is very nice")
+	)
+	checksum := cloud.NewChecksum()
+	checksum.Write(body)
+	entry.Checksum = checksum.String()
+
+	t.Run("CreateExisting", func(t *testing.T) {
+		if err := client.CreateArchive(context.Background()); !errors.Is(err, cloud.ErrArchiveExists) {
+			t.Errorf("expected %v, received %v", cloud.ErrArchiveExists, err)
+		}
+	})
+	t.Run("NotFound", func(t *testing.T) {
+		missing := cloud.Entry{ID: "missing"}
+		if err := client.Head(context.Background(), &missing); !errors.Is(err, cloud.ErrNotFound) {
+			t.Errorf("expected %v from Head, received %v", cloud.ErrNotFound, err)
+		}
+		if _, err := client.Download(context.Background(), missing); !errors.Is(err, cloud.ErrNotFound) {
+			t.Errorf("expected %v from Download, received %v", cloud.ErrNotFound, err)
+		}
+		if err := client.Update(context.Background(), missing); !errors.Is(err, cloud.ErrNotFound) {
+			t.Errorf("expected %v from Update, received %v", cloud.ErrNotFound, err)
+		}
+	})
+	t.Run("Upload", func(t *testing.T) {
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if err := client.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("Head", func(t *testing.T) {
+		headed := cloud.Entry{ID: entry.ID}
+		if err := client.Head(context.Background(), &headed); err != nil {
+			t.Fatal(err)
+		}
+		if headed.Size != int64(len(body)) || headed.LastModified.IsZero() {
+			t.Errorf("expected Head to fill in size and last modified: %+v", headed)
+		}
+	})
+	t.Run("Download", func(t *testing.T) {
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Errorf("downloaded data does not match uploaded data\nexpected: %s\nreceived: %s", body, data)
+		}
+	})
+	t.Run("UploadCorrupted", func(t *testing.T) {
+		file := makeBodyFile(t, append([]byte("x"), body[1:]...))
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		corrupted := entry
+		corrupted.ID = "corrupted"
+		if err := client.Upload(context.Background(), corrupted, file); !errors.Is(err, cloud.ErrIntegrity) {
+			t.Errorf("expected %v, received %v", cloud.ErrIntegrity, err)
+		}
+	})
+	t.Run("DownloadCorrupted", func(t *testing.T) {
+		mismatched := entry
+		mismatched.Checksum = "bm90IHRoZSBjaGVja3N1bQ=="
+		rc, err := client.Download(context.Background(), mismatched)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		if _, err := ioutil.ReadAll(rc); !errors.Is(err, cloud.ErrIntegrity) {
+			t.Errorf("expected %v, received %v", cloud.ErrIntegrity, err)
+		}
+	})
+	t.Run("DownloadRange", func(t *testing.T) {
+		rc, err := client.DownloadRange(context.Background(), entry, 5, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body[5:15]) {
+			t.Errorf("downloaded range does not match uploaded data\nexpected: %s\nreceived: %s", body[5:15], data)
+		}
+	})
+	t.Run("ListVersions", func(t *testing.T) {
+		versions, err := client.ListVersions(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) == 0 || !versions[0].IsLatest || versions[0].Size != int64(len(body)) {
+			t.Fatalf("expected current version to be listed first: %+v", versions)
+		}
+		if err := client.Restore(context.Background(), entry, versions[0].ID); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("Update", func(t *testing.T) {
+		if err := client.Update(context.Background(), entry); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("List", func(t *testing.T) {
+		entries := make(chan cloud.Entry)
+		go func() {
+			if err := client.List(context.Background(), entries); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		var count int
+		for listed := range entries {
+			t.Logf("list: %+v", listed)
+			if listed.ID != entry.ID || listed.Size != int64(len(body)) || listed.LastModified.IsZero() {
+				t.Errorf("unexpected entry listed: %+v", listed)
+			}
+			count++
+		}
+		if count != 1 {
+			t.Errorf("expected 1 entry to be listed, received %d", count)
+		}
+	})
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if err := client.Upload(ctx, entry, file); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v from Upload, received %v", context.Canceled, err)
+		}
+		if err := client.List(ctx, make(chan cloud.Entry)); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v from List, received %v", context.Canceled, err)
+		}
+	})
+	t.Run("RemoveNonEmpty", func(t *testing.T) {
+		if err := client.RemoveArchive(context.Background()); !errors.Is(err, cloud.ErrArchiveNotEmpty) {
+			t.Errorf("expected %v when removing an archive that still contains objects, received %v", cloud.ErrArchiveNotEmpty, err)
+		}
+	})
+	t.Run("Delete", func(t *testing.T) {
+		if err := client.Delete(context.Background(), entry); err != nil {
+			t.Error(err)
+		}
+		if err := client.Delete(context.Background(), entry); err != nil {
+			t.Errorf("deleting a missing entry should not error: %v", err)
+		}
+	})
+}
+
+// runMetaTests exercises storing and reading back encrypted metadata with a
+// client holding an archive key, starting from and ending with an empty archive
+func runMetaTests(t *testing.T, client cloud.Client, entry cloud.Entry) {
+	file := makeBodyFile(t, []byte("scanned birth certificate"))
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	entry.Name = "birth-certificate.pdf"
+	entry.ParentID = "documents"
+	if err := client.Upload(context.Background(), entry, file); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Upload", func(t *testing.T) { assertHeadMatches(t, client, entry) })
+	t.Run("Update", func(t *testing.T) {
+		entry.Name = "Birth Certificate.pdf"
+		entry.ParentID = "identity"
+		entry.Tags = []string{"family", "dmv"}
+		if err := client.Update(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		assertHeadMatches(t, client, entry)
+	})
+	t.Run("UpdateLarge", func(t *testing.T) {
+		entry.Name = strings.Repeat("very long name ", 200)
+		if err := client.Update(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		assertHeadMatches(t, client, entry)
+	})
+	t.Run("UpdateSmall", func(t *testing.T) {
+		entry.Name = "birth-certificate.pdf"
+		if err := client.Update(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		assertHeadMatches(t, client, entry)
+	})
+
+	if err := client.Delete(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertHeadMatches fails the test if the metadata Head reads back for entry differs from entry
+func assertHeadMatches(t *testing.T, client cloud.Client, entry cloud.Entry) {
+	headed := cloud.Entry{ID: entry.ID}
+	if err := client.Head(context.Background(), &headed); err != nil {
+		t.Fatal(err)
+	}
+	if headed.Name != entry.Name || headed.ParentID != entry.ParentID || !reflect.DeepEqual(headed.Tags, entry.Tags) {
+		t.Errorf("metadata read back does not match\nexpected: %+v\nreceived: %+v", entry, headed)
+	}
+}
+
+// assertReaderEquals fails the test if r does not hold exactly expected
+func assertReaderEquals(t *testing.T, r io.Reader, expected []byte) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("data does not match\nexpected: %s\nreceived: %s", expected, data)
+	}
+}
+
+// makeBodyFile writes body to a temp file and rewinds it; caller responsible for closing and removing
+func makeBodyFile(t *testing.T, body []byte) *os.File {
+	file, err := ioutil.TempFile("", "lockedarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
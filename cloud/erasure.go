@@ -0,0 +1,752 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	erasureMagic      = "LAEC"
+	erasureVersion    = 1
+	erasureHeaderSize = 52        // magic, version, shard index, data shards, total shards, size, stripe, checksum
+	erasureStripeSize = 64 * 1024 // most bytes each shard holds per stripe
+)
+
+var (
+	errShardHeader      = errors.New("object is not an erasure coded shard")
+	errErasureVersions  = errors.New("erasure coded entries cannot be restored to an older version")
+	errShardsDisagree   = errors.New("shard belongs to a different write than the others")
+	errNotEnoughHealthy = errors.New("not enough healthy shards to rebuild entry")
+)
+
+// Erasure splits each Entry's encrypted data into DataShards data shards plus parity
+// shards, keeping one shard at each location; any DataShards locations are enough to
+// rebuild the data, so up to len(Locations)-DataShards providers can be lost for far less
+// than the cost of mirroring to all of them
+// Each shard carries a header saying which shard it is and what it rebuilds, so locations
+// may be renamed or reordered later; every location also keeps the Entry's metadata as
+// given, Size included, with only its checksum replaced by the shard's
+// Writes succeed once DataShards+1 locations accept them, so the Entry can still survive
+// losing one more; locations that miss a write are marked pending in Log until CatchUp
+// rebuilds their shard from the others, and reads leave them out until then. Without a
+// Log, writes must reach every location
+// NOTE: a write that fails should be made again; until then reads rebuild from whichever
+// write the first healthy shard found belongs to
+type Erasure struct {
+	Locations  map[string]Client // shard i is written to the i-th name in order
+	DataShards int               // shards needed to rebuild; the rest of the locations hold parity
+	Log        *ReplicationLog   // shards each location missed; may be nil
+	TempDir    string            // where shards are staged; defaults to the system's
+}
+
+// ErasureClient returns a Client spreading each Entry across locations, any dataShards
+// of which can rebuild it, tracking the shards each location missed in log
+func ErasureClient(locations map[string]Client, dataShards int, log *ReplicationLog) Client {
+	return &Erasure{
+		Locations:  locations,
+		DataShards: dataShards,
+		Log:        log,
+	}
+}
+
+// shardHeader describes a shard and the data its set of shards rebuilds
+type shardHeader struct {
+	index, data, total int
+	size               int64  // bytes of data the shards rebuild
+	stripe             int64  // bytes each shard holds per stripe
+	checksum           []byte // SHA-256 of the data the shards rebuild
+}
+
+func (header shardHeader) marshal() []byte {
+	b := make([]byte, erasureHeaderSize)
+	copy(b, erasureMagic)
+	b[4] = erasureVersion
+	b[5] = byte(header.index)
+	b[6] = byte(header.data)
+	b[7] = byte(header.total)
+	binary.BigEndian.PutUint64(b[8:], uint64(header.size))
+	binary.BigEndian.PutUint32(b[16:], uint32(header.stripe))
+	copy(b[20:], header.checksum)
+	return b
+}
+
+func parseShardHeader(b []byte) (shardHeader, error) {
+	if len(b) < erasureHeaderSize || string(b[:4]) != erasureMagic || b[4] != erasureVersion {
+		return shardHeader{}, errShardHeader
+	}
+	header := shardHeader{
+		index:    int(b[5]),
+		data:     int(b[6]),
+		total:    int(b[7]),
+		size:     int64(binary.BigEndian.Uint64(b[8:])),
+		stripe:   int64(binary.BigEndian.Uint32(b[16:])),
+		checksum: append([]byte(nil), b[20:erasureHeaderSize]...),
+	}
+	if header.index >= header.total || header.data < 1 || header.data > header.total ||
+		header.size < 0 || (header.size > 0 && header.stripe < 1) {
+		return shardHeader{}, errShardHeader
+	}
+	return header, nil
+}
+
+// stripes returns how many stripes the data is spread over
+func (header shardHeader) stripes() int64 {
+	if header.size == 0 {
+		return 0
+	}
+	width := header.stripe * int64(header.data)
+	return (header.size + width - 1) / width
+}
+
+// sameWrite reports whether two shards were written together, and so rebuild the same data
+func (header shardHeader) sameWrite(other shardHeader) bool {
+	return header.data == other.data && header.total == other.total && header.size == other.size &&
+		header.stripe == other.stripe && bytes.Equal(header.checksum, other.checksum)
+}
+
+func (header shardHeader) checksumString() string {
+	return base64.StdEncoding.EncodeToString(header.checksum)
+}
+
+// CreateArchive creates the archive at every location
+func (client Erasure) CreateArchive(ctx context.Context) error {
+	return joinLocationErrs(eachLocation(client.Locations, func(name string, location Client) error {
+		return location.CreateArchive(ctx)
+	}))
+}
+
+// RemoveArchive removes the archive from every location
+func (client Erasure) RemoveArchive(ctx context.Context) error {
+	return joinLocationErrs(eachLocation(client.Locations, func(name string, location Client) error {
+		return location.RemoveArchive(ctx)
+	}))
+}
+
+// List collects every Entry held at any location; closes Entry chan when done
+// Fails only if no location could be listed
+// NOTE: listed sizes are those of the stored shards; Head reports the Entry's own
+func (client Erasure) List(ctx context.Context, entries chan Entry) error {
+	defer close(entries)
+
+	listed := make(map[string]bool)
+	var (
+		found []Entry
+		errs  []error
+	)
+	for _, name := range locationNames(client.Locations) {
+		held, err := listAll(ctx, client.Locations[name])
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		for _, entry := range held {
+			if !listed[entry.ID] {
+				listed[entry.ID] = true
+				found = append(found, entry)
+			}
+		}
+	}
+	if len(errs) == len(client.Locations) {
+		if len(errs) == 0 {
+			return errNoLocations
+		}
+		return errors.Join(errs...)
+	}
+
+	for _, entry := range found {
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Upload encodes entry's data into shards and sends one to each location at once
+// Data not matching entry's checksum is refused with ErrIntegrity
+func (client Erasure) Upload(ctx context.Context, entry Entry, file File) error {
+	names := locationNames(client.Locations)
+	rs, err := newReedSolomon(client.DataShards, len(names))
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	shards, err := client.encode(ctx, rs, io.NewSectionReader(file, 0, info.Size()), info.Size(), entry.Checksum)
+	defer func() {
+		for _, shard := range shards {
+			shard.Close()
+			os.Remove(shard.Name())
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	return client.write(entry.ID, ReplicaUpload, func(name string, location Client) error {
+		return uploadShard(ctx, location, entry, shards[indexOf(names, name)])
+	})
+}
+
+// uploadShard sends shard to location, stored with entry's metadata and the shard's own checksum
+func uploadShard(ctx context.Context, location Client, entry Entry, shard *os.File) error {
+	checksum, err := checksumFile(shard)
+	if err != nil {
+		return err
+	}
+	entry.Checksum = checksum
+	return location.Upload(ctx, entry, shard)
+}
+
+// encode writes data's shards into temporary files, returning them all even on failure so
+// they can be removed; caller responsible for closing and removing them
+func (client Erasure) encode(ctx context.Context, rs *reedSolomon, data io.Reader, size int64, expected string) ([]*os.File, error) {
+	shards := make([]*os.File, 0, rs.total)
+	for i := 0; i < rs.total; i++ {
+		shard, err := ioutil.TempFile(client.TempDir, ".shard")
+		if err != nil {
+			return shards, err
+		}
+		shards = append(shards, shard)
+		if _, err := shard.Write(make([]byte, erasureHeaderSize)); err != nil { // filled in once the checksum is known
+			return shards, err
+		}
+	}
+
+	header := shardHeader{data: rs.data, total: rs.total, size: size}
+	if size > 0 {
+		header.stripe = (size + int64(rs.data) - 1) / int64(rs.data)
+		if header.stripe > erasureStripeSize {
+			header.stripe = erasureStripeSize
+		}
+	}
+
+	hash := sha256.New()
+	data = io.TeeReader(&contextReader{ctx: ctx, Reader: data}, hash)
+	pieces := make([][]byte, rs.total)
+	for i := range pieces {
+		pieces[i] = make([]byte, header.stripe)
+	}
+	for stripe := int64(0); stripe < header.stripes(); stripe++ {
+		for i := 0; i < rs.data; i++ {
+			n, err := io.ReadFull(data, pieces[i])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return shards, err
+			}
+			for j := n; j < len(pieces[i]); j++ {
+				pieces[i][j] = 0 // pad the last stripe
+			}
+		}
+		rs.encode(pieces)
+		for i, shard := range shards {
+			if _, err := shard.Write(pieces[i]); err != nil {
+				return shards, err
+			}
+		}
+	}
+
+	header.checksum = hash.Sum(nil)
+	if expected != "" && header.checksumString() != expected {
+		return shards, ErrIntegrity
+	}
+	for i, shard := range shards {
+		header.index = i
+		if _, err := shard.WriteAt(header.marshal(), 0); err != nil {
+			return shards, err
+		}
+		if _, err := shard.Seek(0, io.SeekStart); err != nil {
+			return shards, err
+		}
+	}
+	return shards, nil
+}
+
+// Head fills in entry's properties and metadata from the first location able to give
+// them, with the checksum of the data its shards rebuild
+func (client Erasure) Head(ctx context.Context, entry *Entry) error {
+	var errs []error
+	for _, name := range client.holding(entry.ID) {
+		location := client.Locations[name]
+		headed := *entry
+		err := location.Head(ctx, &headed)
+		var header shardHeader
+		if err == nil {
+			header, err = readShardHeader(ctx, location, headed.ID)
+		}
+		if err == nil {
+			headed.Checksum = header.checksumString()
+			*entry = headed
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if len(errs) == 0 {
+		return errNoLocations
+	}
+	return errors.Join(errs...)
+}
+
+// Download rebuilds entry's data from the first healthy shards found, falling back to
+// others when a location fails or its shard is damaged; caller responsible for closing
+// Reading the data to the end returns ErrIntegrity instead of io.EOF if it does not match its checksum
+func (client Erasure) Download(ctx context.Context, entry Entry) (io.ReadCloser, error) {
+	file, header, err := client.rebuild(ctx, entry.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := entry.Checksum
+	if expected == "" {
+		expected = header.checksumString()
+	}
+	return verify(&readCloser{
+		Reader: &contextReader{ctx: ctx, Reader: file},
+		Closer: &removingCloser{file},
+	}, expected), nil
+}
+
+// rebuild stages healthy shards of the Entry with id and decodes its data into a
+// temporary file, returned rewound; caller responsible for closing and removing it
+func (client Erasure) rebuild(ctx context.Context, id string) (*os.File, shardHeader, error) {
+	var (
+		first  *shardHeader
+		shards []*os.File
+		errs   []error
+		found  int
+	)
+	defer func() {
+		for _, shard := range shards {
+			if shard != nil {
+				shard.Close()
+				os.Remove(shard.Name())
+			}
+		}
+	}()
+
+	for _, name := range client.holding(id) {
+		if first != nil && found == first.data {
+			break
+		}
+		shard, header, err := client.stageShard(ctx, client.Locations[name], id)
+		if err == nil && first != nil && (!header.sameWrite(*first) || shards[header.index] != nil) {
+			shard.Close()
+			os.Remove(shard.Name())
+			err = errShardsDisagree
+		}
+		if ctx.Err() != nil {
+			return nil, shardHeader{}, ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if first == nil {
+			first = &header
+			shards = make([]*os.File, header.total)
+		}
+		shards[header.index] = shard
+		found++
+	}
+	if first == nil || found < first.data {
+		return nil, shardHeader{}, errors.Join(append([]error{errNotEnoughHealthy}, errs...)...)
+	}
+
+	rs, err := newReedSolomon(first.data, first.total)
+	if err != nil {
+		return nil, shardHeader{}, err
+	}
+	file, err := ioutil.TempFile(client.TempDir, "."+id)
+	if err != nil {
+		return nil, shardHeader{}, err
+	}
+	if err = client.decode(ctx, rs, *first, shards, file); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, shardHeader{}, err
+	}
+	return file, *first, nil
+}
+
+// decode writes the data rebuilt from shards, nil where missing, to w
+func (client Erasure) decode(ctx context.Context, rs *reedSolomon, header shardHeader, shards []*os.File, w io.Writer) error {
+	remaining := header.size
+	pieces := make([][]byte, header.total)
+	for stripe := int64(0); stripe < header.stripes(); stripe++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for i, shard := range shards {
+			pieces[i] = nil
+			if shard == nil {
+				continue
+			}
+			pieces[i] = make([]byte, header.stripe)
+			if _, err := shard.ReadAt(pieces[i], erasureHeaderSize+stripe*header.stripe); err != nil {
+				return err
+			}
+		}
+		if err := rs.reconstruct(pieces); err != nil {
+			return err
+		}
+		for i := 0; i < header.data && remaining > 0; i++ {
+			piece := pieces[i]
+			if int64(len(piece)) > remaining {
+				piece = piece[:remaining]
+			}
+			if _, err := w.Write(piece); err != nil {
+				return err
+			}
+			remaining -= int64(len(piece))
+		}
+	}
+	return nil
+}
+
+// stageShard copies the shard of the Entry with id held at location into a temporary
+// file, checking it against the checksum stored with it
+func (client Erasure) stageShard(ctx context.Context, location Client, id string) (*os.File, shardHeader, error) {
+	entry := Entry{ID: id}
+	if err := location.Head(ctx, &entry); err != nil {
+		return nil, shardHeader{}, err
+	}
+	rc, err := location.Download(ctx, entry)
+	if err != nil {
+		return nil, shardHeader{}, err
+	}
+	defer rc.Close()
+
+	shard, err := ioutil.TempFile(client.TempDir, ".shard")
+	if err != nil {
+		return nil, shardHeader{}, err
+	}
+	b := make([]byte, erasureHeaderSize)
+	var header shardHeader
+	if _, err = io.Copy(shard, rc); err == nil { // ErrIntegrity if the shard is damaged
+		if _, err = shard.ReadAt(b, 0); err == io.EOF {
+			err = errShardHeader
+		}
+	}
+	if err == nil {
+		header, err = parseShardHeader(b)
+	}
+	if err != nil {
+		shard.Close()
+		os.Remove(shard.Name())
+		return nil, shardHeader{}, err
+	}
+	return shard, header, nil
+}
+
+// DownloadRange rebuilds length bytes of entry's data, starting at offset, from the stripes
+// of the first shards found covering them; caller responsible for closing
+// Reading past the end of the data returns only the bytes available
+func (client Erasure) DownloadRange(ctx context.Context, entry Entry, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 1 {
+		return nil, errInvalidRange
+	}
+
+	var (
+		first       *shardHeader
+		pieces      [][]byte
+		errs        []error
+		found       int
+		start, stop int64 // stripes covering the range
+	)
+	for _, name := range client.holding(entry.ID) {
+		if first != nil && found == first.data {
+			break
+		}
+		location := client.Locations[name]
+		header, err := readShardHeader(ctx, location, entry.ID)
+		if err == nil && first != nil && (!header.sameWrite(*first) || pieces[header.index] != nil) {
+			err = errShardsDisagree
+		}
+		if err == nil && first == nil {
+			if offset >= header.size {
+				return ioutil.NopCloser(bytes.NewReader(nil)), nil
+			}
+			width := header.stripe * int64(header.data)
+			start, stop = offset/width, (offset+length-1)/width+1
+			if stop > header.stripes() {
+				stop = header.stripes()
+			}
+		}
+		var piece []byte
+		if err == nil {
+			piece, err = readShardRange(ctx, location, entry.ID, erasureHeaderSize+start*header.stripe, (stop-start)*header.stripe)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if first == nil {
+			first = &header
+			pieces = make([][]byte, header.total)
+		}
+		pieces[header.index] = piece
+		found++
+	}
+	if first == nil || found < first.data {
+		return nil, errors.Join(append([]error{errNotEnoughHealthy}, errs...)...)
+	}
+
+	rs, err := newReedSolomon(first.data, first.total)
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	stripe := make([][]byte, first.total)
+	for s := int64(0); s < stop-start; s++ {
+		for i, piece := range pieces {
+			stripe[i] = nil
+			if piece != nil {
+				stripe[i] = piece[s*first.stripe : (s+1)*first.stripe]
+			}
+		}
+		if err := rs.reconstruct(stripe); err != nil {
+			return nil, err
+		}
+		for i := 0; i < first.data; i++ {
+			data.Write(stripe[i])
+		}
+	}
+
+	begin := offset - start*first.stripe*int64(first.data)
+	end := begin + length
+	if limit := first.size - start*first.stripe*int64(first.data); end > limit {
+		end = limit
+	}
+	return ioutil.NopCloser(bytes.NewReader(data.Bytes()[begin:end])), nil
+}
+
+// Update replaces entry's metadata at every location at once, keeping each shard's own checksum
+func (client Erasure) Update(ctx context.Context, entry Entry) error {
+	return client.write(entry.ID, ReplicaUpdate, func(name string, location Client) error {
+		shard := Entry{ID: entry.ID}
+		if err := location.Head(ctx, &shard); err != nil {
+			return err
+		}
+		updated := entry
+		updated.Checksum = shard.Checksum
+		return location.Update(ctx, updated)
+	})
+}
+
+// Delete removes entry's shards from every location at once
+func (client Erasure) Delete(ctx context.Context, entry Entry) error {
+	return client.write(entry.ID, ReplicaDelete, func(name string, location Client) error {
+		return location.Delete(ctx, entry)
+	})
+}
+
+// ListVersions returns the revisions of entry's shard at the first location able to list them
+// NOTE: sizes are those of the shards; older revisions cannot be restored, as each
+// location keeps its own
+func (client Erasure) ListVersions(ctx context.Context, entry Entry) ([]Version, error) {
+	var errs []error
+	for _, name := range locationNames(client.Locations) {
+		versions, err := client.Locations[name].ListVersions(ctx, entry)
+		if err == nil {
+			return versions, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if len(errs) == 0 {
+		return nil, errNoLocations
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Restore is not supported: the locations' revisions of a shard cannot be matched up
+func (client Erasure) Restore(ctx context.Context, entry Entry, versionID string) error {
+	return errErasureVersions
+}
+
+// CatchUp rebuilds location's shard of every Entry whose write it missed from the shards
+// held elsewhere, or repeats the delete it missed
+// Entries that cannot catch up yet stay pending, and their errors are returned together
+func (client Erasure) CatchUp(ctx context.Context, location string) error {
+	target, exists := client.Locations[location]
+	if !exists {
+		return errUnknownLocation
+	}
+	if client.Log == nil {
+		return nil // nothing can have been missed
+	}
+
+	var errs []error
+	for _, id := range client.Log.Pending(location) {
+		op := client.Log.Status(id)[location].Op
+		err := client.catchUp(ctx, location, target, id, op)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var failures map[string]error
+		if err != nil {
+			failures = map[string]error{location: err}
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+		if err := client.Log.record(id, op, []string{location}, failures); err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// catchUp repeats the write op for the Entry with id at target, the location called name
+// Uploads and updates alike are repeated by encoding the data again and sending target its shard
+func (client Erasure) catchUp(ctx context.Context, name string, target Client, id, op string) error {
+	if op == ReplicaDelete {
+		return target.Delete(ctx, Entry{ID: id})
+	}
+
+	entry := Entry{ID: id}
+	if err := client.Head(ctx, &entry); err != nil {
+		return err
+	}
+	data, header, err := client.rebuild(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	rs, err := newReedSolomon(header.data, header.total)
+	if err != nil {
+		return err
+	}
+	shards, err := client.encode(ctx, rs, data, header.size, entry.Checksum)
+	defer func() {
+		for _, shard := range shards {
+			shard.Close()
+			os.Remove(shard.Name())
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	return uploadShard(ctx, target, entry, shards[indexOf(locationNames(client.Locations), name)])
+}
+
+// write runs op against every location at once and records in Log how each fared
+// It fails unless DataShards+1 locations accepted the write, or all of them without a Log
+func (client Erasure) write(entryID, kind string, op func(name string, location Client) error) error {
+	names := locationNames(client.Locations)
+	if len(names) == 0 {
+		return errNoLocations
+	}
+
+	errs := eachLocation(client.Locations, op)
+	needed := client.DataShards + 1
+	if needed > len(names) {
+		needed = len(names)
+	}
+	if client.Log == nil || len(names)-len(errs) < needed {
+		return joinLocationErrs(errs)
+	}
+	return client.Log.record(entryID, kind, names, errs)
+}
+
+// holding returns the names, in order, of the locations holding a shard from the latest
+// write of the Entry with id
+func (client Erasure) holding(id string) []string {
+	names := locationNames(client.Locations)
+	if client.Log == nil {
+		return names
+	}
+	held := names[:0]
+	for _, name := range names {
+		if client.Log.synced(id, name) {
+			held = append(held, name)
+		}
+	}
+	return held
+}
+
+// readShardHeader reads the header of the shard of the Entry with id held at location
+func readShardHeader(ctx context.Context, location Client, id string) (shardHeader, error) {
+	b, err := readShardRange(ctx, location, id, 0, erasureHeaderSize)
+	if err != nil {
+		return shardHeader{}, err
+	}
+	return parseShardHeader(b)
+}
+
+// readShardRange reads length bytes of the shard of the Entry with id held at location, starting at offset
+func readShardRange(ctx context.Context, location Client, id string, offset, length int64) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	rc, err := location.DownloadRange(ctx, Entry{ID: id}, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, errShardHeader // shorter than its header says it should be
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// checksumFile returns the checksum of file's contents, leaving it rewound
+func checksumFile(file *os.File) (string, error) {
+	checksum := NewChecksum()
+	if _, err := io.Copy(checksum, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+		return "", err
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return checksum.String(), err
+}
+
+func indexOf(names []string, name string) int {
+	for i := range names {
+		if names[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// removingCloser closes and removes a temporary file
+type removingCloser struct {
+	file *os.File
+}
+
+func (closer *removingCloser) Close() error {
+	err := closer.file.Close()
+	os.Remove(closer.file.Name())
+	return err
+}
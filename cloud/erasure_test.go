@@ -0,0 +1,224 @@
+package cloud_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+func TestErasure(t *testing.T) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	locals := make(map[string]*cloud.Local)
+	locations := make(map[string]cloud.Client)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		local := setupLocal(t).(*cloud.Local)
+		defer os.RemoveAll(filepath.Dir(local.Path))
+		local.Key = kc
+		locals[name] = local
+		locations[name] = local
+	}
+	// Reads try the first lagging location first, so would find its stale shards if they looked
+	lagging, alsoLagging := &outageClient{Client: locals["a"]}, &outageClient{Client: locals["b"]}
+	locations["a"], locations["b"] = lagging, alsoLagging
+
+	replication, err := cloud.OpenReplicationLog(filepath.Join(filepath.Dir(locals["a"].Path), "replication.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := cloud.ErasureClient(locations, 3, replication)
+
+	// Large enough to span several stripes, and not a multiple of any of them
+	body := make([]byte, 400*1024+7)
+	rand.New(rand.NewSource(1)).Read(body)
+	checksum := cloud.NewChecksum()
+	checksum.Write(body)
+	// Size is the caller's own, as a plaintext size would be, and so unlike the data's length
+	entry := cloud.Entry{ID: "scan", Name: "scan.tiff", Size: 300 * 1024, Checksum: checksum.String()}
+
+	upload := func(entry cloud.Entry, body []byte) {
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := client.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	download := func(entry cloud.Entry, expected []byte) {
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("rebuilt %d bytes not matching the %d uploaded", len(data), len(expected))
+		}
+	}
+	downloadRange := func(offset, length int64) {
+		rc, err := client.DownloadRange(context.Background(), entry, offset, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		end := offset + length
+		if end > int64(len(body)) {
+			end = int64(len(body))
+		}
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body[offset:end]) {
+			t.Errorf("range %d+%d does not match uploaded data", offset, length)
+		}
+	}
+	upload(entry, body)
+
+	t.Run("Shards", func(t *testing.T) {
+		for name, location := range locations {
+			stored := cloud.Entry{ID: entry.ID}
+			if err := location.Head(context.Background(), &stored); err != nil {
+				t.Fatal(err)
+			}
+			if stored.Size != entry.Size || stored.Name != entry.Name {
+				t.Errorf("expected %s to keep the entry's metadata as given, found %+v", name, stored)
+			}
+			info, err := os.Stat(filepath.Join(locals[name].Path, entry.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() >= int64(len(body))/2 {
+				t.Errorf("expected %s to hold a third of the data, found %d bytes", name, info.Size())
+			}
+		}
+	})
+	t.Run("Head", func(t *testing.T) {
+		headed := cloud.Entry{ID: entry.ID}
+		if err := client.Head(context.Background(), &headed); err != nil {
+			t.Fatal(err)
+		}
+		if headed.Size != entry.Size || headed.Checksum != entry.Checksum || headed.Name != entry.Name {
+			t.Errorf("expected Head to give the entry's metadata and the checksum of the data the shards rebuild: %+v", headed)
+		}
+	})
+	t.Run("Download", func(t *testing.T) {
+		download(entry, body)
+		downloadRange(5, 10)
+		downloadRange(190*1024, 20*1024) // across a stripe boundary
+		downloadRange(int64(len(body))-3, 100)
+	})
+	t.Run("Small", func(t *testing.T) {
+		small := []byte("pin: 0000")
+		upload(cloud.Entry{ID: "small"}, small)
+		download(cloud.Entry{ID: "small"}, small)
+		upload(cloud.Entry{ID: "empty"}, nil)
+		download(cloud.Entry{ID: "empty"}, nil)
+	})
+	t.Run("Update", func(t *testing.T) {
+		entry.Name = "scan, renamed.tiff"
+		if err := client.Update(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		assertHeadMatches(t, client, entry)
+		download(entry, body)
+	})
+	t.Run("Outage", func(t *testing.T) {
+		draft := cloud.Entry{ID: "draft", Name: "draft.txt"}
+		upload(draft, []byte("first draft"))
+
+		lagging.down = true
+		upload(draft, []byte("final draft"))
+		if status := replication.Status(draft.ID)["a"]; status.State != cloud.ReplicaPending || status.Op != cloud.ReplicaUpload {
+			t.Errorf("expected pending upload, received %+v", status)
+		}
+		download(draft, []byte("final draft"))
+
+		alsoLagging.down = true
+		file := makeBodyFile(t, []byte("one too many"))
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := client.Upload(context.Background(), draft, file); err == nil {
+			t.Error("expected a write reaching only as many locations as needed to rebuild to fail")
+		}
+		lagging.down, alsoLagging.down = false, false
+		upload(draft, []byte("final draft"))
+
+		// Lose another location's shard while the lagging one catches up
+		lagging.down = true
+		upload(draft, []byte("final draft, signed"))
+		lagging.down = false
+		if err := client.(*cloud.Erasure).CatchUp(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+		if status := replication.Status(draft.ID); len(status) != 0 {
+			t.Errorf("expected the lagging location to have caught up, received %+v", status)
+		}
+		for _, name := range []string{"d", "e"} {
+			if err := locations[name].Delete(context.Background(), draft); err != nil {
+				t.Fatal(err)
+			}
+		}
+		download(draft, []byte("final draft, signed"))
+		assertHeadMatches(t, locations["a"], cloud.Entry{ID: draft.ID, Name: draft.Name})
+	})
+	t.Run("Degraded", func(t *testing.T) {
+		if err := locations["a"].Delete(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		download(entry, body)
+		downloadRange(190*1024, 20*1024)
+
+		// Damage a shard on disk, keeping its size and stored checksum as they were
+		path := filepath.Join(locals["c"].Path, entry.ID)
+		shard, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shard[len(shard)-1] ^= 0xff
+		if err := ioutil.WriteFile(path, shard, 0600); err != nil {
+			t.Fatal(err)
+		}
+		download(entry, body)
+
+		if err := locations["b"].Delete(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Download(context.Background(), entry); err == nil {
+			t.Error("expected rebuilding from two healthy shards of three needed to fail")
+		}
+	})
+	t.Run("UploadCorrupted", func(t *testing.T) {
+		file := makeBodyFile(t, []byte("not the data checksummed"))
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := client.Upload(context.Background(), entry, file); !errors.Is(err, cloud.ErrIntegrity) {
+			t.Errorf("expected %v, received %v", cloud.ErrIntegrity, err)
+		}
+	})
+	t.Run("Delete", func(t *testing.T) {
+		for _, id := range []string{entry.ID, "small", "empty", "draft"} {
+			if err := client.Delete(context.Background(), cloud.Entry{ID: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.RemoveArchive(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+}
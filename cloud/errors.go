@@ -0,0 +1,51 @@
+package cloud
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of failure every Client reports its provider's errors as; check for them with errors.Is
+var (
+	ErrNotFound        = errors.New("cloud: entry not found")
+	ErrArchiveNotFound = errors.New("cloud: archive not found")
+	ErrArchiveExists   = errors.New("cloud: archive already exists")
+	ErrArchiveNotEmpty = errors.New("cloud: archive is not empty")
+	ErrAccessDenied    = errors.New("cloud: access denied")
+	ErrTransient       = errors.New("cloud: temporary failure; try again later")
+	ErrIntegrity       = errors.New("cloud: data does not match its checksum")
+	ErrArchived        = errors.New("cloud: data is in cold storage and must be restored first")
+	ErrRestorePending  = errors.New("cloud: data is being restored from cold storage; try again later")
+	ErrConfirmation    = errors.New("cloud: confirmation token does not match the archive's contents")
+	ErrLocked          = errors.New("cloud: data is locked against deletion by a retention period or legal hold")
+	ErrConflict        = errors.New("cloud: archive was changed by another writer at the same time")
+)
+
+// Error is returned by a Client when its provider reports an error, pairing the
+// provider's own error with the kind of failure it represents
+// Use errors.As to inspect the provider's code; errors.Is matches both Kind and Err
+type Error struct {
+	Kind error  // one of the Err* kinds above, or ctx's error once canceled; nil if the provider's error is not recognized
+	Code string // provider's error code, such as "NoSuchKey"
+	Err  error  // error as returned by the provider
+}
+
+func (e *Error) Error() string {
+	if e.Kind == nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+// Unwrap returns both the kind of failure and the provider's error
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// wrapErr classifies a provider's error as kind
+func wrapErr(kind error, code string, err error) error {
+	return &Error{Kind: kind, Code: code, Err: err}
+}
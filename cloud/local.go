@@ -0,0 +1,487 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+const (
+	localTempPrefix = "."     // prefix for in-progress uploads; skipped by List
+	localVersionID  = "null"  // matches the version id S3 gives unversioned objects
+	localMetaDir    = ".meta" // subdirectory holding each Entry's encrypted metadata
+)
+
+var (
+	errInvalidID = errors.New("entry id is not a valid object name")
+)
+
+// Local is used to store an archive in a directory on the local file system
+// (NAS mount, external drive) in a way that satisfies the Client interface
+type Local struct {
+	Path string               // Directory holding the archive's objects
+	Key  *secure.KeyContainer // archive key used to encrypt Entry metadata; metadata is not stored without it
+}
+
+// LocalClient returns a new Client
+func LocalClient(path string) (client Client) {
+	return &Local{
+		Path: path,
+	}
+}
+
+// CreateArchive creates the directory responsible for storing data
+// NOTE: parent directory must already exist so an unmounted drive is not
+// silently replaced with a folder on the system disk
+func (client Local) CreateArchive(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := os.Mkdir(client.Path, 0700)
+	if os.IsExist(err) {
+		return wrapErr(ErrArchiveExists, "", err)
+	}
+	return localErr(err)
+}
+
+// RemoveArchive removes the archive's directory; errors if it still contains objects
+func (client Local) RemoveArchive(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(client.Path, localMetaDir)) // only succeeds once empty
+	err := os.Remove(client.Path)
+	switch {
+	case os.IsNotExist(err):
+		return wrapErr(ErrArchiveNotFound, "", err)
+	case errors.Is(err, syscall.ENOTEMPTY), os.IsExist(err):
+		return wrapErr(ErrArchiveNotEmpty, "", err)
+	}
+	return localErr(err)
+}
+
+// List collects all list data for the given directory; closes Entry chan when done
+func (client Local) List(ctx context.Context, entries chan Entry) error {
+	defer close(entries)
+
+	infos, err := ioutil.ReadDir(client.Path)
+	if os.IsNotExist(err) {
+		return wrapErr(ErrArchiveNotFound, "", err)
+	}
+	if err != nil {
+		return localErr(err)
+	}
+
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), localTempPrefix) {
+			continue
+		}
+		select {
+		case entries <- Entry{
+			ID:           info.Name(),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Upload copies an Entry's body into the archive directory
+// Data is written to a temporary file first and renamed into place so an
+// interrupted upload never leaves a partial object behind; data not matching
+// entry's checksum is refused with ErrIntegrity
+func (client Local) Upload(ctx context.Context, entry Entry, file File) error {
+	return client.upload(ctx, entry, file, client.writeMeta)
+}
+
+// UploadSealed copies an Entry's body into the archive directory, as Upload does, along
+// with encrypted metadata exactly as given
+func (client Local) UploadSealed(ctx context.Context, entry Entry, sealed string, file File) error {
+	return client.upload(ctx, entry, file, func(entry Entry) error {
+		return client.writeSealedMeta(entry, sealed)
+	})
+}
+
+// upload copies an Entry's body into place once writeMeta has stored its metadata
+func (client Local) upload(ctx context.Context, entry Entry, file File, writeMeta func(Entry) error) error {
+	path, err := client.path(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(client.Path, localTempPrefix+entry.ID)
+	if os.IsNotExist(err) {
+		return wrapErr(ErrArchiveNotFound, "", err)
+	}
+	if err != nil {
+		return localErr(err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	defer tmp.Close()
+
+	checksum := NewChecksum()
+	if _, err := io.Copy(io.MultiWriter(tmp, checksum), &contextReader{ctx: ctx, Reader: file}); err != nil {
+		return localErr(err)
+	}
+	if entry.Checksum != "" && checksum.String() != entry.Checksum {
+		return ErrIntegrity
+	}
+	if err := tmp.Sync(); err != nil {
+		return localErr(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return localErr(err)
+	}
+
+	if err := writeMeta(entry); err != nil {
+		return localErr(err)
+	}
+	return localErr(os.Rename(tmp.Name(), path))
+}
+
+// Head fills in entry with the properties and decrypted metadata stored in the archive directory
+func (client Local) Head(ctx context.Context, entry *Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := client.path(*entry)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return localErr(err)
+	}
+
+	entry.Size = info.Size()
+	entry.LastModified = info.ModTime()
+
+	return localErr(client.readMeta(entry))
+}
+
+// HeadSealed fills in entry's properties, returning its encrypted metadata as stored; the
+// metadata is never decrypted, so no Key is needed
+// NOTE: Local keeps checksums only within encrypted metadata, so entry's is left as is
+func (client Local) HeadSealed(ctx context.Context, entry *Entry) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	path, err := client.path(*entry)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", localErr(err)
+	}
+	entry.Size = info.Size()
+	entry.LastModified = info.ModTime()
+
+	meta, err := ioutil.ReadFile(client.metaPath(*entry))
+	if os.IsNotExist(err) {
+		return "", nil // no metadata stored
+	}
+	return string(meta), localErr(err)
+}
+
+// Download opens entry's data from the archive directory; caller responsible for closing
+// Reading the data to the end returns ErrIntegrity instead of io.EOF if it does not match its checksum
+func (client Local) Download(ctx context.Context, entry Entry) (io.ReadCloser, error) {
+	path, err := client.path(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, localErr(err)
+	}
+	return verify(&readCloser{
+		Reader: &contextReader{ctx: ctx, Reader: file},
+		Closer: file,
+	}, entry.Checksum), nil
+}
+
+// DownloadRange opens length bytes of entry's data, starting at offset; caller responsible for closing
+// Reading past the end of the data returns only the bytes available
+func (client Local) DownloadRange(ctx context.Context, entry Entry, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 1 {
+		return nil, errInvalidRange
+	}
+
+	path, err := client.path(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, localErr(err)
+	}
+
+	return &readCloser{
+		Reader: &contextReader{ctx: ctx, Reader: io.NewSectionReader(file, offset, length)},
+		Closer: file,
+	}, nil
+}
+
+// Update replaces the encrypted metadata stored with an Entry and marks it as modified
+func (client Local) Update(ctx context.Context, entry Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := client.path(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return localErr(err)
+	}
+	if err := client.writeMeta(entry); err != nil {
+		return localErr(err)
+	}
+
+	now := time.Now()
+	return localErr(os.Chtimes(path, now, now))
+}
+
+// Delete removes an Entry from the archive directory
+// Like S3, deleting an Entry that does not exist is not an error
+func (client Local) Delete(ctx context.Context, entry Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := client.path(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return localErr(err)
+	}
+	if err := os.Remove(client.metaPath(entry)); err != nil && !os.IsNotExist(err) {
+		return localErr(err)
+	}
+	return nil
+}
+
+// ListVersions returns the Entry's only revision; Local does not keep older ones
+func (client Local) ListVersions(ctx context.Context, entry Entry) ([]Version, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path, err := client.path(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, localErr(err)
+	}
+
+	return []Version{{
+		ID:           localVersionID,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		IsLatest:     true,
+	}}, nil
+}
+
+// Restore succeeds only for the Entry's current revision, which is the only one Local keeps
+func (client Local) Restore(ctx context.Context, entry Entry, versionID string) error {
+	versions, err := client.ListVersions(ctx, entry)
+	if err != nil {
+		return err
+	}
+	if versionID != versions[0].ID {
+		return wrapErr(ErrNotFound, "", errNoSuchVersion)
+	}
+	return nil
+}
+
+// PlanRemoval reports everything PurgeArchive would permanently delete from the directory,
+// along with the token needed to go through with it; nothing is changed
+// Local keeps one version of each object, and interrupted uploads count as Uploads
+func (client Local) PlanRemoval(ctx context.Context) (*RemovalReport, error) {
+	report, _, err := client.planRemoval(ctx)
+	return report, err
+}
+
+// planRemoval walks the directory into a RemovalReport, returning the files it found as well
+// Entries' metadata files change the report's token but are not counted as objects of their own
+func (client Local) planRemoval(ctx context.Context) (*RemovalReport, []removalItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		items            []removalItem
+		objects, uploads int
+		size             int64
+	)
+	err := filepath.Walk(client.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(client.Path, path)
+		if err != nil {
+			return err
+		}
+		items = append(items, removalItem{key: filepath.ToSlash(rel), versionID: localVersionID, size: info.Size()})
+		switch {
+		case filepath.Dir(rel) == localMetaDir:
+			// part of the Entry it describes, as List has it
+		case strings.HasPrefix(info.Name(), localTempPrefix):
+			uploads++
+			size += info.Size()
+		default:
+			objects++
+			size += info.Size()
+		}
+		return ctx.Err()
+	})
+	if os.IsNotExist(err) {
+		return nil, nil, wrapErr(ErrArchiveNotFound, "", err)
+	}
+	if err != nil {
+		return nil, nil, localErr(err)
+	}
+
+	report := newRemovalReport(client.Path, items)
+	report.Objects = objects
+	report.Versions = objects
+	report.Uploads = uploads
+	report.Size = size
+	return report, items, nil
+}
+
+// PurgeArchive permanently deletes the directory and everything in it
+// token must come from a PlanRemoval report made since the directory last changed, or
+// ErrConfirmation is returned and nothing is deleted
+// Only what the confirmed report counted is deleted; anything written since is left, and
+// the directory with it, failing with ErrArchiveNotEmpty
+func (client Local) PurgeArchive(ctx context.Context, token string) error {
+	report, items, err := client.planRemoval(ctx)
+	if err != nil {
+		return err
+	}
+	if err := report.confirm(token); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := os.Remove(filepath.Join(client.Path, filepath.FromSlash(item.key))); err != nil && !os.IsNotExist(err) {
+			return localErr(err)
+		}
+	}
+	return client.RemoveArchive(ctx)
+}
+
+// writeMeta encrypts entry's metadata into its file under the metadata directory
+// NOTE: does nothing if client has no Key to encrypt with
+func (client Local) writeMeta(entry Entry) error {
+	if client.Key == nil {
+		return nil
+	}
+
+	meta, err := entry.Meta(client.Key)
+	if err != nil {
+		return err
+	}
+	return client.writeSealedMeta(entry, meta)
+}
+
+// writeSealedMeta writes already encrypted metadata into entry's file under the metadata
+// directory, removing any left from before when there is none
+func (client Local) writeSealedMeta(entry Entry, sealed string) error {
+	if sealed == "" {
+		if err := os.Remove(client.metaPath(entry)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(client.Path, localMetaDir), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(client.metaPath(entry), []byte(sealed), 0600)
+}
+
+// readMeta decrypts the metadata stored for entry, if there is any
+func (client Local) readMeta(entry *Entry) error {
+	if client.Key == nil {
+		return nil
+	}
+
+	meta, err := ioutil.ReadFile(client.metaPath(*entry))
+	if os.IsNotExist(err) {
+		return nil // no metadata stored
+	}
+	if err != nil {
+		return err
+	}
+
+	return entry.UpdateMeta(string(meta), client.Key)
+}
+
+// metaPath returns the location of entry's metadata; entry's ID must already be validated
+func (client Local) metaPath(entry Entry) string {
+	return filepath.Join(client.Path, localMetaDir, entry.ID)
+}
+
+// localErr classifies an error from the file system as one of the kinds of failure every Client reports
+func localErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return wrapErr(ErrNotFound, "", err)
+	case os.IsPermission(err):
+		return wrapErr(ErrAccessDenied, "", err)
+	}
+	return err
+}
+
+// readCloser pairs a Reader with the Closer of its underlying resource
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// contextReader stops reading with ctx's error once ctx is done
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// path returns the location of entry's object, refusing IDs that would escape the archive
+func (client Local) path(entry Entry) (string, error) {
+	if entry.ID == "" ||
+		entry.ID != filepath.Base(entry.ID) ||
+		strings.HasPrefix(entry.ID, localTempPrefix) {
+		return "", errInvalidID
+	}
+	return filepath.Join(client.Path, entry.ID), nil
+}
@@ -0,0 +1,96 @@
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+func TestLocal(t *testing.T) {
+	client := setupLocal(t)
+
+	runClientTests(t, client)
+
+	t.Run("InvalidID", func(t *testing.T) {
+		if _, err := client.Download(context.Background(), cloud.Entry{ID: filepath.Join("..", "escape")}); err == nil {
+			t.Error("expected an error when entry id escapes the archive directory")
+		}
+	})
+
+	t.Run("Meta", func(t *testing.T) {
+		kc, err := secure.GenerateKeyContainer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kc.Destroy()
+
+		metaClient := &cloud.Local{Path: client.(*cloud.Local).Path, Key: kc}
+		runMetaTests(t, metaClient, cloud.Entry{ID: "meta"})
+	})
+
+	if err := client.RemoveArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Dir(client.(*cloud.Local).Path)); err != nil {
+		t.Error(err)
+	}
+	t.Log("success: removed archive with Local")
+}
+
+func TestLocalPurge(t *testing.T) {
+	client := setupLocal(t)
+	local := client.(*cloud.Local)
+	defer os.RemoveAll(filepath.Dir(local.Path))
+
+	body := []byte("photos from the wedding")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+	local.Key = kc // metadata kept alongside is part of the Entry, not counted on its own
+	if err := client.Upload(context.Background(), cloud.Entry{ID: "photos", Name: "wedding.zip"}, file); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := local.PlanRemoval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 1 || report.Size != int64(len(body)) {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	if err := local.PurgeArchive(context.Background(), ""); !errors.Is(err, cloud.ErrConfirmation) {
+		t.Errorf("expected %v, received %v", cloud.ErrConfirmation, err)
+	}
+	if err := local.PurgeArchive(context.Background(), report.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(local.Path); !os.IsNotExist(err) {
+		t.Errorf("expected archive directory to be removed, received %v", err)
+	}
+}
+
+func setupLocal(t *testing.T) (client cloud.Client) {
+	dir, err := ioutil.TempDir("", "lockedarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = cloud.LocalClient(filepath.Join(dir, "archive"))
+	if err := client.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("success: created archive with Local")
+	return
+}
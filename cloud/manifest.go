@@ -0,0 +1,420 @@
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+const (
+	defaultCompactEvery = 32
+
+	manifestIDPrefix = "manifest~" // IDs of manifest objects, hidden from List
+	manifestHeadID   = manifestIDPrefix + "head"
+)
+
+var (
+	errManifestNoKey   = errors.New("manifest needs the archive key to encrypt its contents")
+	errManifestGap     = errors.New("manifest is missing an update; rebuild it")
+	errManifestChanged = errors.New("manifest update was replaced by another writer's")
+)
+
+// Manifest wraps a Client, keeping a versioned record of every Entry's encrypted metadata
+// in a handful of objects so a new device can rebuild its whole tree from a few downloads
+// instead of heading every Entry
+// Each Flush adds the changes made since as one more update object, and every
+// CompactEvery updates are compacted into a snapshot. All are encrypted with Key, on top
+// of the metadata within them already being so
+// NOTE: changes are held back until Flush; before it, or if it fails, the manifest is only
+// behind, and objects still carry their own metadata
+// NOTE: the manifest is meant to have one writer at a time. Flush catches up on what other
+// writers saved before it, and reads its update back once saved; finding another writer's
+// in its place, it fails with ErrConflict and keeps its changes to add on the next Flush.
+// Writers saving at the very same moment may still go unnoticed
+type Manifest struct {
+	Client
+	Key          *secure.KeyContainer // archive key used to encrypt the manifest and the metadata in it
+	CompactEvery int                  // updates after a snapshot before the next is taken; defaults to 32
+	TempDir      string               // where manifest objects are staged before sending; defaults to the system's
+
+	mutex    sync.Mutex
+	entries  map[string]string // encrypted metadata of every Entry as of version, by ID; nil until loaded
+	version  int64             // latest update applied to entries
+	snapshot int64             // version of the latest snapshot
+	pending  map[string]string // changes yet to be flushed; empty metadata marks a deletion
+}
+
+// ManifestClient returns client wrapped so a manifest of its Entries is kept, encrypted with key
+func ManifestClient(client Client, key *secure.KeyContainer) Client {
+	return &Manifest{
+		Client: client,
+		Key:    key,
+	}
+}
+
+// manifestHead points at the latest snapshot and update
+type manifestHead struct {
+	Version  int64 `json:"version"`
+	Snapshot int64 `json:"snapshot"` // updates after it are each kept as an object of their own
+}
+
+// manifestChanges is a snapshot of every Entry, or an update of those changed since the last
+type manifestChanges struct {
+	Version int64             `json:"version"`
+	Entries map[string]string `json:"entries"`          // encrypted metadata by ID; empty in an update for a deletion
+	Writer  string            `json:"writer,omitempty"` // random ID telling an update apart from another writer's
+}
+
+// Upload sends entry on, noting its metadata for the manifest
+func (client *Manifest) Upload(ctx context.Context, entry Entry, file File) error {
+	if err := client.Client.Upload(ctx, entry, file); err != nil {
+		return err
+	}
+	return client.note(entry)
+}
+
+// Update sends entry's metadata on, noting it for the manifest
+func (client *Manifest) Update(ctx context.Context, entry Entry) error {
+	if err := client.Client.Update(ctx, entry); err != nil {
+		return err
+	}
+	return client.note(entry)
+}
+
+// Delete removes entry, noting its removal for the manifest
+func (client *Manifest) Delete(ctx context.Context, entry Entry) error {
+	if err := client.Client.Delete(ctx, entry); err != nil {
+		return err
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.pendingChanges()[entry.ID] = ""
+	return nil
+}
+
+// Restore makes an older revision of entry current again, noting the metadata it brings back
+func (client *Manifest) Restore(ctx context.Context, entry Entry, versionID string) error {
+	if err := client.Client.Restore(ctx, entry, versionID); err != nil {
+		return err
+	}
+	restored := Entry{ID: entry.ID}
+	if err := client.Client.Head(ctx, &restored); err != nil {
+		return err
+	}
+	return client.note(restored)
+}
+
+// List collects all list data for the archive, leaving out the manifest's own objects; closes Entry chan when done
+func (client *Manifest) List(ctx context.Context, entries chan Entry) error {
+	defer close(entries)
+
+	listed := make(chan Entry)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.Client.List(ctx, listed)
+	}()
+	for entry := range listed {
+		if strings.HasPrefix(entry.ID, manifestIDPrefix) {
+			continue
+		}
+		entries <- entry
+	}
+	return <-errc
+}
+
+// Entries returns every Entry in the manifest, metadata decrypted, sorted by ID
+// On a new device this reads the latest snapshot and the few updates since
+func (client *Manifest) Entries(ctx context.Context) ([]Entry, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := client.load(ctx); err != nil {
+		return nil, err
+	}
+
+	sealed := make(map[string]string, len(client.entries))
+	for id, meta := range client.entries {
+		sealed[id] = meta
+	}
+	apply(sealed, client.pending)
+
+	ids := make([]string, 0, len(sealed))
+	for id := range sealed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		entry := Entry{ID: id}
+		if err := entry.UpdateMeta(sealed[id], client.Key); err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Flush adds the changes held back to the manifest as one update, taking a snapshot if
+// enough have gathered since the last, then flushes Client if it holds writes back too
+func (client *Manifest) Flush(ctx context.Context) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if len(client.pending) > 0 {
+		if err := client.load(ctx); err != nil { // catches up on updates made elsewhere
+			return err
+		}
+		update := manifestChanges{Version: client.version + 1, Entries: client.pending}
+		if err := client.saveUpdate(ctx, update); err != nil {
+			return err
+		}
+		apply(client.entries, client.pending)
+		client.version = update.Version
+		client.pending = nil
+
+		var err error
+		if client.version-client.snapshot >= client.compactEvery() {
+			err = client.compact(ctx)
+		} else {
+			_, err = client.saveHead(ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if flusher, ok := client.Client.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Rebuild replaces the manifest with one made by heading every Entry, as needed for an
+// archive written before it kept one or after an update went missing
+func (client *Manifest) Rebuild(ctx context.Context) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.Key == nil {
+		return errManifestNoKey
+	}
+
+	listed, err := listAll(ctx, client.Client)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]string)
+	for _, entry := range listed {
+		if strings.HasPrefix(entry.ID, manifestIDPrefix) {
+			continue
+		}
+		if err := client.Client.Head(ctx, &entry); err != nil {
+			return fmt.Errorf("%s: %w", entry.ID, err)
+		}
+		if entries[entry.ID], err = entry.Meta(client.Key); err != nil {
+			return err
+		}
+	}
+
+	var head manifestHead
+	if err := loadSealed(ctx, client.Client, client.Key, manifestHeadID, &head); err != nil && !errors.Is(err, secure.ErrDecrypt) {
+		return err
+	}
+	client.entries = entries
+	client.version = head.Version + 1
+	client.snapshot = head.Snapshot
+	client.pending = nil
+	return client.compact(ctx)
+}
+
+// compact saves a snapshot of every Entry as of the latest update, points the head at it,
+// then deletes the snapshot and updates it replaces
+// If another writer has moved the head further meanwhile, they are left for it to point at
+func (client *Manifest) compact(ctx context.Context) error {
+	previous := client.snapshot
+	snapshot := manifestChanges{Version: client.version, Entries: client.entries}
+	if err := client.save(ctx, manifestSnapshotID(snapshot.Version), snapshot); err != nil {
+		return err
+	}
+	client.snapshot = snapshot.Version
+	moved, err := client.saveHead(ctx)
+	if err != nil || !moved {
+		return err
+	}
+
+	// Only once the head no longer points at them
+	var stale []string
+	if previous > 0 {
+		stale = append(stale, manifestSnapshotID(previous))
+	}
+	for version := previous + 1; version <= client.snapshot; version++ {
+		stale = append(stale, manifestUpdateID(version))
+	}
+	for _, id := range stale {
+		if err := client.Client.Delete(ctx, Entry{ID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load brings entries up to date with the manifest as stored, reading the latest snapshot
+// if entries are older than it, then every update since
+func (client *Manifest) load(ctx context.Context) error {
+	if client.Key == nil {
+		return errManifestNoKey
+	}
+
+	var head manifestHead
+	if err := loadSealed(ctx, client.Client, client.Key, manifestHeadID, &head); err != nil {
+		return err
+	}
+
+	if client.entries == nil || client.version < head.Snapshot {
+		snapshot := manifestChanges{Entries: make(map[string]string)}
+		if head.Snapshot > 0 {
+			if err := client.load1(ctx, manifestSnapshotID(head.Snapshot), head.Snapshot, &snapshot); err != nil {
+				return err
+			}
+		}
+		client.entries = snapshot.Entries
+		client.version = head.Snapshot
+	}
+	for client.version < head.Version {
+		var update manifestChanges
+		if err := client.load1(ctx, manifestUpdateID(client.version+1), client.version+1, &update); err != nil {
+			return err
+		}
+		apply(client.entries, update.Entries)
+		client.version = update.Version
+	}
+	// Then any saved by writers yet to move the head past them
+	for {
+		var update manifestChanges
+		if err := loadSealed(ctx, client.Client, client.Key, manifestUpdateID(client.version+1), &update); err != nil {
+			return err
+		}
+		if update.Version != client.version+1 {
+			break // no such update
+		}
+		apply(client.entries, update.Entries)
+		client.version = update.Version
+	}
+	client.snapshot = head.Snapshot
+	return nil
+}
+
+// load1 reads one snapshot or update, which must hold version
+func (client *Manifest) load1(ctx context.Context, id string, version int64, changes *manifestChanges) error {
+	if err := loadSealed(ctx, client.Client, client.Key, id, changes); err != nil {
+		return err
+	}
+	if changes.Version != version {
+		return errManifestGap
+	}
+	if changes.Entries == nil {
+		changes.Entries = make(map[string]string)
+	}
+	return nil
+}
+
+// saveUpdate saves update, then reads it back to make sure another writer saving the same
+// version has not replaced it, returning ErrConflict if one has
+func (client *Manifest) saveUpdate(ctx context.Context, update manifestChanges) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	update.Writer = hex.EncodeToString(b)
+
+	id := manifestUpdateID(update.Version)
+	if err := client.save(ctx, id, update); err != nil {
+		return err
+	}
+	var saved manifestChanges
+	if err := loadSealed(ctx, client.Client, client.Key, id, &saved); err != nil {
+		return err
+	}
+	if saved.Writer != update.Writer {
+		return wrapErr(ErrConflict, "", errManifestChanged)
+	}
+	return nil
+}
+
+// saveHead points the head at the latest snapshot and update, reporting whether it did;
+// a head another writer has already moved as far or further is left as is, and a newer
+// snapshot it points at is kept
+func (client *Manifest) saveHead(ctx context.Context) (bool, error) {
+	var stored manifestHead
+	if err := loadSealed(ctx, client.Client, client.Key, manifestHeadID, &stored); err != nil && !errors.Is(err, secure.ErrDecrypt) {
+		return false, err
+	}
+	if stored.Version >= client.version {
+		return false, nil
+	}
+
+	head := manifestHead{Version: client.version, Snapshot: client.snapshot}
+	if stored.Snapshot > head.Snapshot {
+		head.Snapshot = stored.Snapshot
+	}
+	return true, client.save(ctx, manifestHeadID, head)
+}
+
+func (client *Manifest) save(ctx context.Context, id string, v interface{}) error {
+	return saveSealed(ctx, client.Client, client.Key, client.TempDir, id, v)
+}
+
+// note holds entry's encrypted metadata back for the next Flush
+func (client *Manifest) note(entry Entry) error {
+	if client.Key == nil {
+		return errManifestNoKey
+	}
+	meta, err := entry.Meta(client.Key)
+	if err != nil {
+		return err
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.pendingChanges()[entry.ID] = meta
+	return nil
+}
+
+func (client *Manifest) pendingChanges() map[string]string {
+	if client.pending == nil {
+		client.pending = make(map[string]string)
+	}
+	return client.pending
+}
+
+func (client *Manifest) compactEvery() int64 {
+	if client.CompactEvery > 0 {
+		return int64(client.CompactEvery)
+	}
+	return defaultCompactEvery
+}
+
+// apply makes changes to entries; empty metadata marks a deletion
+func apply(entries, changes map[string]string) {
+	for id, meta := range changes {
+		if meta == "" {
+			delete(entries, id)
+		} else {
+			entries[id] = meta
+		}
+	}
+}
+
+func manifestSnapshotID(version int64) string {
+	return fmt.Sprintf("%ssnapshot-%020d", manifestIDPrefix, version)
+}
+
+func manifestUpdateID(version int64) string {
+	return fmt.Sprintf("%supdate-%020d", manifestIDPrefix, version)
+}
@@ -0,0 +1,228 @@
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+// hookClient calls before and after, when set, around each upload through it; an error
+// from before stops the upload
+type hookClient struct {
+	cloud.Client
+	before, after func(id string) error
+}
+
+func (client *hookClient) Upload(ctx context.Context, entry cloud.Entry, file cloud.File) error {
+	if client.before != nil {
+		if err := client.before(entry.ID); err != nil {
+			return err
+		}
+	}
+	if err := client.Client.Upload(ctx, entry, file); err != nil {
+		return err
+	}
+	if client.after != nil {
+		return client.after(entry.ID)
+	}
+	return nil
+}
+
+// hidingClient reports the Entry with id as missing, as a writer yet to see it would find it
+type hidingClient struct {
+	cloud.Client
+	id string
+}
+
+func (client *hidingClient) Download(ctx context.Context, entry cloud.Entry) (io.ReadCloser, error) {
+	if entry.ID == client.id {
+		return nil, cloud.ErrNotFound
+	}
+	return client.Client.Download(ctx, entry)
+}
+
+func TestManifest(t *testing.T) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	local := setupLocal(t).(*cloud.Local)
+	defer os.RemoveAll(filepath.Dir(local.Path))
+	local.Key = kc
+	client := &cloud.Manifest{Client: local, Key: kc, CompactEvery: 3}
+
+	upload := func(entry cloud.Entry) {
+		file := makeBodyFile(t, []byte(entry.Name))
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := client.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush := func() {
+		if err := client.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bootstrap := func() []cloud.Entry {
+		entries, err := (&cloud.Manifest{Client: local, Key: kc}).Entries(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	manifestIDs := func() (ids []string) {
+		for _, id := range listIDs(t, local) {
+			if strings.HasPrefix(id, "manifest~") {
+				ids = append(ids, id)
+			}
+		}
+		return
+	}
+
+	t.Run("Incremental", func(t *testing.T) {
+		upload(cloud.Entry{ID: "docs", Name: "Documents", IsDir: true})
+		upload(cloud.Entry{ID: "return", ParentID: "docs", Name: "2017 return.pdf"})
+		if entries := bootstrap(); len(entries) != 0 {
+			t.Errorf("expected nothing in the manifest before Flush, found %+v", entries)
+		}
+		flush()
+
+		upload(cloud.Entry{ID: "receipt", ParentID: "docs", Name: "receipt.jpg"})
+		if err := client.Update(context.Background(), cloud.Entry{ID: "return", ParentID: "docs", Name: "2017 tax return.pdf"}); err != nil {
+			t.Fatal(err)
+		}
+		flush()
+
+		entries := bootstrap()
+		if len(entries) != 3 || entries[2].ID != "return" || entries[2].Name != "2017 tax return.pdf" || entries[2].ParentID != "docs" {
+			t.Errorf("unexpected entries bootstrapped: %+v", entries)
+		}
+		if ids := manifestIDs(); len(ids) != 3 {
+			t.Errorf("expected the head and two updates to be stored, found %v", ids)
+		}
+		if listed := listIDs(t, client); len(listed) != 3 {
+			t.Errorf("expected the manifest's own objects not to be listed, received %v", listed)
+		}
+	})
+	t.Run("Compact", func(t *testing.T) {
+		if err := client.Delete(context.Background(), cloud.Entry{ID: "receipt"}); err != nil {
+			t.Fatal(err)
+		}
+		flush()
+
+		if ids := manifestIDs(); len(ids) != 2 {
+			t.Errorf("expected the updates to be compacted into a snapshot beside the head, found %v", ids)
+		}
+		entries := bootstrap()
+		if len(entries) != 2 || entries[0].ID != "docs" || entries[1].ID != "return" {
+			t.Errorf("unexpected entries bootstrapped: %+v", entries)
+		}
+	})
+	t.Run("Elsewhere", func(t *testing.T) {
+		// Another device's changes are caught up on before this one's are added
+		other := &cloud.Manifest{Client: local, Key: kc}
+		file := makeBodyFile(t, []byte("photo"))
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := other.Upload(context.Background(), cloud.Entry{ID: "photo", Name: "photo.jpg"}, file); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		upload(cloud.Entry{ID: "notes", ParentID: "docs", Name: "notes.txt"})
+		flush()
+		if entries := bootstrap(); len(entries) != 4 {
+			t.Errorf("expected both devices' entries in the manifest, found %+v", entries)
+		}
+	})
+	t.Run("Rebuild", func(t *testing.T) {
+		for _, id := range manifestIDs() {
+			if err := local.Delete(context.Background(), cloud.Entry{ID: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.Rebuild(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, entry := range bootstrap() {
+			names = append(names, entry.Name)
+		}
+		if fmt.Sprint(names) != "[Documents notes.txt photo.jpg 2017 tax return.pdf]" {
+			t.Errorf("expected the manifest to be rebuilt from every entry, found %v", names)
+		}
+	})
+	t.Run("HeadNotMoved", func(t *testing.T) {
+		// A writer cut off between saving its update and moving the head
+		cutOff := &cloud.Manifest{Client: &hookClient{Client: local, before: func(id string) error {
+			if id == "manifest~head" {
+				return errors.New("connection lost")
+			}
+			return nil
+		}}, Key: kc}
+		if err := cutOff.Update(context.Background(), cloud.Entry{ID: "photo", Name: "holiday.jpg"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cutOff.Flush(context.Background()); err == nil {
+			t.Fatal("expected moving the head to fail")
+		}
+
+		if err := client.Update(context.Background(), cloud.Entry{ID: "docs", Name: "Paperwork", IsDir: true}); err != nil {
+			t.Fatal(err)
+		}
+		flush()
+		var names []string
+		for _, entry := range bootstrap() {
+			names = append(names, entry.Name)
+		}
+		if fmt.Sprint(names) != "[Paperwork notes.txt holiday.jpg 2017 tax return.pdf]" {
+			t.Errorf("expected the update saved ahead of the head to be kept, found %v", names)
+		}
+	})
+	t.Run("Collision", func(t *testing.T) {
+		// Another writer saves the same update at once, not having seen this one's
+		hiding := &hidingClient{Client: local}
+		other := &cloud.Manifest{Client: hiding, Key: kc}
+		writer := &cloud.Manifest{Client: &hookClient{Client: local, after: func(id string) error {
+			if !strings.HasPrefix(id, "manifest~update-") || hiding.id != "" {
+				return nil
+			}
+			hiding.id = id
+			if err := other.Update(context.Background(), cloud.Entry{ID: "photo", Name: "beach.jpg"}); err != nil {
+				return err
+			}
+			return other.Flush(context.Background())
+		}}, Key: kc}
+
+		if err := writer.Update(context.Background(), cloud.Entry{ID: "notes", ParentID: "docs", Name: "meeting notes.txt"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(context.Background()); !errors.Is(err, cloud.ErrConflict) {
+			t.Fatalf("expected %v once the other writer's update replaced this one's, received %v", cloud.ErrConflict, err)
+		}
+		if err := writer.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range bootstrap() {
+			names = append(names, entry.Name)
+		}
+		if fmt.Sprint(names) != "[Paperwork meeting notes.txt beach.jpg 2017 tax return.pdf]" {
+			t.Errorf("expected both writers' changes once the conflict was flushed again, found %v", names)
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const defaultMigrationConcurrency = 4
+
+var (
+	errMigrationIncomplete = errors.New("migration incomplete")
+	errMetaMismatch        = errors.New("encrypted metadata differs from source")
+	errNotSealed           = errors.New("client cannot move encrypted metadata as stored")
+)
+
+// SealedClient is a Client able to move an Entry's encrypted metadata exactly as stored,
+// without the archive key; AS3 and Local are both SealedClients
+// Retry and Transfer are too, failing with errNotSealed if the Client they wrap is not
+type SealedClient interface {
+	Client
+	HeadSealed(ctx context.Context, entry *Entry) (sealed string, err error)
+	UploadSealed(ctx context.Context, entry Entry, sealed string, file File) error
+}
+
+// Migration copies every Entry of an archive from one provider to another exactly as
+// stored: data and metadata stay encrypted throughout, so no key is needed and no plaintext
+// ever reaches the machine running it
+// Progress is saved to StatePath as Entries finish, so running an interrupted Migration
+// again resumes it. Every copied Entry is then read back from Destination and checked
+// NOTE: only current revisions are copied; Destination's own storage class settings apply
+type Migration struct {
+	Source      SealedClient
+	Destination SealedClient
+	StatePath   string // where progress is saved; required
+	Concurrency int    // Entries copied at once; defaults to 4
+	TempDir     string // where data is staged between providers; defaults to the system's
+}
+
+// MigrationReport summarizes one run of a Migration
+type MigrationReport struct {
+	Entries  int               `json:"entries"`            // Entries found at Source
+	Copied   int               `json:"copied"`             // Entries copied by this run
+	Resumed  int               `json:"resumed"`            // Entries copied by an earlier, interrupted run
+	Bytes    int64             `json:"bytes"`              // bytes copied by this run
+	Verified int               `json:"verified"`           // Entries read back from Destination and found intact
+	Failures map[string]string `json:"failures,omitempty"` // why Entries failed to copy or verify, by ID
+}
+
+// migrationState is what a Migration saves to resume from
+type migrationState struct {
+	Copied map[string]string `json:"copied"` // checksums of the Entries copied so far, by ID
+}
+
+// Run copies every Entry not yet copied, then verifies them all at Destination
+// Entries that fail are left to the next run, and the report says why
+func (migration *Migration) Run(ctx context.Context) (*MigrationReport, error) {
+	state, err := loadMigrationState(migration.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := listAll(ctx, migration.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{
+		Entries:  len(entries),
+		Failures: make(map[string]string),
+	}
+	var (
+		mutex   sync.Mutex
+		pending []string
+	)
+	for _, entry := range entries {
+		if _, copied := state.Copied[entry.ID]; copied {
+			report.Resumed++
+			continue
+		}
+		pending = append(pending, entry.ID)
+	}
+
+	err = migration.parallel(ctx, pending, func(id string) error {
+		checksum, size, err := migration.copy(ctx, id)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			report.Failures[id] = err.Error()
+			return nil
+		}
+		report.Copied++
+		report.Bytes += size
+		state.Copied[id] = checksum
+		return saveJSON(migration.StatePath, state)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	var copied []string
+	for _, entry := range entries {
+		if _, ok := state.Copied[entry.ID]; ok {
+			copied = append(copied, entry.ID)
+		}
+	}
+	err = migration.parallel(ctx, copied, func(id string) error {
+		mutex.Lock()
+		checksum := state.Copied[id]
+		mutex.Unlock()
+		err := migration.verify(ctx, id, checksum)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			report.Failures[id] = err.Error()
+			delete(state.Copied, id) // copy again next run
+			return saveJSON(migration.StatePath, state)
+		}
+		report.Verified++
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if len(report.Failures) > 0 {
+		return report, fmt.Errorf("%w: %d of %d entries failed", errMigrationIncomplete, len(report.Failures), report.Entries)
+	}
+	return report, nil
+}
+
+// copy stages the Entry with id from Source and uploads it to Destination as stored,
+// returning the checksum and size of the data copied
+func (migration *Migration) copy(ctx context.Context, id string) (string, int64, error) {
+	entry := Entry{ID: id}
+	sealed, err := migration.Source.HeadSealed(ctx, &entry)
+	if err != nil {
+		return "", 0, err
+	}
+	rc, err := migration.Source.Download(ctx, entry)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile(migration.TempDir, "."+id)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	checksum := NewChecksum()
+	size, err := io.Copy(io.MultiWriter(tmp, checksum), rc) // ErrIntegrity if Source's data is damaged
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	entry.Checksum = checksum.String() // Destination refuses the upload if it arrives damaged
+	entry.StorageClass = ""
+	if err := migration.Destination.UploadSealed(ctx, entry, sealed, tmp); err != nil {
+		return "", 0, err
+	}
+	return entry.Checksum, size, nil
+}
+
+// verify reads the Entry with id back from Destination, checking its data against checksum
+// and its encrypted metadata against Source's
+func (migration *Migration) verify(ctx context.Context, id, checksum string) error {
+	source, destination := Entry{ID: id}, Entry{ID: id}
+	expected, err := migration.Source.HeadSealed(ctx, &source)
+	if err != nil {
+		return err
+	}
+	sealed, err := migration.Destination.HeadSealed(ctx, &destination)
+	if err != nil {
+		return err
+	}
+	if sealed != expected {
+		return errMetaMismatch
+	}
+
+	return verifyData(ctx, migration.Destination, Entry{ID: id, Checksum: checksum})
+}
+
+// parallel calls fn for each of ids, Concurrency at a time, stopping at the first error fn returns
+func (migration *Migration) parallel(ctx context.Context, ids []string, fn func(id string) error) error {
+	concurrency := migration.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultMigrationConcurrency
+	}
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+		queue = make(chan string)
+		stop  = make(chan struct{})
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range queue {
+				if err := fn(id); err != nil {
+					once.Do(func() {
+						first = err
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+
+queueing:
+	for _, id := range ids {
+		select {
+		case queue <- id:
+		case <-stop:
+			break queueing
+		case <-ctx.Done():
+			break queueing
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// loadMigrationState reads the state saved at path, or starts afresh if there is none
+func loadMigrationState(path string) (*migrationState, error) {
+	state := &migrationState{Copied: make(map[string]string)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Copied == nil {
+		state.Copied = make(map[string]string)
+	}
+	return state, nil
+}
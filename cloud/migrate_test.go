@@ -0,0 +1,115 @@
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+// refusingClient fails to store one Entry, as a destination running out of space might
+type refusingClient struct {
+	cloud.SealedClient
+	refuse string // id of the Entry to refuse
+}
+
+func (client *refusingClient) UploadSealed(ctx context.Context, entry cloud.Entry, sealed string, file cloud.File) error {
+	if entry.ID == client.refuse {
+		return errors.New("no space left on device")
+	}
+	return client.SealedClient.UploadSealed(ctx, entry, sealed, file)
+}
+
+func TestMigration(t *testing.T) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	source := setupLocal(t).(*cloud.Local)
+	defer os.RemoveAll(filepath.Dir(source.Path))
+	source.Key = kc
+
+	bodies := map[string][]byte{
+		"will":     []byte("last will and testament"),
+		"deed":     []byte("deed to the house"),
+		"passport": []byte("passport scan"),
+	}
+	for id, body := range bodies {
+		file := makeBodyFile(t, body)
+		checksum := cloud.NewChecksum()
+		checksum.Write(body)
+		entry := cloud.Entry{ID: id, Name: id + ".pdf", Checksum: checksum.String()}
+		if err := source.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	destination, close := newTestAS3(t, "lockedarchive-migration")
+	defer close()
+	if err := destination.CreateArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither end of the migration holds the key
+	keyless := &cloud.Local{Path: source.Path}
+	migration := &cloud.Migration{
+		Source:      keyless,
+		Destination: &refusingClient{SealedClient: destination, refuse: "will"},
+		StatePath:   filepath.Join(filepath.Dir(source.Path), "migration.json"),
+		Concurrency: 2,
+	}
+
+	t.Run("Interrupted", func(t *testing.T) {
+		report, err := migration.Run(context.Background())
+		if err == nil {
+			t.Fatal("expected the refused entry to fail the migration")
+		}
+		if report.Copied != 2 || report.Verified != 2 || report.Failures["will"] == "" {
+			t.Errorf("unexpected report: %+v", report)
+		}
+	})
+	t.Run("Resumed", func(t *testing.T) {
+		migration.Destination = destination
+		report, err := migration.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Entries != 3 || report.Resumed != 2 || report.Copied != 1 || report.Verified != 3 {
+			t.Errorf("unexpected report: %+v", report)
+		}
+	})
+	t.Run("Readable", func(t *testing.T) {
+		destination.Key = kc
+		defer func() { destination.Key = nil }()
+		for id, body := range bodies {
+			entry := cloud.Entry{ID: id}
+			if err := destination.Head(context.Background(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.Name != id+".pdf" {
+				t.Errorf("expected metadata to survive the migration, received name %q", entry.Name)
+			}
+			rc, err := destination.Download(context.Background(), entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertReaderEquals(t, rc, body)
+			rc.Close()
+		}
+	})
+
+	var entries []cloud.Entry
+	for id := range bodies {
+		entries = append(entries, cloud.Entry{ID: id})
+	}
+	purgeAS3(t, destination, entries...)
+	teardown(t, destination)
+}
@@ -0,0 +1,397 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	errNoLocations     = errors.New("mirror has no locations")
+	errNoReplica       = errors.New("no location holds the entry's latest write")
+	errUnknownLocation = errors.New("mirror has no such location")
+)
+
+// Mirror writes to every one of an archive's locations, so that losing a single
+// provider, or the account with it, never costs any data
+// Writes succeed once any location accepts them; locations that miss a write are
+// marked pending in Log until CatchUp brings them up to date. Reads come from the
+// first location, by name, holding the Entry's latest write
+// NOTE: CatchUp and Audit repairs copy Entries between locations as stored, so locations
+// must be SealedClients for them to work
+type Mirror struct {
+	Locations map[string]Client // keyed by a name that stays the same between runs
+	Log       *ReplicationLog   // replication status of each Entry at each location
+	TempDir   string            // where CatchUp stages data copied between locations; defaults to the system's
+}
+
+// MirrorClient returns a Client writing to every one of locations, tracking their status in log
+func MirrorClient(locations map[string]Client, log *ReplicationLog) Client {
+	return &Mirror{
+		Locations: locations,
+		Log:       log,
+	}
+}
+
+// CreateArchive creates the archive at every location
+func (client Mirror) CreateArchive(ctx context.Context) error {
+	return joinLocationErrs(client.each(func(name string, location Client) error {
+		return location.CreateArchive(ctx)
+	}))
+}
+
+// RemoveArchive removes the archive from every location
+func (client Mirror) RemoveArchive(ctx context.Context) error {
+	return joinLocationErrs(client.each(func(name string, location Client) error {
+		return location.RemoveArchive(ctx)
+	}))
+}
+
+// List collects all list data from the first location able to provide it; closes Entry chan when done
+// NOTE: Entries a location has yet to catch up on are missing from its list
+func (client Mirror) List(ctx context.Context, entries chan Entry) error {
+	defer close(entries)
+
+	sent := make(map[string]bool)
+	var errs []error
+	for _, name := range client.names() {
+		attempt := make(chan Entry)
+		errc := make(chan error, 1)
+		go func(location Client) {
+			errc <- location.List(ctx, attempt)
+		}(client.Locations[name])
+
+		for entry := range attempt {
+			if sent[entry.ID] {
+				continue
+			}
+			select {
+			case entries <- entry:
+				sent[entry.ID] = true
+			case <-ctx.Done():
+				for range attempt {
+					// drain so the location's List can finish
+				}
+				return ctx.Err()
+			}
+		}
+
+		err := <-errc
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if len(errs) == 0 {
+		return errNoLocations
+	}
+	return errors.Join(errs...)
+}
+
+// Upload sends entry's data to every location at once
+func (client Mirror) Upload(ctx context.Context, entry Entry, file File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return client.write(entry.ID, ReplicaUpload, func(name string, location Client) error {
+		// Each location reads through its own section of file, so none disturbs another's position
+		return location.Upload(ctx, entry, &sectionFile{
+			SectionReader: io.NewSectionReader(file, 0, info.Size()),
+			file:          file,
+		})
+	})
+}
+
+// Head fills in entry's properties and metadata from the first location holding its latest write
+func (client Mirror) Head(ctx context.Context, entry *Entry) error {
+	return client.read(ctx, entry.ID, func(name string, location Client) error {
+		headed := *entry
+		if err := location.Head(ctx, &headed); err != nil {
+			return err
+		}
+		*entry = headed
+		return nil
+	})
+}
+
+// Download opens entry's data from the first location holding its latest write
+func (client Mirror) Download(ctx context.Context, entry Entry) (rc io.ReadCloser, err error) {
+	err = client.read(ctx, entry.ID, func(name string, location Client) (err error) {
+		rc, err = location.Download(ctx, entry)
+		return
+	})
+	return
+}
+
+// DownloadRange opens part of entry's data from the first location holding its latest write
+func (client Mirror) DownloadRange(ctx context.Context, entry Entry, offset, length int64) (rc io.ReadCloser, err error) {
+	err = client.read(ctx, entry.ID, func(name string, location Client) (err error) {
+		rc, err = location.DownloadRange(ctx, entry, offset, length)
+		return
+	})
+	return
+}
+
+// Update replaces entry's metadata at every location at once
+func (client Mirror) Update(ctx context.Context, entry Entry) error {
+	return client.write(entry.ID, ReplicaUpdate, func(name string, location Client) error {
+		return location.Update(ctx, entry)
+	})
+}
+
+// Delete removes entry from every location at once
+func (client Mirror) Delete(ctx context.Context, entry Entry) error {
+	return client.write(entry.ID, ReplicaDelete, func(name string, location Client) error {
+		return location.Delete(ctx, entry)
+	})
+}
+
+// ListVersions returns entry's stored revisions at the first location holding its latest write
+// NOTE: version ids belong to that location; Restore uses the same one
+func (client Mirror) ListVersions(ctx context.Context, entry Entry) (versions []Version, err error) {
+	err = client.read(ctx, entry.ID, func(name string, location Client) (err error) {
+		versions, err = location.ListVersions(ctx, entry)
+		return
+	})
+	return
+}
+
+// Restore makes an older revision of entry current again at the location ListVersions
+// reads from; every other location is marked pending until CatchUp copies the result over
+func (client Mirror) Restore(ctx context.Context, entry Entry, versionID string) error {
+	var restoredAt string
+	err := client.read(ctx, entry.ID, func(name string, location Client) error {
+		if err := location.Restore(ctx, entry, versionID); err != nil {
+			return err
+		}
+		restoredAt = name
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	errs := make(map[string]error)
+	for _, name := range client.names() {
+		if name != restoredAt {
+			errs[name] = fmt.Errorf("restored from an older version at %s", restoredAt)
+		}
+	}
+	return client.Log.record(entry.ID, ReplicaUpload, client.names(), errs)
+}
+
+// CatchUp brings location up to date with every write it missed, copying data
+// and metadata over from locations holding each Entry's latest write
+// Entries that cannot catch up yet stay pending, and their errors are returned together
+func (client Mirror) CatchUp(ctx context.Context, location string) error {
+	target, exists := client.Locations[location]
+	if !exists {
+		return errUnknownLocation
+	}
+
+	var errs []error
+	for _, id := range client.Log.Pending(location) {
+		op := client.Log.Status(id)[location].Op
+		err := client.catchUp(ctx, target, id, op)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var failures map[string]error
+		if err != nil {
+			failures = map[string]error{location: err}
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+		if err := client.Log.record(id, op, []string{location}, failures); err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// catchUp repeats the write op for the Entry with id at target
+// Uploads and updates alike are repeated by copying the Entry's latest write as stored,
+// so neither needs the archive key
+func (client Mirror) catchUp(ctx context.Context, target Client, id, op string) error {
+	if op == ReplicaDelete {
+		return target.Delete(ctx, Entry{ID: id})
+	}
+
+	entry, sealed, file, err := client.stage(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	return uploadStaged(ctx, target, entry, sealed, file)
+}
+
+// stage copies the latest data for the Entry with id into a temporary file, returning
+// it rewound and ready to upload along with the Entry's properties and encrypted metadata
+// caller responsible for closing and removing the file
+func (client Mirror) stage(ctx context.Context, id string) (entry Entry, sealed string, file *os.File, err error) {
+	err = client.read(ctx, id, func(name string, location Client) (err error) {
+		entry, sealed, file, err = client.stageFrom(ctx, location, id)
+		return
+	})
+	return
+}
+
+// stageFrom copies the data for the Entry with id from source into a temporary file,
+// as stage does; data and metadata are copied as stored, without decrypting either
+// NOTE: source must be a SealedClient
+func (client Mirror) stageFrom(ctx context.Context, source Client, id string) (Entry, string, *os.File, error) {
+	entry := Entry{ID: id}
+	sealer, ok := source.(SealedClient)
+	if !ok {
+		return entry, "", nil, errNotSealed
+	}
+	sealed, err := sealer.HeadSealed(ctx, &entry)
+	if err != nil {
+		return entry, "", nil, err
+	}
+	rc, err := source.Download(ctx, entry)
+	if err != nil {
+		return entry, "", nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile(client.TempDir, "."+id)
+	if err != nil {
+		return entry, "", nil, err
+	}
+	if _, err = io.Copy(tmp, rc); err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return entry, "", nil, err
+	}
+	return entry, sealed, tmp, nil
+}
+
+// uploadStaged stores what stageFrom staged at target, exactly as staged
+// NOTE: target must be a SealedClient
+func uploadStaged(ctx context.Context, target Client, entry Entry, sealed string, file File) error {
+	sealer, ok := target.(SealedClient)
+	if !ok {
+		return errNotSealed
+	}
+	return sealer.UploadSealed(ctx, entry, sealed, file)
+}
+
+// write runs op against every location at once and records how each fared
+// It only fails if no location accepted the write
+func (client Mirror) write(entryID, kind string, op func(name string, location Client) error) error {
+	names := client.names()
+	if len(names) == 0 {
+		return errNoLocations
+	}
+
+	errs := client.each(op)
+	if len(errs) == len(names) {
+		return joinLocationErrs(errs)
+	}
+	return client.Log.record(entryID, kind, names, errs)
+}
+
+// read runs op against each location holding the Entry's latest write in turn, until one succeeds
+func (client Mirror) read(ctx context.Context, entryID string, op func(name string, location Client) error) error {
+	var errs []error
+	for _, name := range client.names() {
+		if !client.Log.synced(entryID, name) {
+			continue
+		}
+		err := op(name, client.Locations[name])
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if len(errs) == 0 {
+		return errNoReplica
+	}
+	return errors.Join(errs...)
+}
+
+// each runs op against every location at once, returning failures keyed by location
+func (client Mirror) each(op func(name string, location Client) error) map[string]error {
+	return eachLocation(client.Locations, op)
+}
+
+// names returns the names of every location, in order
+func (client Mirror) names() []string {
+	return locationNames(client.Locations)
+}
+
+// eachLocation runs op against every one of locations at once, returning failures keyed by location
+func eachLocation(locations map[string]Client, op func(name string, location Client) error) map[string]error {
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		errs  = make(map[string]error)
+	)
+	for name, location := range locations {
+		wg.Add(1)
+		go func(name string, location Client) {
+			defer wg.Done()
+			if err := op(name, location); err != nil {
+				mutex.Lock()
+				errs[name] = err
+				mutex.Unlock()
+			}
+		}(name, location)
+	}
+	wg.Wait()
+	return errs
+}
+
+// locationNames returns the names of every one of locations, in order
+func locationNames(locations map[string]Client) []string {
+	names := make([]string, 0, len(locations))
+	for name := range locations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// joinLocationErrs combines failures keyed by location into one error, nil if there are none
+func joinLocationErrs(errs map[string]error) error {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	joined := make([]error, 0, len(names))
+	for _, name := range names {
+		joined = append(joined, fmt.Errorf("%s: %w", name, errs[name]))
+	}
+	return errors.Join(joined...)
+}
+
+// sectionFile gives one reader of a shared File its own position within it
+type sectionFile struct {
+	*io.SectionReader
+	file File
+}
+
+func (file *sectionFile) Stat() (os.FileInfo, error) {
+	return file.file.Stat()
+}
@@ -0,0 +1,237 @@
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+// outageClient refuses every write while down, as a provider in the middle of an outage would,
+// and every head while unreadable
+type outageClient struct {
+	cloud.Client
+	down       bool
+	unreadable bool
+}
+
+var errOutage = &cloud.Error{Kind: cloud.ErrTransient, Code: "ServiceUnavailable", Err: errors.New("service unavailable")}
+
+func (client *outageClient) Upload(ctx context.Context, entry cloud.Entry, file cloud.File) error {
+	if client.down {
+		return errOutage
+	}
+	return client.Client.Upload(ctx, entry, file)
+}
+
+func (client *outageClient) UploadSealed(ctx context.Context, entry cloud.Entry, sealed string, file cloud.File) error {
+	if client.down {
+		return errOutage
+	}
+	return client.Client.(cloud.SealedClient).UploadSealed(ctx, entry, sealed, file)
+}
+
+func (client *outageClient) Head(ctx context.Context, entry *cloud.Entry) error {
+	if client.unreadable {
+		return errOutage
+	}
+	return client.Client.Head(ctx, entry)
+}
+
+func (client *outageClient) HeadSealed(ctx context.Context, entry *cloud.Entry) (string, error) {
+	if client.unreadable {
+		return "", errOutage
+	}
+	return client.Client.(cloud.SealedClient).HeadSealed(ctx, entry)
+}
+
+func (client *outageClient) Delete(ctx context.Context, entry cloud.Entry) error {
+	if client.down {
+		return errOutage
+	}
+	return client.Client.Delete(ctx, entry)
+}
+
+func TestMirror(t *testing.T) {
+	primary, secondary := setupLocal(t), setupLocal(t)
+	defer os.RemoveAll(filepath.Dir(primary.(*cloud.Local).Path))
+	defer os.RemoveAll(filepath.Dir(secondary.(*cloud.Local).Path))
+
+	replication, err := cloud.OpenReplicationLog(filepath.Join(filepath.Dir(primary.(*cloud.Local).Path), "replication.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lagging := &outageClient{Client: secondary}
+	mirror := &cloud.Mirror{
+		Locations: map[string]cloud.Client{"a": lagging, "b": primary}, // reads try the lagging location first
+		Log:       replication,
+	}
+
+	body := []byte("the only copy of grandma's recipes")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	revisedBody := []byte("grandma's recipes, now with the secret ingredient")
+	revised := makeBodyFile(t, revisedBody)
+	defer os.Remove(revised.Name())
+	defer revised.Close()
+	entry := cloud.Entry{ID: "recipes"}
+
+	t.Run("Upload", func(t *testing.T) {
+		if err := mirror.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+		for name, location := range mirror.Locations {
+			rc, err := location.Download(context.Background(), entry)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			assertReaderEquals(t, rc, body)
+			rc.Close()
+		}
+	})
+	t.Run("Outage", func(t *testing.T) {
+		lagging.down = true
+		if err := mirror.Delete(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		if status := replication.Status(entry.ID)["a"]; status.State != cloud.ReplicaPending || status.Op != cloud.ReplicaDelete {
+			t.Errorf("expected pending delete, received %+v", status)
+		}
+
+		if err := mirror.Upload(context.Background(), entry, revised); err != nil {
+			t.Fatal(err)
+		}
+		if status := replication.Status(entry.ID)["a"]; status.State != cloud.ReplicaPending || status.Op != cloud.ReplicaUpload {
+			t.Errorf("expected pending upload, received %+v", status)
+		}
+	})
+	t.Run("AllDown", func(t *testing.T) {
+		down := &cloud.Mirror{
+			Locations: map[string]cloud.Client{"a": lagging},
+			Log:       replication,
+		}
+		if err := down.Delete(context.Background(), entry); !errors.Is(err, cloud.ErrTransient) {
+			t.Errorf("expected %v, received %v", cloud.ErrTransient, err)
+		}
+	})
+	t.Run("ReadsSkipLagging", func(t *testing.T) {
+		rc, err := mirror.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, revisedBody)
+	})
+	t.Run("Reopen", func(t *testing.T) {
+		reopened, err := cloud.OpenReplicationLog(replication.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := reopened.Status(entry.ID)["a"]; status.State != cloud.ReplicaPending || status.Op != cloud.ReplicaUpload {
+			t.Errorf("expected saved status to be a pending upload, received %+v", status)
+		}
+	})
+	t.Run("CatchUp", func(t *testing.T) {
+		if err := mirror.CatchUp(context.Background(), "a"); !errors.Is(err, cloud.ErrTransient) {
+			t.Errorf("expected catch up to fail while down, received %v", err)
+		}
+
+		lagging.down = false
+		if err := mirror.CatchUp(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+		if pending := replication.Pending("a"); len(pending) != 0 {
+			t.Errorf("expected nothing pending, received %v", pending)
+		}
+		if status := replication.Status(entry.ID); len(status) != 0 {
+			t.Errorf("expected entry synced everywhere to be forgotten, received %+v", status)
+		}
+		rc, err := secondary.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, revisedBody)
+	})
+	t.Run("Forgotten", func(t *testing.T) {
+		if err := mirror.Delete(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := cloud.OpenReplicationLog(replication.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := reopened.Status(entry.ID); len(status) != 0 {
+			t.Errorf("expected saved log to forget entries synced everywhere, received %+v", status)
+		}
+	})
+}
+
+func TestMirrorCatchUpSealed(t *testing.T) {
+	primary, secondary := setupLocal(t), setupLocal(t)
+	defer os.RemoveAll(filepath.Dir(primary.(*cloud.Local).Path))
+	defer os.RemoveAll(filepath.Dir(secondary.(*cloud.Local).Path))
+
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+	primary.(*cloud.Local).Key = kc
+
+	replication, err := cloud.OpenReplicationLog(filepath.Join(filepath.Dir(primary.(*cloud.Local).Path), "replication.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lagging := &outageClient{Client: secondary, down: true}
+	mirror := &cloud.Mirror{
+		Locations: map[string]cloud.Client{"a": lagging, "b": primary},
+		Log:       replication,
+	}
+
+	body := []byte("deed to the house")
+	file := makeBodyFile(t, body)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	entry := cloud.Entry{ID: "deed", Name: "deed.pdf"}
+	if err := mirror.Upload(context.Background(), entry, file); err != nil {
+		t.Fatal(err)
+	}
+	entry.Name = "deed-signed.pdf"
+	if err := mirror.Update(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither location has the key while catching up, so metadata can only be copied as stored
+	primary.(*cloud.Local).Key = nil
+	lagging.down = false
+	if err := mirror.CatchUp(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := primary.(cloud.SealedClient).HeadSealed(context.Background(), &cloud.Entry{ID: entry.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := secondary.(cloud.SealedClient).HeadSealed(context.Background(), &cloud.Entry{ID: entry.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed == "" || sealed != expected {
+		t.Error("expected encrypted metadata to be copied exactly as stored")
+	}
+
+	secondary.(*cloud.Local).Key = kc
+	headed := cloud.Entry{ID: entry.ID}
+	if err := secondary.Head(context.Background(), &headed); err != nil {
+		t.Fatal(err)
+	}
+	if headed.Name != entry.Name {
+		t.Errorf("expected name %s, received %s", entry.Name, headed.Name)
+	}
+}
@@ -0,0 +1,619 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+// Defaults used for any PackPolicy field left at zero
+const (
+	defaultPackThreshold = 1 << 20  // 1 MiB
+	defaultPackSize      = 16 << 20 // 16 MiB
+	defaultPackDeadSpace = 0.5
+
+	packIDPrefix    = "pack~" // IDs of pack objects, hidden from List
+	packIndexID     = packIDPrefix + "index"
+	packedVersionID = "packed" // the only version a packed Entry has
+)
+
+var (
+	errPackNoKey = errors.New("packing needs the archive key to encrypt its index")
+)
+
+// PackPolicy decides which Entries a Pack client groups together, and when it repacks them
+// Zero values fall back on defaults
+type PackPolicy struct {
+	Threshold int64   `json:"threshold,omitempty"`  // Entries smaller than this many bytes are packed; defaults to 1 MiB
+	PackSize  int64   `json:"pack_size,omitempty"`  // bytes of members gathered before a pack is sent; defaults to 16 MiB
+	DeadSpace float64 `json:"dead_space,omitempty"` // fraction of a pack left unused by deleted members before it is repacked; defaults to 0.5
+}
+
+// Flusher is a Client holding some writes back to send together; they are not stored until Flush returns
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Pack wraps a Client, grouping small Entries into larger pack objects so each costs a
+// fraction of a request to write and read; larger Entries still go to objects of their own
+// Where each member sits is kept in an index encrypted with Key, and members are read
+// back with ranged reads of their pack. Packs whose deleted members leave too much
+// dead space are repacked
+// NOTE: uploads, updates and deletes of packed Entries are held back until Flush, or
+// until enough small Entries gather to fill a pack; control objects (see isControlID), such
+// as a Manifest's, are never packed, so other writers see them as soon as they are sent
+// NOTE: each save of the index first checks it is still the revision loaded; if another
+// writer has saved it since, the changes made here are applied to theirs rather than
+// overwriting it. Writers saving at the very same moment may still go unnoticed
+type Pack struct {
+	Client
+	Key     *secure.KeyContainer // archive key used to encrypt the index
+	Policy  PackPolicy
+	TempDir string // where packs are staged before sending; defaults to the system's
+
+	mutex   sync.Mutex
+	index   *packIndex
+	base    *packIndex            // index as last loaded or saved, to tell what changed since
+	moved   map[string]bool       // members moved to another pack by repacking since base, by ID
+	dirty   bool                  // index has changes yet to be saved
+	pending map[string]packMember // members gathered for the next pack, by ID
+	buffer  []byte                // data of the next pack
+}
+
+// PackClient returns client wrapped so Entries smaller than policy's threshold are packed together
+func PackClient(client Client, key *secure.KeyContainer, policy PackPolicy) Client {
+	return &Pack{
+		Client: client,
+		Key:    key,
+		Policy: policy,
+	}
+}
+
+// packIndex records where every packed Entry is kept
+type packIndex struct {
+	Revision int64                 `json:"revision"` // times the index has been saved
+	Members  map[string]packMember `json:"members"`  // by Entry ID
+	Packs    map[string]*packStats `json:"packs"`    // by pack ID
+}
+
+// packMember is one Entry's data within a pack
+type packMember struct {
+	Pack   string `json:"p"`
+	Offset int64  `json:"o"`
+	Length int64  `json:"l"` // bytes of the member's data
+	Entry  Entry  `json:"e"` // properties and metadata as given; Checksum is the member's data
+}
+
+type packStats struct {
+	Size int64 `json:"size"`
+	Dead int64 `json:"dead"` // bytes no longer belonging to a member
+}
+
+// Upload packs entry's data with others if it is small enough, or sends it on as is
+// Data not matching entry's checksum is refused with ErrIntegrity
+func (client *Pack) Upload(ctx context.Context, entry Entry, file File) error {
+	if isControlID(entry.ID) {
+		return client.Client.Upload(ctx, entry, file)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= client.threshold() {
+		if err := client.Client.Upload(ctx, entry, file); err != nil {
+			return err
+		}
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		if err := client.load(ctx); err != nil {
+			return err
+		}
+		client.forget(entry.ID)
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(&contextReader{ctx: ctx, Reader: io.NewSectionReader(file, 0, info.Size())})
+	if err != nil {
+		return err
+	}
+	checksum := NewChecksum()
+	checksum.Write(data)
+	if entry.Checksum != "" && checksum.String() != entry.Checksum {
+		return ErrIntegrity
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := client.load(ctx); err != nil {
+		return err
+	}
+	client.forget(entry.ID)
+
+	entry.Checksum = checksum.String()
+	entry.LastModified = time.Now()
+	client.pending[entry.ID] = packMember{Offset: int64(len(client.buffer)), Length: int64(len(data)), Entry: entry}
+	client.buffer = append(client.buffer, data...)
+
+	if int64(len(client.buffer)) >= client.packSize() {
+		return client.flush(ctx)
+	}
+	return nil
+}
+
+// Flush sends every write held back, repacking packs left with too much dead space
+func (client *Pack) Flush(ctx context.Context) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := client.load(ctx); err != nil {
+		return err
+	}
+	return client.flush(ctx)
+}
+
+// flush sends the next pack and saves the index, then deletes packs no longer needed
+func (client *Pack) flush(ctx context.Context) error {
+	var retired []string
+	for id, stats := range client.index.Packs {
+		if float64(stats.Dead) < float64(stats.Size)*client.deadSpace() {
+			continue
+		}
+		if stats.Dead < stats.Size {
+			if err := client.repack(ctx, id); err != nil {
+				return err
+			}
+		}
+		retired = append(retired, id)
+	}
+
+	if len(client.pending) > 0 {
+		id, err := newPackID()
+		if err != nil {
+			return err
+		}
+		if err := uploadBytes(ctx, client.Client, client.TempDir, id, client.buffer); err != nil {
+			return err
+		}
+
+		stats := &packStats{Size: int64(len(client.buffer)), Dead: int64(len(client.buffer))}
+		for memberID, member := range client.pending {
+			member.Pack = id
+			client.index.Members[memberID] = member
+			stats.Dead -= member.Length
+		}
+		client.index.Packs[id] = stats
+		client.pending = make(map[string]packMember)
+		client.buffer = nil
+		client.dirty = true
+	}
+
+	for _, id := range retired {
+		delete(client.index.Packs, id)
+		client.dirty = true
+	}
+	if client.dirty {
+		if err := client.saveIndex(ctx); err != nil {
+			return err
+		}
+		client.dirty = false
+	}
+
+	// Only once the index no longer points at them
+	for _, id := range retired {
+		if _, kept := client.index.Packs[id]; kept {
+			continue // another writer's index still does
+		}
+		if err := client.Client.Delete(ctx, Entry{ID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repack moves the live members of a pack into the next one, reading the pack whole
+func (client *Pack) repack(ctx context.Context, id string) error {
+	rc, err := client.Client.Download(ctx, Entry{ID: id})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	for memberID, member := range client.index.Members {
+		if _, pending := client.pending[memberID]; pending || member.Pack != id {
+			continue
+		}
+		end := member.Offset + member.Length
+		if end > int64(len(data)) {
+			return ErrIntegrity
+		}
+		client.pending[memberID] = packMember{Offset: int64(len(client.buffer)), Length: member.Length, Entry: member.Entry}
+		client.buffer = append(client.buffer, data[member.Offset:end]...)
+		client.moved[memberID] = true
+	}
+	return nil
+}
+
+// Head fills in entry's properties and metadata from the index if it is packed
+func (client *Pack) Head(ctx context.Context, entry *Entry) error {
+	member, _, packed, err := client.lookup(ctx, entry.ID)
+	if err != nil {
+		return err
+	}
+	if !packed {
+		return client.Client.Head(ctx, entry)
+	}
+
+	*entry = member.Entry
+	return nil
+}
+
+// Download opens entry's data, reading just its part of its pack if it is packed; caller responsible for closing
+// Reading the data to the end returns ErrIntegrity instead of io.EOF if it does not match its checksum
+func (client *Pack) Download(ctx context.Context, entry Entry) (io.ReadCloser, error) {
+	member, data, packed, err := client.lookup(ctx, entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !packed {
+		return client.Client.Download(ctx, entry)
+	}
+
+	expected := entry.Checksum
+	if expected == "" {
+		expected = member.Entry.Checksum
+	}
+	rc, err := client.readMember(ctx, member, data, 0, member.Length)
+	if err != nil {
+		return nil, err
+	}
+	return verify(rc, expected), nil
+}
+
+// DownloadRange opens length bytes of entry's data, starting at offset; caller responsible for closing
+// Reading past the end of the data returns only the bytes available
+func (client *Pack) DownloadRange(ctx context.Context, entry Entry, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 1 {
+		return nil, errInvalidRange
+	}
+	member, data, packed, err := client.lookup(ctx, entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !packed {
+		return client.Client.DownloadRange(ctx, entry, offset, length)
+	}
+
+	if offset > member.Length {
+		offset = member.Length
+	}
+	if offset+length > member.Length {
+		length = member.Length - offset
+	}
+	return client.readMember(ctx, member, data, offset, length)
+}
+
+// readMember opens length bytes of a member's data, starting at offset, from its pack or
+// from pending, the data of a member yet to be sent
+func (client *Pack) readMember(ctx context.Context, member packMember, pending []byte, offset, length int64) (io.ReadCloser, error) {
+	if member.Pack == "" || length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(pending[offset : offset+length])), nil
+	}
+	return client.Client.DownloadRange(ctx, Entry{ID: member.Pack}, member.Offset+offset, length)
+}
+
+// Update replaces entry's metadata, in the index if it is packed
+func (client *Pack) Update(ctx context.Context, entry Entry) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := client.load(ctx); err != nil {
+		return err
+	}
+
+	members := client.index.Members
+	member, packed := client.pending[entry.ID]
+	if packed {
+		members = client.pending
+	} else if member, packed = client.index.Members[entry.ID]; packed {
+		client.dirty = true
+	}
+	if !packed {
+		return client.Client.Update(ctx, entry)
+	}
+
+	entry.Checksum = member.Entry.Checksum
+	entry.LastModified = time.Now()
+	member.Entry = entry
+	members[entry.ID] = member
+	return nil
+}
+
+// Delete removes entry, along with any object of its own
+// Like S3, deleting an Entry that does not exist is not an error
+func (client *Pack) Delete(ctx context.Context, entry Entry) error {
+	if isControlID(entry.ID) {
+		return client.Client.Delete(ctx, entry)
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err := client.load(ctx); err != nil {
+		return err
+	}
+
+	client.forget(entry.ID)
+	return client.Client.Delete(ctx, entry)
+}
+
+// List collects every Entry, packed or not; closes Entry chan when done
+func (client *Pack) List(ctx context.Context, entries chan Entry) error {
+	defer close(entries)
+
+	client.mutex.Lock()
+	err := client.load(ctx)
+	members := make(map[string]packMember)
+	if err == nil {
+		for id, member := range client.index.Members {
+			members[id] = member
+		}
+		for id, member := range client.pending {
+			members[id] = member
+		}
+	}
+	client.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	stored, err := listAll(ctx, client.Client)
+	if err != nil {
+		return err
+	}
+	for _, entry := range stored {
+		if _, packed := members[entry.ID]; packed || strings.HasPrefix(entry.ID, packIDPrefix) {
+			continue
+		}
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for id, member := range members {
+		entry := member.Entry
+		entry.ID = id
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ListVersions returns entry's stored revisions; a packed Entry has only its current one
+func (client *Pack) ListVersions(ctx context.Context, entry Entry) ([]Version, error) {
+	member, _, packed, err := client.lookup(ctx, entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !packed {
+		return client.Client.ListVersions(ctx, entry)
+	}
+
+	return []Version{{
+		ID:           packedVersionID,
+		Size:         member.Length,
+		LastModified: member.Entry.LastModified,
+		IsLatest:     true,
+	}}, nil
+}
+
+// Restore makes an older revision of entry current again; a packed Entry only has its current one
+func (client *Pack) Restore(ctx context.Context, entry Entry, versionID string) error {
+	_, _, packed, err := client.lookup(ctx, entry.ID)
+	if err != nil {
+		return err
+	}
+	if !packed {
+		return client.Client.Restore(ctx, entry, versionID)
+	}
+	if versionID != packedVersionID {
+		return wrapErr(ErrNotFound, "", errNoSuchVersion)
+	}
+	return nil
+}
+
+// lookup finds the Entry with id among packed members, returning a copy of its data too
+// if it is yet to be sent
+func (client *Pack) lookup(ctx context.Context, id string) (member packMember, pending []byte, packed bool, err error) {
+	if isControlID(id) {
+		return
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err = client.load(ctx); err != nil {
+		return
+	}
+
+	if member, packed = client.pending[id]; packed {
+		pending = append([]byte(nil), client.buffer[member.Offset:member.Offset+member.Length]...)
+	} else {
+		member, packed = client.index.Members[id]
+	}
+	member.Entry.ID = id
+	return
+}
+
+// forget removes the Entry with id from the packed members, counting its data as dead space
+func (client *Pack) forget(id string) {
+	delete(client.pending, id) // data already gathered is sent all the same, as dead space
+	delete(client.moved, id)
+	member, packed := client.index.Members[id]
+	if !packed {
+		return
+	}
+	delete(client.index.Members, id)
+	if stats, exists := client.index.Packs[member.Pack]; exists {
+		stats.Dead += member.Length
+	}
+	client.dirty = true
+}
+
+// load reads and decrypts the index, if not already loaded
+func (client *Pack) load(ctx context.Context) error {
+	if client.index != nil {
+		return nil
+	}
+	if client.Key == nil {
+		return errPackNoKey
+	}
+
+	index := &packIndex{
+		Members: make(map[string]packMember),
+		Packs:   make(map[string]*packStats),
+	}
+	if err := loadSealed(ctx, client.Client, client.Key, packIndexID, index); err != nil {
+		return err
+	}
+
+	client.index = index
+	client.base = index.clone()
+	client.moved = make(map[string]bool)
+	client.pending = make(map[string]packMember)
+	return nil
+}
+
+// saveIndex encrypts and sends the index, first applying the changes made since it was
+// loaded to the stored one instead if another writer has saved it since
+// NOTE: the check and the save are separate requests, so writers saving at the very same
+// moment may still go unnoticed
+func (client *Pack) saveIndex(ctx context.Context) error {
+	stored := &packIndex{
+		Members: make(map[string]packMember),
+		Packs:   make(map[string]*packStats),
+	}
+	if err := loadSealed(ctx, client.Client, client.Key, packIndexID, stored); err != nil {
+		return err
+	}
+	if stored.Revision != client.index.Revision {
+		client.rebase(stored)
+	}
+
+	client.index.Revision++
+	if err := saveSealed(ctx, client.Client, client.Key, client.TempDir, packIndexID, client.index); err != nil {
+		client.index.Revision--
+		return err
+	}
+	client.base = client.index.clone()
+	client.moved = make(map[string]bool)
+	return nil
+}
+
+// rebase makes stored, another writer's newer index, the index, with the changes made here
+// since base applied to it
+// Members moved by repacking only follow if the other writer left them where they were,
+// and packs retired here are kept while its members still sit in them
+func (client *Pack) rebase(stored *packIndex) {
+	base, index := client.base, client.index
+	for id, member := range index.Members {
+		was, existed := base.Members[id]
+		current, held := stored.Members[id]
+		switch {
+		case existed && reflect.DeepEqual(member, was):
+			continue // unchanged here
+		case client.moved[id]:
+			if !held || current.Pack != was.Pack || current.Offset != was.Offset {
+				continue // replaced or deleted there
+			}
+		case existed && member.Pack == was.Pack && member.Offset == was.Offset:
+			if held { // only its metadata updated here
+				current.Entry = member.Entry
+				stored.Members[id] = current
+			}
+			continue
+		}
+		stored.Members[id] = member
+	}
+	for id := range base.Members {
+		if _, kept := index.Members[id]; !kept {
+			delete(stored.Members, id)
+		}
+	}
+
+	live := make(map[string]int64)
+	for _, member := range stored.Members {
+		live[member.Pack] += member.Length
+	}
+	for id, stats := range index.Packs {
+		if _, existed := base.Packs[id]; !existed {
+			stored.Packs[id] = stats
+		}
+	}
+	for id := range base.Packs {
+		if _, kept := index.Packs[id]; !kept && live[id] == 0 {
+			delete(stored.Packs, id)
+		}
+	}
+	for id, stats := range stored.Packs {
+		stats.Dead = stats.Size - live[id]
+	}
+	client.index = stored
+}
+
+// clone returns a copy of index that changes to it leave alone
+func (index *packIndex) clone() *packIndex {
+	clone := &packIndex{
+		Revision: index.Revision,
+		Members:  make(map[string]packMember, len(index.Members)),
+		Packs:    make(map[string]*packStats, len(index.Packs)),
+	}
+	for id, member := range index.Members {
+		clone.Members[id] = member
+	}
+	for id, stats := range index.Packs {
+		copied := *stats
+		clone.Packs[id] = &copied
+	}
+	return clone
+}
+
+func (client *Pack) threshold() int64 {
+	if client.Policy.Threshold > 0 {
+		return client.Policy.Threshold
+	}
+	return defaultPackThreshold
+}
+
+func (client *Pack) packSize() int64 {
+	if client.Policy.PackSize > 0 {
+		return client.Policy.PackSize
+	}
+	return defaultPackSize
+}
+
+func (client *Pack) deadSpace() float64 {
+	if client.Policy.DeadSpace > 0 {
+		return client.Policy.DeadSpace
+	}
+	return defaultPackDeadSpace
+}
+
+func newPackID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return packIDPrefix + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,189 @@
+package cloud_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+// countingClient counts the objects uploaded through it, as a provider would bill PUT requests
+type countingClient struct {
+	cloud.Client
+	uploads int
+}
+
+func (client *countingClient) Upload(ctx context.Context, entry cloud.Entry, file cloud.File) error {
+	client.uploads++
+	return client.Client.Upload(ctx, entry, file)
+}
+
+func TestPack(t *testing.T) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	local := setupLocal(t).(*cloud.Local)
+	defer os.RemoveAll(filepath.Dir(local.Path))
+	local.Key = kc
+	counting := &countingClient{Client: local}
+	policy := cloud.PackPolicy{Threshold: 100, PackSize: 1000}
+	client := cloud.PackClient(counting, kc, policy)
+
+	upload := func(client cloud.Client, entry cloud.Entry, body []byte) {
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := client.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	download := func(client cloud.Client, id string, expected []byte) {
+		rc, err := client.Download(context.Background(), cloud.Entry{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, expected)
+	}
+	receipt := func(i int) []byte {
+		return []byte(fmt.Sprintf("receipt #%d: coffee, $%d.50", i, i))
+	}
+	large := bytes.Repeat([]byte("tax return "), 20)
+
+	// Sizes are the caller's own, as plaintext sizes would be, and so unlike the data's lengths
+	for i := 0; i < 5; i++ {
+		upload(client, cloud.Entry{ID: fmt.Sprintf("receipt%d", i), Name: fmt.Sprintf("receipt %d.jpg", i), Size: int64(i) << 10}, receipt(i))
+	}
+	upload(client, cloud.Entry{ID: "return", Name: "2017 return.pdf"}, large)
+
+	t.Run("Pending", func(t *testing.T) {
+		if counting.uploads != 1 {
+			t.Errorf("expected only the large entry to be sent before Flush, %d objects were", counting.uploads)
+		}
+		download(client, "receipt2", receipt(2))
+		if err := client.(cloud.Flusher).Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if counting.uploads != 3 {
+			t.Errorf("expected one pack and its index to be sent, %d objects were", counting.uploads-1)
+		}
+	})
+
+	// A new client reads everything back from the index it saved
+	client = cloud.PackClient(counting, kc, policy)
+
+	t.Run("Read", func(t *testing.T) {
+		headed := cloud.Entry{ID: "receipt3"}
+		if err := client.Head(context.Background(), &headed); err != nil {
+			t.Fatal(err)
+		}
+		if headed.Name != "receipt 3.jpg" || headed.Size != 3<<10 {
+			t.Errorf("unexpected entry read from the index: %+v", headed)
+		}
+		download(client, "receipt3", receipt(3))
+		download(client, "return", large)
+
+		rc, err := client.DownloadRange(context.Background(), cloud.Entry{ID: "receipt1"}, 3, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, receipt(1)[3:9])
+	})
+	t.Run("List", func(t *testing.T) {
+		listed, stored := listIDs(t, client), listIDs(t, local)
+		if len(listed) != 6 || strings.Contains(strings.Join(listed, " "), "pack") {
+			t.Errorf("expected the 5 receipts and the return to be listed, received %v", listed)
+		}
+		if len(stored) != 3 {
+			t.Errorf("expected the return, one pack and the index to be stored, found %v", stored)
+		}
+	})
+	t.Run("Update", func(t *testing.T) {
+		renamed := cloud.Entry{ID: "receipt4", Name: "coffee.jpg"}
+		if err := client.Update(context.Background(), renamed); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.(cloud.Flusher).Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		assertHeadMatches(t, cloud.PackClient(local, kc, policy), renamed)
+	})
+	t.Run("Repack", func(t *testing.T) {
+		before := listIDs(t, local)
+		for i := 0; i < 4; i++ {
+			if err := client.Delete(context.Background(), cloud.Entry{ID: fmt.Sprintf("receipt%d", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.(cloud.Flusher).Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		after := listIDs(t, local)
+		if len(after) != 3 || strings.Join(after, " ") == strings.Join(before, " ") {
+			t.Errorf("expected the pack to be replaced by one holding only its live member, found %v then %v", before, after)
+		}
+		download(cloud.PackClient(local, kc, policy), "receipt4", receipt(4))
+		if listed := listIDs(t, client); len(listed) != 2 {
+			t.Errorf("expected the last receipt and the return to be listed, received %v", listed)
+		}
+	})
+	t.Run("Conflict", func(t *testing.T) {
+		// Another writer saves the index between this client loading it and saving it again
+		other := cloud.PackClient(local, kc, policy)
+		if err := other.Delete(context.Background(), cloud.Entry{ID: "receipt4"}); err != nil {
+			t.Fatal(err)
+		}
+		upload(other, cloud.Entry{ID: "receipt6"}, receipt(6))
+		upload(client, cloud.Entry{ID: "receipt5"}, receipt(5))
+		if err := other.(cloud.Flusher).Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.(cloud.Flusher).Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		fresh := cloud.PackClient(local, kc, policy)
+		if listed := listIDs(t, fresh); len(listed) != 3 || strings.Contains(strings.Join(listed, " "), "receipt4") {
+			t.Errorf("expected both writers' changes in the index, listing the return and 2 receipts: %v", listed)
+		}
+		download(fresh, "receipt5", receipt(5))
+		download(fresh, "receipt6", receipt(6))
+
+		// The pack left holding only the deleted receipt is collected, and nothing else is left behind
+		if err := client.(cloud.Flusher).Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if stored := listIDs(t, local); len(stored) != 4 {
+			t.Errorf("expected the return, each writer's pack and the index to be stored, found %v", stored)
+		}
+	})
+}
+
+// listIDs returns the IDs of every Entry client lists
+func listIDs(t *testing.T, client cloud.Client) []string {
+	entries := make(chan cloud.Entry)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.List(context.Background(), entries)
+	}()
+
+	var ids []string
+	for entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
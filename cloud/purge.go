@@ -0,0 +1,64 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Purger is implemented by Clients able to permanently empty and remove their archive
+// PlanRemoval is always safe to call; PurgeArchive only runs when given the Token of a
+// report that still matches the archive's contents
+type Purger interface {
+	PlanRemoval(context.Context) (*RemovalReport, error)
+	PurgeArchive(ctx context.Context, token string) error
+}
+
+// RemovalReport describes everything purging an archive would permanently delete
+type RemovalReport struct {
+	Archive       string `json:"archive"`        // bucket or directory being removed
+	Objects       int    `json:"objects"`        // current objects, including stored metadata
+	Versions      int    `json:"versions"`       // stored revisions of all objects, current ones included
+	DeleteMarkers int    `json:"delete_markers"` // markers left behind by deleting from a versioned archive
+	Uploads       int    `json:"uploads"`        // unfinished multipart uploads
+	Size          int64  `json:"size"`           // bytes across all versions
+	Token         string `json:"token"`          // pass to PurgeArchive to confirm removal
+}
+
+// removalItem is one thing a purge would delete, used to derive a RemovalReport's token
+type removalItem struct {
+	key       string
+	versionID string
+	size      int64
+}
+
+// newRemovalReport totals items into a report whose token changes if any of them do
+func newRemovalReport(archive string, items []removalItem) *RemovalReport {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].key != items[j].key {
+			return items[i].key < items[j].key
+		}
+		return items[i].versionID < items[j].versionID
+	})
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", archive)
+	for _, item := range items {
+		fmt.Fprintf(hash, "%q %q %d\n", item.key, item.versionID, item.size)
+	}
+
+	return &RemovalReport{
+		Archive: archive,
+		Token:   hex.EncodeToString(hash.Sum(nil)[:16]),
+	}
+}
+
+// confirm returns ErrConfirmation unless token matches the report
+func (report *RemovalReport) confirm(token string) error {
+	if token == "" || token != report.Token {
+		return ErrConfirmation
+	}
+	return nil
+}
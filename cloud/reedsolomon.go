@@ -0,0 +1,194 @@
+package cloud
+
+import "errors"
+
+var (
+	errShardCount     = errors.New("erasure coding needs at least one data shard and at most 255 shards in all")
+	errTooFewShards   = errors.New("too few shards to rebuild data")
+	errSingularMatrix = errors.New("erasure coding matrix is singular")
+)
+
+// gfExp and gfLog hold powers of the generator in GF(2^8), reduced by the polynomial
+// x^8 + x^4 + x^3 + x^2 + 1, and their logarithms; gfMul is the full multiplication table
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPower(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+// reedSolomon is a systematic Reed–Solomon code: the first data shards hold the data as is,
+// and the rest hold parity from which any data shards' worth of shards rebuild it
+type reedSolomon struct {
+	data, total int
+	matrix      [][]byte // total rows of data columns; the top rows are the identity
+}
+
+// newReedSolomon builds the code from a Vandermonde matrix, any data rows of which are
+// independent, made systematic by multiplying through by the inverse of its top rows
+func newReedSolomon(data, total int) (*reedSolomon, error) {
+	if data < 1 || total < data || total > 255 {
+		return nil, errShardCount
+	}
+
+	vandermonde := make([][]byte, total)
+	for row := range vandermonde {
+		vandermonde[row] = make([]byte, data)
+		for col := range vandermonde[row] {
+			vandermonde[row][col] = gfPower(byte(row), col)
+		}
+	}
+	top, err := invertMatrix(vandermonde[:data])
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{
+		data:   data,
+		total:  total,
+		matrix: multiplyMatrix(vandermonde, top),
+	}, nil
+}
+
+// encode fills in the parity shards from the data shards; all shards must be the same length
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for row := rs.data; row < rs.total; row++ {
+		parity := shards[row]
+		for i := range parity {
+			parity[i] = 0
+		}
+		for col := 0; col < rs.data; col++ {
+			mulAdd(parity, shards[col], rs.matrix[row][col])
+		}
+	}
+}
+
+// reconstruct fills in the missing (nil) data shards from any data shards' worth of those
+// present; missing parity shards are left missing
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	var (
+		rows    [][]byte
+		present [][]byte
+		size    int
+	)
+	for i := 0; i < rs.total && len(rows) < rs.data; i++ {
+		if shards[i] != nil {
+			rows = append(rows, rs.matrix[i])
+			present = append(present, shards[i])
+			size = len(shards[i])
+		}
+	}
+	if len(rows) < rs.data {
+		return errTooFewShards
+	}
+
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rs.data; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shard := make([]byte, size)
+		for col, source := range present {
+			mulAdd(shard, source, decode[i][col])
+		}
+		shards[i] = shard
+	}
+	return nil
+}
+
+// mulAdd adds c times src into dst
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+func multiplyMatrix(a, b [][]byte) [][]byte {
+	product := make([][]byte, len(a))
+	for row := range a {
+		product[row] = make([]byte, len(b[0]))
+		for col := range product[row] {
+			var sum byte
+			for i := range b {
+				sum ^= gfMul[a[row][i]][b[i][col]]
+			}
+			product[row][col] = sum
+		}
+	}
+	return product
+}
+
+// invertMatrix inverts a square matrix by Gauss–Jordan elimination, leaving it unchanged
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for row := range m {
+		work[row] = make([]byte, 2*n)
+		copy(work[row], m[row])
+		work[row][n+row] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingularMatrix
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInverse(work[col][col])
+		for i := range work[col] {
+			work[col][i] = gfMul[scale][work[col][i]]
+		}
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				mulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for row := range work {
+		inverse[row] = work[row][n:]
+	}
+	return inverse, nil
+}
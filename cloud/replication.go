@@ -0,0 +1,189 @@
+package cloud
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replica states
+const (
+	ReplicaSynced  = "synced"  // location holds the Entry's latest write
+	ReplicaPending = "pending" // location missed the Entry's latest write and must catch up
+)
+
+// Writes a Replica can be waiting on, most demanding first: a location missing
+// an upload needs the data itself, one missing an update only needs metadata
+const (
+	ReplicaUpload = "upload"
+	ReplicaUpdate = "update"
+	ReplicaDelete = "delete"
+)
+
+// Replica is the replication status of one Entry at one location
+type Replica struct {
+	State   string    `json:"state"`
+	Op      string    `json:"op"`              // last write this location received or is waiting on
+	Error   string    `json:"error,omitempty"` // why the location missed it
+	Updated time.Time `json:"updated"`
+}
+
+// ReplicationLog records, per Entry and location, whether the location holds the Entry's latest write
+// Entries are forgotten once every location holds their latest write, so the log only grows
+// with the writes still to catch up on; it is saved as JSON to Path after every change
+type ReplicationLog struct {
+	Path string
+
+	mutex    sync.Mutex
+	replicas map[string]map[string]Replica // by Entry ID, then location
+}
+
+// OpenReplicationLog loads the log saved at path, or starts an empty one if there is none
+func OpenReplicationLog(path string) (*ReplicationLog, error) {
+	replication := &ReplicationLog{
+		Path:     path,
+		replicas: make(map[string]map[string]Replica),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return replication, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &replication.replicas); err != nil {
+		return nil, err
+	}
+	return replication, nil
+}
+
+// Status returns the replication status of an Entry at each location it was written to,
+// or none once every location holds its latest write
+func (replication *ReplicationLog) Status(entryID string) map[string]Replica {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	status := make(map[string]Replica)
+	for location, replica := range replication.replicas[entryID] {
+		status[location] = replica
+	}
+	return status
+}
+
+// Pending returns the IDs of Entries waiting to catch up at location, in order
+func (replication *ReplicationLog) Pending(location string) []string {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	var ids []string
+	for id, replicas := range replication.replicas {
+		if replicas[location].State == ReplicaPending {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// synced reports whether location holds entryID's latest write
+// Entries the log knows nothing about are assumed to be everywhere
+func (replication *ReplicationLog) synced(entryID, location string) bool {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	replica, exists := replication.replicas[entryID][location]
+	return !exists || replica.State != ReplicaPending
+}
+
+// deleted reports whether entryID's latest write was a delete that at least one location carried out
+func (replication *ReplicationLog) deleted(entryID string) bool {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	for _, replica := range replication.replicas[entryID] {
+		if replica.Op == ReplicaDelete && replica.State == ReplicaSynced {
+			return true
+		}
+	}
+	return false
+}
+
+// record notes the outcome of writing op for entryID to each of locations; errs holds
+// the failures, keyed by location
+func (replication *ReplicationLog) record(entryID, op string, locations []string, errs map[string]error) error {
+	replication.mutex.Lock()
+	defer replication.mutex.Unlock()
+
+	replicas, tracked := replication.replicas[entryID]
+	if !tracked {
+		replicas = make(map[string]Replica)
+	}
+	now := time.Now()
+	for _, location := range locations {
+		previous := replicas[location]
+		replica := Replica{State: ReplicaSynced, Op: op, Updated: now}
+
+		// An update neither makes up for nor replaces a missing upload
+		if previous.State == ReplicaPending && previous.Op == ReplicaUpload && op == ReplicaUpdate {
+			replica = previous
+		}
+		if err := errs[location]; err != nil {
+			replica.State = ReplicaPending
+			replica.Error = err.Error()
+			replica.Updated = now
+		}
+		replicas[location] = replica
+	}
+
+	if !syncedEverywhere(replicas) {
+		replication.replicas[entryID] = replicas
+	} else if tracked {
+		delete(replication.replicas, entryID) // nothing left to track
+	} else {
+		return nil // nothing was tracked before either, so nothing to save
+	}
+	return replication.save()
+}
+
+func syncedEverywhere(replicas map[string]Replica) bool {
+	for _, replica := range replicas {
+		if replica.State != ReplicaSynced {
+			return false
+		}
+	}
+	return true
+}
+
+// save writes the log to Path
+func (replication *ReplicationLog) save() error {
+	return saveJSON(replication.Path, replication.replicas)
+}
+
+// saveJSON writes v as JSON to a temporary file and renames it into path, so a crash
+// never leaves the file half written
+func saveJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,265 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Defaults used for any RetryPolicy field left at zero
+const (
+	defaultMaxAttempts = 5
+	defaultBaseDelay   = 200 * time.Millisecond
+	defaultMaxDelay    = 30 * time.Second
+	defaultBudget      = 2 * time.Minute
+)
+
+// RetryPolicy decides how a Retry client retries operations that fail with ErrTransient
+// Zero values fall back on defaults
+type RetryPolicy struct {
+	MaxAttempts int           `json:"max_attempts,omitempty"` // attempts per operation, including the first; defaults to 5
+	BaseDelay   time.Duration `json:"base_delay,omitempty"`   // longest wait before the first retry, doubling after each; defaults to 200ms
+	MaxDelay    time.Duration `json:"max_delay,omitempty"`    // longest wait between any two attempts; defaults to 30s
+	Budget      time.Duration `json:"budget,omitempty"`       // total time an operation may spend before giving up; defaults to 2m
+}
+
+// Retry wraps a Client, retrying operations that fail with ErrTransient using
+// exponential backoff with full jitter until the policy's attempts or budget run out
+type Retry struct {
+	Client
+	Policy RetryPolicy
+}
+
+// RetryClient returns client wrapped so transient failures are retried following policy
+func RetryClient(client Client, policy RetryPolicy) Client {
+	return &Retry{
+		Client: client,
+		Policy: policy,
+	}
+}
+
+// CreateArchive creates the archive, retrying transient failures
+func (client Retry) CreateArchive(ctx context.Context) error {
+	return client.retry(ctx, func() error {
+		return client.Client.CreateArchive(ctx)
+	})
+}
+
+// RemoveArchive removes the archive, retrying transient failures
+func (client Retry) RemoveArchive(ctx context.Context) error {
+	return client.retry(ctx, func() error {
+		return client.Client.RemoveArchive(ctx)
+	})
+}
+
+// List collects all list data for the archive, retrying transient failures; closes Entry chan when done
+// Entries already passed along before a failure are skipped on retry, relying on providers listing in a stable order
+func (client Retry) List(ctx context.Context, entries chan Entry) error {
+	defer close(entries)
+
+	var sent int
+	return client.retry(ctx, func() error {
+		attempt := make(chan Entry)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- client.Client.List(ctx, attempt)
+		}()
+
+		var received int
+		for entry := range attempt {
+			received++
+			if received <= sent {
+				continue
+			}
+			select {
+			case entries <- entry:
+				sent++
+			case <-ctx.Done():
+				for range attempt {
+					// drain so the wrapped List can finish
+				}
+				return ctx.Err()
+			}
+		}
+		return <-errc
+	})
+}
+
+// Upload sends entry's data, retrying transient failures
+// file is returned to the offset it held when Upload was called before each retry so no data is skipped
+func (client Retry) Upload(ctx context.Context, entry Entry, file File) error {
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	attempted := false
+	return client.retry(ctx, func() error {
+		if attempted {
+			if _, err := file.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		attempted = true
+		return client.Client.Upload(ctx, entry, file)
+	})
+}
+
+// Head fills in entry's properties and metadata, retrying transient failures
+func (client Retry) Head(ctx context.Context, entry *Entry) error {
+	return client.retry(ctx, func() error {
+		return client.Client.Head(ctx, entry)
+	})
+}
+
+// UploadSealed sends entry's data and encrypted metadata as stored, retrying transient failures
+// file is returned to the offset it held when UploadSealed was called before each retry, as with Upload
+func (client Retry) UploadSealed(ctx context.Context, entry Entry, sealed string, file File) error {
+	sealer, ok := client.Client.(SealedClient)
+	if !ok {
+		return errNotSealed
+	}
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	attempted := false
+	return client.retry(ctx, func() error {
+		if attempted {
+			if _, err := file.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		attempted = true
+		return sealer.UploadSealed(ctx, entry, sealed, file)
+	})
+}
+
+// HeadSealed fills in entry's properties, returning its encrypted metadata as stored, retrying transient failures
+func (client Retry) HeadSealed(ctx context.Context, entry *Entry) (sealed string, err error) {
+	sealer, ok := client.Client.(SealedClient)
+	if !ok {
+		return "", errNotSealed
+	}
+
+	err = client.retry(ctx, func() (err error) {
+		sealed, err = sealer.HeadSealed(ctx, entry)
+		return
+	})
+	return
+}
+
+// Download opens entry's data, retrying transient failures
+// NOTE: only opening the data is retried; errors while reading it are returned to the caller
+func (client Retry) Download(ctx context.Context, entry Entry) (rc io.ReadCloser, err error) {
+	err = client.retry(ctx, func() (err error) {
+		rc, err = client.Client.Download(ctx, entry)
+		return
+	})
+	return
+}
+
+// DownloadRange opens part of entry's data, retrying transient failures
+// NOTE: only opening the data is retried; errors while reading it are returned to the caller
+func (client Retry) DownloadRange(ctx context.Context, entry Entry, offset, length int64) (rc io.ReadCloser, err error) {
+	err = client.retry(ctx, func() (err error) {
+		rc, err = client.Client.DownloadRange(ctx, entry, offset, length)
+		return
+	})
+	return
+}
+
+// Update replaces entry's metadata, retrying transient failures
+func (client Retry) Update(ctx context.Context, entry Entry) error {
+	return client.retry(ctx, func() error {
+		return client.Client.Update(ctx, entry)
+	})
+}
+
+// Delete removes entry, retrying transient failures
+func (client Retry) Delete(ctx context.Context, entry Entry) error {
+	return client.retry(ctx, func() error {
+		return client.Client.Delete(ctx, entry)
+	})
+}
+
+// ListVersions returns entry's stored revisions, retrying transient failures
+func (client Retry) ListVersions(ctx context.Context, entry Entry) (versions []Version, err error) {
+	err = client.retry(ctx, func() (err error) {
+		versions, err = client.Client.ListVersions(ctx, entry)
+		return
+	})
+	return
+}
+
+// Restore makes an older revision of entry current again, retrying transient failures
+func (client Retry) Restore(ctx context.Context, entry Entry, versionID string) error {
+	return client.retry(ctx, func() error {
+		return client.Client.Restore(ctx, entry, versionID)
+	})
+}
+
+// retry calls op until it succeeds, fails with an error other than ErrTransient,
+// or the policy's attempts or budget run out; the last error is returned
+func (client Retry) retry(ctx context.Context, op func() error) error {
+	deadline := time.Now().Add(client.Policy.budget())
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !errors.Is(err, ErrTransient) || attempt >= client.Policy.maxAttempts() {
+			return err
+		}
+
+		delay := client.Policy.delay(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// delay returns a random wait of up to BaseDelay doubled for each attempt so far, capped at MaxDelay
+func (policy RetryPolicy) delay(attempt int) time.Duration {
+	ceiling := policy.maxDelay()
+	if shift := uint(attempt - 1); shift < 32 && policy.baseDelay()<<shift < ceiling {
+		ceiling = policy.baseDelay() << shift
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (policy RetryPolicy) maxAttempts() int {
+	if policy.MaxAttempts < 1 {
+		return defaultMaxAttempts
+	}
+	return policy.MaxAttempts
+}
+
+func (policy RetryPolicy) baseDelay() time.Duration {
+	if policy.BaseDelay <= 0 {
+		return defaultBaseDelay
+	}
+	return policy.BaseDelay
+}
+
+func (policy RetryPolicy) maxDelay() time.Duration {
+	if policy.MaxDelay <= 0 {
+		return defaultMaxDelay
+	}
+	return policy.MaxDelay
+}
+
+func (policy RetryPolicy) budget() time.Duration {
+	if policy.Budget <= 0 {
+		return defaultBudget
+	}
+	return policy.Budget
+}
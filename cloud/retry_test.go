@@ -0,0 +1,131 @@
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+)
+
+// flakyClient fails a set number of calls with ErrTransient before passing them on
+type flakyClient struct {
+	cloud.Client
+	failures int // calls left to fail
+	calls    int
+}
+
+func (client *flakyClient) Upload(ctx context.Context, entry cloud.Entry, file cloud.File) error {
+	client.calls++
+	if client.failures > 0 {
+		client.failures--
+		io.CopyN(ioutil.Discard, file, 10) // connection drops partway through the body
+		return &cloud.Error{Kind: cloud.ErrTransient, Code: "RequestError", Err: errors.New("connection reset")}
+	}
+	return client.Client.Upload(ctx, entry, file)
+}
+
+func (client *flakyClient) Delete(ctx context.Context, entry cloud.Entry) error {
+	client.calls++
+	return &cloud.Error{Kind: cloud.ErrAccessDenied, Code: "AccessDenied", Err: errors.New("access denied")}
+}
+
+func TestRetry(t *testing.T) {
+	local := setupLocal(t)
+	defer os.RemoveAll(filepath.Dir(local.(*cloud.Local).Path))
+
+	policy := cloud.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	body := []byte("This is a test set of data and it is very nice")
+	entry := cloud.Entry{ID: "retry"}
+
+	t.Run("Upload", func(t *testing.T) {
+		flaky := &flakyClient{Client: local, failures: 2}
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if err := cloud.RetryClient(flaky, policy).Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+		if flaky.calls != 3 {
+			t.Errorf("expected 3 calls, received %d", flaky.calls)
+		}
+
+		rc, err := local.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, body) // retried from the start of the file
+	})
+	t.Run("UploadFromOffset", func(t *testing.T) {
+		flaky := &flakyClient{Client: local, failures: 2}
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		// Callers may hand over a file already positioned past a header of their own
+		const offset = 5
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if err := cloud.RetryClient(flaky, policy).Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+
+		rc, err := local.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, body[offset:]) // retried from where the file stood, not its start
+	})
+	t.Run("OutOfAttempts", func(t *testing.T) {
+		flaky := &flakyClient{Client: local, failures: 3}
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if err := cloud.RetryClient(flaky, policy).Upload(context.Background(), entry, file); !errors.Is(err, cloud.ErrTransient) {
+			t.Errorf("expected %v, received %v", cloud.ErrTransient, err)
+		}
+		if flaky.calls != 3 {
+			t.Errorf("expected 3 calls, received %d", flaky.calls)
+		}
+	})
+	t.Run("OutOfBudget", func(t *testing.T) {
+		flaky := &flakyClient{Client: local, failures: 3}
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		budgeted := cloud.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, Budget: time.Millisecond}
+		if err := cloud.RetryClient(flaky, budgeted).Upload(context.Background(), entry, file); !errors.Is(err, cloud.ErrTransient) {
+			t.Errorf("expected %v, received %v", cloud.ErrTransient, err)
+		}
+		if flaky.calls > 2 {
+			t.Errorf("expected budget to stop retries, received %d calls", flaky.calls)
+		}
+	})
+	t.Run("NotTransient", func(t *testing.T) {
+		flaky := &flakyClient{Client: local}
+		if err := cloud.RetryClient(flaky, policy).Delete(context.Background(), entry); !errors.Is(err, cloud.ErrAccessDenied) {
+			t.Errorf("expected %v, received %v", cloud.ErrAccessDenied, err)
+		}
+		if flaky.calls != 1 {
+			t.Errorf("expected 1 call, received %d", flaky.calls)
+		}
+	})
+
+	if err := local.Delete(context.Background(), entry); err != nil {
+		t.Error(err)
+	}
+	if err := local.RemoveArchive(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
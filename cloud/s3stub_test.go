@@ -0,0 +1,878 @@
+package cloud_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+)
+
+const (
+	s3EndpointEnv = "LOCKEDARCHIVE_TEST_S3_ENDPOINT" // e.g. http://localhost:9000 for a local MinIO
+	s3RegionEnv   = "LOCKEDARCHIVE_TEST_S3_REGION"
+)
+
+// newTestAS3 returns an AS3 client pointed at the S3-compatible service named
+// by LOCKEDARCHIVE_TEST_S3_ENDPOINT or, when unset, at an in-process stand-in;
+// caller responsible for calling close once done
+func newTestAS3(t *testing.T, bucket string) (client *cloud.AS3, close func()) {
+	if endpoint := os.Getenv(s3EndpointEnv); endpoint != "" {
+		return &cloud.AS3{
+			Bucket:    bucket,
+			Region:    os.Getenv(s3RegionEnv),
+			Endpoint:  endpoint,
+			PathStyle: true,
+		}, func() {}
+	}
+
+	client, _, close = newStubAS3(t, bucket)
+	return
+}
+
+// newStubAS3 returns an AS3 client pointed at an in-process stand-in, along with
+// the stand-in for inspection; caller responsible for calling close once done
+func newStubAS3(t *testing.T, bucket string) (client *cloud.AS3, stub *s3Stub, close func()) {
+	// The stand-in does not check signatures, but the SDK still needs something to sign with
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		if os.Getenv(env) == "" {
+			os.Setenv(env, "lockedarchive-test")
+		}
+	}
+
+	stub = newS3Stub()
+	server := httptest.NewTLSServer(stub)
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return &cloud.AS3{
+		Bucket:    bucket,
+		Region:    "us-east-1",
+		Endpoint:  server.URL,
+		PathStyle: true,
+		CACert:    caCert,
+	}, stub, server.Close
+}
+
+// s3Stub is a minimal, in-memory stand-in for the parts of the S3 API used by AS3
+type s3Stub struct {
+	sync.Mutex
+	buckets map[string]*s3StubBucket
+	uploads map[string]*s3StubUpload // keyed by upload id
+
+	accessKey     string // access key id the last request was signed with
+	versionCount  int    // used to generate version ids
+	partsReceived int    // number of parts received successfully
+	failPartsFrom int    // once partsReceived reaches this, fail part uploads; 0 to disable
+
+	afterListVersions func(*s3StubBucket) // called with the lock held once versions are listed; may be nil
+}
+
+type s3StubBucket struct {
+	location  string // LocationConstraint the bucket was created with
+	versioned bool
+	locking   bool                       // whether object lock was enabled as the bucket was created
+	retention s3StubRetention            // default retention given to new versions
+	lifecycle []byte                     // lifecycle configuration as sent
+	settings  map[string][]byte          // other bucket configuration as sent, by subresource (encryption, policy, publicAccessBlock)
+	objects   map[string][]*s3StubObject // every version of each key, oldest first
+}
+
+type s3StubObject struct {
+	versionID    string
+	deleteMarker bool
+	data         []byte
+	meta         http.Header
+	modified     time.Time
+	storageClass string
+	tagging      string
+	restore      string // "", "ongoing" or "done"
+	retention    s3StubRetention
+	retainUntil  time.Time
+	legalHold    string // "", "ON" or "OFF"
+}
+
+type s3StubRetention struct {
+	Mode  string
+	Days  int
+	Years int
+}
+
+// locked reports whether object may not yet be deleted
+func (object *s3StubObject) locked() bool {
+	return object.legalHold == "ON" || (object.retention.Mode != "" && time.Now().Before(object.retainUntil))
+}
+
+type s3StubUpload struct {
+	bucket       string
+	key          string
+	meta         http.Header
+	storageClass string
+	initiated    time.Time
+	parts        map[int][]byte
+}
+
+func newS3Stub() *s3Stub {
+	return &s3Stub{
+		buckets: make(map[string]*s3StubBucket),
+		uploads: make(map[string]*s3StubUpload),
+	}
+}
+
+func (stub *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.Lock()
+	defer stub.Unlock()
+
+	// Authorization: AWS4-HMAC-SHA256 Credential=<access key>/<date>/<region>/s3/aws4_request, ...
+	if credential := strings.SplitN(r.Header.Get("Authorization"), "Credential=", 2); len(credential) == 2 {
+		stub.accessKey = strings.SplitN(credential[1], "/", 2)[0]
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	name := path[0]
+	if len(path) == 1 || path[1] == "" {
+		stub.serveBucket(w, r, name)
+		return
+	}
+
+	bucket, exists := stub.buckets[name]
+	if !exists {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+	if hasQuery(query, "uploads") || query.Get("uploadId") != "" {
+		stub.serveMultipart(w, r, name, path[1])
+		return
+	}
+	stub.serveObject(w, r, bucket, path[1])
+}
+
+func (stub *s3Stub) serveBucket(w http.ResponseWriter, r *http.Request, name string) {
+	var (
+		bucket, exists = stub.buckets[name]
+		query          = r.URL.Query()
+	)
+
+	if r.Method == http.MethodPut && len(query) == 0 {
+		if exists {
+			writeS3Error(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou")
+			return
+		}
+		var config struct{ LocationConstraint string }
+		if err := xml.NewDecoder(r.Body).Decode(&config); err != nil && err != io.EOF {
+			writeS3Error(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		locking := r.Header.Get("X-Amz-Bucket-Object-Lock-Enabled") == "true"
+		stub.buckets[name] = &s3StubBucket{
+			location:  config.LocationConstraint,
+			versioned: locking, // object lock turns versioning on with it
+			locking:   locking,
+			settings:  make(map[string][]byte),
+			objects:   make(map[string][]*s3StubObject),
+		}
+		return
+	}
+	if !exists {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && hasQuery(query, "versioning"):
+		var config struct{ Status string }
+		if err := xml.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		bucket.versioned = config.Status == "Enabled"
+
+	case r.Method == http.MethodPut && hasQuery(query, "object-lock"):
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Md5") == "" || !digestMatches(r.Header, data) {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidDigest")
+			return
+		}
+		var config struct {
+			ObjectLockEnabled string
+			Rule              struct{ DefaultRetention s3StubRetention }
+		}
+		if err := xml.Unmarshal(data, &config); err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		if !bucket.locking {
+			writeS3Error(w, r, http.StatusConflict, "InvalidBucketState")
+			return
+		}
+		bucket.retention = config.Rule.DefaultRetention
+
+	case r.Method == http.MethodPut && (hasQuery(query, "encryption") || hasQuery(query, "policy") || hasQuery(query, "publicAccessBlock")):
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || !digestMatches(r.Header, data) {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidDigest")
+			return
+		}
+		for subresource := range query {
+			if !hasQuery(query, "policy") && r.Header.Get("Content-Md5") == "" {
+				writeS3Error(w, r, http.StatusBadRequest, "InvalidRequest") // as S3 requires of the others
+				return
+			}
+			bucket.settings[subresource] = data
+		}
+
+	case r.Method == http.MethodPut && hasQuery(query, "lifecycle"):
+		lifecycle, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		bucket.lifecycle = lifecycle
+
+	case r.Method == http.MethodDelete && hasQuery(query, "lifecycle"):
+		bucket.lifecycle = nil
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && len(query) == 0:
+		if len(bucket.objects) > 0 {
+			writeS3Error(w, r, http.StatusConflict, "BucketNotEmpty")
+			return
+		}
+		delete(stub.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && hasQuery(query, "delete"):
+		var request struct {
+			Objects []struct {
+				Key       string
+				VersionID string `xml:"VersionId"`
+			} `xml:"Object"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var result s3StubDeleteResult // quiet mode: only failures are reported
+		for _, object := range request.Objects {
+			if object.VersionID == "" {
+				writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+				return
+			}
+			if version := bucket.version(object.Key, object.VersionID); version != nil && version.locked() {
+				result.Errors = append(result.Errors, s3StubDeleteError{
+					Key: object.Key, VersionID: object.VersionID, Code: "ObjectLocked", Message: s3StubLockedMessage,
+				})
+				continue
+			}
+			bucket.remove(object.Key, object.VersionID)
+		}
+		writeS3XML(w, result)
+
+	case r.Method == http.MethodGet && hasQuery(query, "uploads"):
+		writeS3XML(w, stub.listUploads(name))
+
+	case r.Method == http.MethodGet && hasQuery(query, "versions"):
+		writeS3XML(w, bucket.listVersions(name, query.Get("prefix")))
+		if stub.afterListVersions != nil {
+			stub.afterListVersions(bucket)
+		}
+
+	case r.Method == http.MethodGet:
+		writeS3XML(w, bucket.listObjects(name))
+
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (stub *s3Stub) serveObject(w http.ResponseWriter, r *http.Request, bucket *s3StubBucket, key string) {
+	versionID := r.URL.Query().Get("versionId")
+	if hasQuery(r.URL.Query(), "legal-hold") {
+		stub.serveLegalHold(w, r, bucket, key)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			stub.copyObject(w, r, bucket, key, source)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if !digestMatches(r.Header, data) {
+			writeS3Error(w, r, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		object := stub.put(bucket, key, &s3StubObject{
+			data:         data,
+			meta:         userMeta(r.Header),
+			storageClass: r.Header.Get("X-Amz-Storage-Class"),
+			tagging:      r.Header.Get("X-Amz-Tagging"),
+		})
+		w.Header().Set("ETag", object.etag())
+		w.Header().Set("X-Amz-Version-Id", object.versionID)
+
+	case http.MethodPost:
+		object := bucket.latest(key)
+		switch {
+		case !hasQuery(r.URL.Query(), "restore"):
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+		case object == nil || object.deleteMarker:
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+		case !object.archived():
+			writeS3Error(w, r, http.StatusForbidden, "InvalidObjectState")
+		case object.restore == "ongoing":
+			writeS3Error(w, r, http.StatusConflict, "RestoreAlreadyInProgress")
+		case object.restore == "done":
+			w.WriteHeader(http.StatusOK)
+		default:
+			object.restore = "ongoing"
+			w.WriteHeader(http.StatusAccepted)
+		}
+
+	case http.MethodGet, http.MethodHead:
+		object := bucket.latest(key)
+		if versionID != "" {
+			object = bucket.version(key, versionID)
+		}
+		if object == nil || object.deleteMarker {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if r.Method == http.MethodGet && object.archived() && object.restore != "done" {
+			writeS3Error(w, r, http.StatusForbidden, "InvalidObjectState")
+			return
+		}
+		for name, values := range object.meta {
+			w.Header()[name] = values
+		}
+		if object.storageClass != "" && object.storageClass != "STANDARD" {
+			w.Header().Set("X-Amz-Storage-Class", object.storageClass)
+		}
+		switch object.restore {
+		case "ongoing":
+			w.Header().Set("X-Amz-Restore", `ongoing-request="true"`)
+		case "done":
+			w.Header().Set("X-Amz-Restore", `ongoing-request="false", expiry-date="Fri, 21 Dec 2040 00:00:00 GMT"`)
+		}
+		if object.retention.Mode != "" {
+			w.Header().Set("X-Amz-Object-Lock-Mode", object.retention.Mode)
+			w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date", object.retainUntil.UTC().Format(time.RFC3339))
+		}
+		if object.legalHold != "" {
+			w.Header().Set("X-Amz-Object-Lock-Legal-Hold", object.legalHold)
+		}
+		w.Header().Set("ETag", object.etag())
+		w.Header().Set("X-Amz-Version-Id", object.versionID)
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+
+		data := object.data
+		if start, end, ok := parseRange(r.Header.Get("Range"), len(data)); ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(end-start))
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[start:end]
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case http.MethodDelete:
+		switch {
+		case versionID != "":
+			if object := bucket.version(key, versionID); object != nil && object.locked() {
+				writeS3ErrorMessage(w, r, http.StatusBadRequest, "InvalidRequest", s3StubLockedMessage)
+				return
+			}
+			bucket.remove(key, versionID)
+		case bucket.versioned:
+			stub.put(bucket, key, &s3StubObject{deleteMarker: true})
+		default:
+			delete(bucket.objects, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// serveLegalHold places, lifts or reports a legal hold on the latest version of key
+func (stub *s3Stub) serveLegalHold(w http.ResponseWriter, r *http.Request, bucket *s3StubBucket, key string) {
+	object := bucket.latest(key)
+	switch {
+	case !bucket.locking:
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidRequest")
+	case object == nil || object.deleteMarker:
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+
+	case r.Method == http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Md5") == "" || !digestMatches(r.Header, data) {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidDigest")
+			return
+		}
+		var hold s3StubLegalHold
+		if err := xml.Unmarshal(data, &hold); err != nil || (hold.Status != "ON" && hold.Status != "OFF") {
+			writeS3Error(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		object.legalHold = hold.Status
+
+	case r.Method == http.MethodGet && object.legalHold == "":
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchObjectLockConfiguration")
+	case r.Method == http.MethodGet:
+		writeS3XML(w, s3StubLegalHold{Status: object.legalHold})
+
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// copyObject handles a PUT carrying x-amz-copy-source of the form bucket/key[?versionId=id]
+func (stub *s3Stub) copyObject(w http.ResponseWriter, r *http.Request, bucket *s3StubBucket, key, source string) {
+	source, err := url.QueryUnescape(source)
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	var versionID string
+	if i := strings.Index(source, "?versionId="); i >= 0 {
+		source, versionID = source[:i], source[i+len("?versionId="):]
+	}
+	path := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	sourceBucket, exists := stub.buckets[path[0]]
+	if !exists || len(path) < 2 {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	original := sourceBucket.latest(path[1])
+	if versionID != "" {
+		original = sourceBucket.version(path[1], versionID)
+	}
+	if original == nil || original.deleteMarker {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if original.archived() && original.restore != "done" {
+		writeS3Error(w, r, http.StatusForbidden, "InvalidObjectState")
+		return
+	}
+
+	meta := original.meta
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		meta = userMeta(r.Header)
+	}
+	object := stub.put(bucket, key, &s3StubObject{
+		data:         original.data,
+		meta:         meta,
+		storageClass: r.Header.Get("X-Amz-Storage-Class"),
+	})
+	w.Header().Set("X-Amz-Version-Id", object.versionID)
+	writeS3XML(w, s3StubCopyResult{ETag: object.etag(), LastModified: object.modified.UTC().Format(time.RFC3339)})
+}
+
+// finishRestores makes every archived object being restored readable
+func (stub *s3Stub) finishRestores() {
+	stub.Lock()
+	defer stub.Unlock()
+
+	for _, bucket := range stub.buckets {
+		for _, versions := range bucket.objects {
+			for _, object := range versions {
+				if object.restore == "ongoing" {
+					object.restore = "done"
+				}
+			}
+		}
+	}
+}
+
+// archived reports whether object's data must be restored before it can be read
+func (object *s3StubObject) archived() bool {
+	return object.storageClass == "GLACIER" || object.storageClass == "DEEP_ARCHIVE"
+}
+
+// put stores object as the latest version of key, replacing it when versioning is off
+func (stub *s3Stub) put(bucket *s3StubBucket, key string, object *s3StubObject) *s3StubObject {
+	object.modified = time.Now()
+	if !object.deleteMarker && bucket.retention.Mode != "" {
+		object.retention = bucket.retention
+		object.retainUntil = object.modified.AddDate(bucket.retention.Years, 0, bucket.retention.Days)
+	}
+	if !bucket.versioned {
+		object.versionID = "null"
+		bucket.objects[key] = []*s3StubObject{object}
+		return object
+	}
+
+	stub.versionCount++
+	object.versionID = "v" + strconv.Itoa(stub.versionCount)
+	bucket.objects[key] = append(bucket.objects[key], object)
+	return object
+}
+
+// latest returns the current version of key; nil if there is none
+func (bucket *s3StubBucket) latest(key string) *s3StubObject {
+	versions := bucket.objects[key]
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
+
+func (bucket *s3StubBucket) version(key, versionID string) *s3StubObject {
+	for _, object := range bucket.objects[key] {
+		if object.versionID == versionID {
+			return object
+		}
+	}
+	return nil
+}
+
+func (bucket *s3StubBucket) remove(key, versionID string) {
+	versions := bucket.objects[key]
+	for i, object := range versions {
+		if object.versionID == versionID {
+			versions = append(versions[:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(bucket.objects, key)
+		return
+	}
+	bucket.objects[key] = versions
+}
+
+func (object *s3StubObject) etag() string {
+	sum := md5.Sum(object.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+type s3StubListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []s3StubListContent
+}
+
+type s3StubListContent struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+func (bucket *s3StubBucket) listObjects(name string) s3StubListResult {
+	result := s3StubListResult{Name: name}
+	for key := range bucket.objects {
+		object := bucket.latest(key)
+		if object.deleteMarker {
+			continue
+		}
+		result.Contents = append(result.Contents, s3StubListContent{
+			Key:          key,
+			LastModified: object.modified.UTC().Format(time.RFC3339),
+			ETag:         object.etag(),
+			Size:         len(object.data),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	return result
+}
+
+type s3StubListVersionsResult struct {
+	XMLName       xml.Name `xml:"ListVersionsResult"`
+	Name          string
+	Prefix        string
+	IsTruncated   bool
+	Versions      []s3StubVersion `xml:"Version"`
+	DeleteMarkers []s3StubVersion `xml:"DeleteMarker"`
+}
+
+type s3StubVersion struct {
+	Key          string
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         int
+}
+
+func (bucket *s3StubBucket) listVersions(name, prefix string) s3StubListVersionsResult {
+	result := s3StubListVersionsResult{Name: name, Prefix: prefix}
+	for key, versions := range bucket.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for i := len(versions) - 1; i >= 0; i-- { // newest first, as S3 does
+			object := versions[i]
+			version := s3StubVersion{
+				Key:          key,
+				VersionID:    object.versionID,
+				IsLatest:     i == len(versions)-1,
+				LastModified: object.modified.UTC().Format(time.RFC3339Nano),
+			}
+			if object.deleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, version)
+				continue
+			}
+			version.ETag = object.etag()
+			version.Size = len(object.data)
+			result.Versions = append(result.Versions, version)
+		}
+	}
+	return result
+}
+
+type s3StubDeleteResult struct {
+	XMLName xml.Name            `xml:"DeleteResult"`
+	Errors  []s3StubDeleteError `xml:"Error"`
+}
+
+type s3StubDeleteError struct {
+	Key       string
+	VersionID string `xml:"VersionId"`
+	Code      string
+	Message   string
+}
+
+const s3StubLockedMessage = "Access Denied because object protected by object lock."
+
+type s3StubLegalHold struct {
+	XMLName xml.Name `xml:"LegalHold"`
+	Status  string
+}
+
+type s3StubCopyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string
+	LastModified string
+}
+
+// parseRange interprets a "bytes=start-end" Range header against data of the given size
+func parseRange(header string, size int) (start, end int, ok bool) {
+	if _, err := fmt.Sscanf(header, "bytes=%d-%d", &start, &end); err != nil || start >= size {
+		return 0, 0, false
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end + 1, true
+}
+
+// userMeta collects the x-amz-meta-* headers of a request
+func userMeta(header http.Header) http.Header {
+	meta := make(http.Header)
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+// digestMatches checks data against the Content-MD5 and x-amz-checksum-sha256 headers, when sent
+func digestMatches(header http.Header, data []byte) bool {
+	if expected := header.Get("Content-Md5"); expected != "" {
+		sum := md5.Sum(data)
+		if expected != base64.StdEncoding.EncodeToString(sum[:]) {
+			return false
+		}
+	}
+	if expected := header.Get("X-Amz-Checksum-Sha256"); expected != "" {
+		sum := sha256.Sum256(data)
+		if expected != base64.StdEncoding.EncodeToString(sum[:]) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasQuery(query url.Values, name string) bool {
+	_, exists := query[name]
+	return exists
+}
+
+func writeS3XML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(append([]byte(xml.Header), data...))
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	writeS3ErrorMessage(w, r, status, code, code)
+}
+
+func writeS3ErrorMessage(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, message)
+	}
+}
+
+func (stub *s3Stub) serveMultipart(w http.ResponseWriter, r *http.Request, name, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	if uploadID == "" { // initiate
+		uploadID = strconv.FormatInt(time.Now().UnixNano(), 36)
+		stub.uploads[uploadID] = &s3StubUpload{
+			bucket:       name,
+			key:          key,
+			meta:         userMeta(r.Header),
+			storageClass: r.Header.Get("X-Amz-Storage-Class"),
+			initiated:    time.Now(),
+			parts:        make(map[int][]byte),
+		}
+		writeS3XML(w, s3StubInitiateResult{Bucket: name, Key: key, UploadID: uploadID})
+		return
+	}
+
+	upload, exists := stub.uploads[uploadID]
+	if !exists || upload.bucket != name || upload.key != key {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if stub.failPartsFrom > 0 && stub.partsReceived >= stub.failPartsFrom {
+			writeS3Error(w, r, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		number, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if !digestMatches(r.Header, data) {
+			writeS3Error(w, r, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		upload.parts[number] = data
+		stub.partsReceived++
+		w.Header().Set("ETag", (&s3StubObject{data: data}).etag())
+
+	case http.MethodGet:
+		result := s3StubListPartsResult{Bucket: name, Key: key, UploadID: uploadID}
+		for number, data := range upload.parts {
+			result.Parts = append(result.Parts, s3StubPart{
+				PartNumber: number,
+				ETag:       (&s3StubObject{data: data}).etag(),
+				Size:       len(data),
+			})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		writeS3XML(w, result)
+
+	case http.MethodPost: // complete
+		var data []byte
+		numbers := make([]int, 0, len(upload.parts))
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		delete(stub.uploads, uploadID)
+		object := stub.put(stub.buckets[name], key, &s3StubObject{data: data, meta: upload.meta, storageClass: upload.storageClass})
+		w.Header().Set("X-Amz-Version-Id", object.versionID)
+		writeS3XML(w, s3StubCompleteResult{Bucket: name, Key: key, ETag: object.etag()})
+
+	case http.MethodDelete: // abort
+		delete(stub.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (stub *s3Stub) listUploads(name string) s3StubListUploadsResult {
+	result := s3StubListUploadsResult{Bucket: name}
+	for uploadID, upload := range stub.uploads {
+		if upload.bucket == name {
+			result.Uploads = append(result.Uploads, s3StubMultipartUpload{
+				Key:       upload.key,
+				UploadID:  uploadID,
+				Initiated: upload.initiated.UTC().Format(time.RFC3339Nano),
+			})
+		}
+	}
+	return result
+}
+
+type s3StubInitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type s3StubCompleteResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+type s3StubListPartsResult struct {
+	XMLName  xml.Name `xml:"ListPartsResult"`
+	Bucket   string
+	Key      string
+	UploadID string       `xml:"UploadId"`
+	Parts    []s3StubPart `xml:"Part"`
+}
+
+type s3StubPart struct {
+	PartNumber int
+	ETag       string
+	Size       int
+}
+
+type s3StubListUploadsResult struct {
+	XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+	Bucket  string
+	Uploads []s3StubMultipartUpload `xml:"Upload"`
+}
+
+type s3StubMultipartUpload struct {
+	Key       string
+	UploadID  string `xml:"UploadId"`
+	Initiated string
+}
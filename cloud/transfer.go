@@ -0,0 +1,316 @@
+package cloud
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket holding up to one second's worth of bytes
+// Share one between clients to cap their combined bandwidth
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // negative when transfers have borrowed against the future
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSecond
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// WaitN charges n bytes transferred against the limit, blocking until the limit allows them,
+// or returns ctx's error once ctx is done
+// Transfers waiting together are let through in the order they asked
+func (limiter *RateLimiter) WaitN(ctx context.Context, n int) error {
+	limiter.mutex.Lock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.rate {
+		limiter.tokens = limiter.rate
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	wait := time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	limiter.mutex.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Progress reports how far along an Entry's upload or download is
+type Progress struct {
+	Entry    Entry
+	Download bool  // false for uploads
+	Done     int64 // bytes transferred so far
+	Total    int64 // bytes to transfer; 0 if not known
+}
+
+// Transfer wraps a Client, reporting the progress of its uploads and downloads
+// and limiting their bandwidth
+type Transfer struct {
+	Client
+	UploadLimit   *RateLimiter   // shared by every upload through this Client; nil for no limit
+	DownloadLimit *RateLimiter   // shared by every download through this Client; nil for no limit
+	Progress      func(Progress) // called as data moves, possibly from several goroutines; may be nil
+}
+
+// TransferClient returns client wrapped so its transfers are limited and report their progress
+func TransferClient(client Client, uploadLimit, downloadLimit *RateLimiter, progress func(Progress)) Client {
+	return &Transfer{
+		Client:        client,
+		UploadLimit:   uploadLimit,
+		DownloadLimit: downloadLimit,
+		Progress:      progress,
+	}
+}
+
+// Upload sends entry's data through the wrapped Client, metering it as the Client sends it
+// if the Client does so (as AS3 does), or else as it is read from file
+func (client Transfer) Upload(ctx context.Context, entry Entry, file File) error {
+	ctx, metered, err := client.meterUpload(ctx, entry, file)
+	if err != nil {
+		return err
+	}
+	return client.Client.Upload(ctx, entry, metered)
+}
+
+// UploadSealed sends entry's data and encrypted metadata as stored through the wrapped
+// Client, metering the data as Upload does
+func (client Transfer) UploadSealed(ctx context.Context, entry Entry, sealed string, file File) error {
+	sealer, ok := client.Client.(SealedClient)
+	if !ok {
+		return errNotSealed
+	}
+	ctx, metered, err := client.meterUpload(ctx, entry, file)
+	if err != nil {
+		return err
+	}
+	return sealer.UploadSealed(ctx, entry, sealed, metered)
+}
+
+// HeadSealed fills in entry's properties through the wrapped Client, returning its encrypted metadata as stored
+func (client Transfer) HeadSealed(ctx context.Context, entry *Entry) (string, error) {
+	sealer, ok := client.Client.(SealedClient)
+	if !ok {
+		return "", errNotSealed
+	}
+	return sealer.HeadSealed(ctx, entry)
+}
+
+// meterUpload returns file wrapped to meter its reads, and ctx carrying the same meter for
+// a Client that meters data as it sends it instead
+func (client Transfer) meterUpload(ctx context.Context, entry Entry, file File) (context.Context, File, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &meter{
+		limiter:  client.UploadLimit,
+		report:   client.Progress,
+		progress: Progress{Entry: entry, Total: info.Size()},
+		reread:   true,
+	}
+	ctx = context.WithValue(ctx, sendMeterKey{}, m)
+	m.ctx = ctx
+	return ctx, &meteredFile{File: file, meter: m}, nil
+}
+
+// Download opens entry's data through the wrapped Client, metering reads from it
+func (client Transfer) Download(ctx context.Context, entry Entry) (io.ReadCloser, error) {
+	rc, err := client.Client.Download(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	return client.meterDownload(ctx, entry, rc, 0), nil
+}
+
+// DownloadRange opens part of entry's data through the wrapped Client, metering reads from it
+func (client Transfer) DownloadRange(ctx context.Context, entry Entry, offset, length int64) (io.ReadCloser, error) {
+	rc, err := client.Client.DownloadRange(ctx, entry, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return client.meterDownload(ctx, entry, rc, length), nil
+}
+
+func (client Transfer) meterDownload(ctx context.Context, entry Entry, rc io.ReadCloser, total int64) io.ReadCloser {
+	m := &meter{
+		ctx:      ctx,
+		limiter:  client.DownloadLimit,
+		report:   client.Progress,
+		progress: Progress{Entry: entry, Download: true, Total: total},
+	}
+	return m.readCloser(rc)
+}
+
+// sendMeterKey is the context key a Transfer's upload meter is passed to the wrapped Client with
+type sendMeterKey struct{}
+
+// sendMeter returns the meter of the Transfer uploading through ctx, if any, for a Client
+// to meter data with as it sends it; nil if there is none
+// NOTE: call markSending first, or the data is metered twice
+func sendMeter(ctx context.Context) *meter {
+	m, _ := ctx.Value(sendMeterKey{}).(*meter)
+	return m
+}
+
+// markSending tells the Transfer uploading through ctx, if any, that the Client meters data
+// with sendMeter as it sends it, so it is no longer metered as it is read from the file
+// A Client may read the file long before sending it, or more than once, so call this before
+// reading from the file
+func markSending(ctx context.Context) {
+	if m := sendMeter(ctx); m != nil {
+		atomic.StoreInt32(&m.sending, 1)
+	}
+}
+
+// meter limits and counts the bytes of one transfer
+type meter struct {
+	ctx     context.Context
+	limiter *RateLimiter
+	report  func(Progress)
+	reread  bool  // whether data may be read more than once, so Done must stop at Total
+	sending int32 // set once the Client meters data as it sends it; see markSending
+
+	mutex    sync.Mutex
+	progress Progress
+}
+
+// wait charges n bytes transferred against the limit, blocking until it allows them
+func (m *meter) wait(n int) error {
+	if m.limiter == nil || n == 0 {
+		return m.ctx.Err()
+	}
+	return m.limiter.WaitN(m.ctx, n)
+}
+
+// add counts n bytes as transferred and reports the new progress
+// NOTE: a Client may read data it uploads more than once (to hash it or to retry)
+func (m *meter) add(n int) {
+	if n == 0 || m.report == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	m.progress.Done += int64(n)
+	if m.reread && m.progress.Done > m.progress.Total {
+		m.progress.Done = m.progress.Total
+	}
+	progress := m.progress
+	m.mutex.Unlock()
+
+	m.report(progress)
+}
+
+// transferred counts and charges n bytes read, returning err unless waiting for the limit failed
+func (m *meter) transferred(n int, err error) (int, error) {
+	m.add(n)
+	if waitErr := m.wait(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+// readCloser limits and counts reads from rc
+func (m *meter) readCloser(rc io.ReadCloser) io.ReadCloser {
+	return &readCloser{
+		Reader: readerFunc(func(p []byte) (int, error) {
+			return m.transferred(rc.Read(p))
+		}),
+		Closer: rc,
+	}
+}
+
+// meteredFile limits and counts reads from a File being uploaded, unless the Client
+// uploading it meters what it sends instead
+type meteredFile struct {
+	File
+	*meter
+}
+
+func (file *meteredFile) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&file.sending) != 0 {
+		return file.File.Read(p)
+	}
+	return file.transferred(file.File.Read(p))
+}
+
+func (file *meteredFile) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&file.sending) != 0 {
+		return file.File.ReadAt(p, off)
+	}
+	return file.transferred(file.File.ReadAt(p, off))
+}
+
+// readerFunc lets a function satisfy io.Reader
+type readerFunc func(p []byte) (int, error)
+
+func (read readerFunc) Read(p []byte) (int, error) {
+	return read(p)
+}
+
+// Batch totals the progress of several transfers, such as a whole ingest
+// Pass its Track method as a Transfer's Progress, alongside any per Entry reporting
+type Batch struct {
+	Report func(done, total int64) // called whenever the batch's progress changes
+
+	mutex sync.Mutex
+	done  map[string]int64
+	total map[string]int64
+}
+
+// Expect counts an Entry's size towards the batch's total before its transfer begins
+func (batch *Batch) Expect(entry Entry) {
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	batch.init()
+	batch.total[entry.ID] = entry.Size
+}
+
+// Track records an Entry's progress and reports the batch's
+func (batch *Batch) Track(progress Progress) {
+	batch.mutex.Lock()
+	batch.init()
+	batch.done[progress.Entry.ID] = progress.Done
+	if progress.Total > 0 {
+		batch.total[progress.Entry.ID] = progress.Total
+	}
+	var done, total int64
+	for _, n := range batch.done {
+		done += n
+	}
+	for _, n := range batch.total {
+		total += n
+	}
+	batch.mutex.Unlock()
+
+	if batch.Report != nil {
+		batch.Report(done, total)
+	}
+}
+
+func (batch *Batch) init() {
+	if batch.done == nil {
+		batch.done = make(map[string]int64)
+		batch.total = make(map[string]int64)
+	}
+}
@@ -0,0 +1,163 @@
+package cloud_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := cloud.NewRateLimiter(1000)
+	start := time.Now()
+
+	if err := limiter.WaitN(context.Background(), 1000); err != nil { // a full bucket passes at once
+		t.Fatal(err)
+	}
+	if err := limiter.WaitN(context.Background(), 500); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected to wait about 500ms for tokens, waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.WaitN(ctx, 1000); err != context.Canceled {
+		t.Errorf("expected %v, received %v", context.Canceled, err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	local := setupLocal(t)
+	defer os.RemoveAll(filepath.Dir(local.(*cloud.Local).Path))
+
+	var (
+		mutex    sync.Mutex
+		progress []cloud.Progress
+		done     int64
+		total    int64
+		body     = []byte("This is a test set of data and it is very nice")
+		entry    = cloud.Entry{ID: "transfer", Size: int64(len(body))}
+	)
+	batch := &cloud.Batch{Report: func(batchDone, batchTotal int64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		done, total = batchDone, batchTotal
+	}}
+	batch.Expect(entry)
+	batch.Expect(cloud.Entry{ID: "pending", Size: 100})
+
+	client := cloud.TransferClient(local, cloud.NewRateLimiter(1<<20), cloud.NewRateLimiter(1<<20), func(p cloud.Progress) {
+		mutex.Lock()
+		progress = append(progress, p)
+		mutex.Unlock()
+		batch.Track(p)
+	})
+
+	t.Run("Upload", func(t *testing.T) {
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if err := client.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+
+		last := progress[len(progress)-1]
+		if last.Entry.ID != entry.ID || last.Download || last.Done != last.Total || last.Total != int64(len(body)) {
+			t.Errorf("expected upload to finish at %d bytes: %+v", len(body), last)
+		}
+		if done != int64(len(body)) || total != int64(len(body))+100 {
+			t.Errorf("expected batch at %d of %d bytes, received %d of %d", len(body), len(body)+100, done, total)
+		}
+	})
+	t.Run("Download", func(t *testing.T) {
+		progress = nil
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		assertReaderEquals(t, rc, body)
+
+		last := progress[len(progress)-1]
+		if !last.Download || last.Done != int64(len(body)) {
+			t.Errorf("expected download to finish at %d bytes: %+v", len(body), last)
+		}
+	})
+
+	if err := local.Delete(context.Background(), entry); err != nil {
+		t.Error(err)
+	}
+	if err := local.RemoveArchive(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransferCharges(t *testing.T) {
+	t.Run("BytesRead", func(t *testing.T) {
+		local := setupLocal(t)
+		defer os.RemoveAll(filepath.Dir(local.(*cloud.Local).Path))
+
+		body := []byte("small")
+		entry := cloud.Entry{ID: "small"}
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := local.Upload(context.Background(), entry, file); err != nil {
+			t.Fatal(err)
+		}
+
+		// A buffer larger than the limit costs nothing more than the bytes read into it
+		client := cloud.TransferClient(local, nil, cloud.NewRateLimiter(1000), nil)
+		start := time.Now()
+		rc, err := client.Download(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		buf := make([]byte, 4096)
+		for err == nil {
+			_, err = rc.Read(buf)
+		}
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected %d bytes to pass at once, waited %v", len(body), elapsed)
+		}
+	})
+	t.Run("BytesSent", func(t *testing.T) {
+		as3, _, close := newStubAS3(t, "lockedarchive-metered")
+		defer close()
+		as3.PartSize = 5 << 20
+		if err := as3.CreateArchive(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		body := make([]byte, as3.PartSize+1) // 2 parts, each read into memory before it is sent
+		file := makeBodyFile(t, body)
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		// Data is charged as it is sent, not again as it is read, so a full bucket covers it
+		var last cloud.Progress
+		client := cloud.TransferClient(as3, cloud.NewRateLimiter(int64(len(body))), nil, func(p cloud.Progress) { last = p })
+		start := time.Now()
+		if err := client.Upload(context.Background(), cloud.Entry{ID: "metered"}, file); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected %d bytes to be charged once and pass at once, waited %v", len(body), elapsed)
+		}
+		if last.Done != int64(len(body)) || last.Total != int64(len(body)) {
+			t.Errorf("expected upload to finish at %d bytes: %+v", len(body), last)
+		}
+	})
+}
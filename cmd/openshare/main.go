@@ -0,0 +1,127 @@
+// Command openshare downloads and decrypts one Entry someone shared from their archive
+//
+//	openshare -url <link> -capsule <capsule> [-o <path>]
+//
+// The secret received separately from the link is prompted for without echoing it, or read
+// from the first line of standard input when that is not a terminal, so it never shows up in
+// shell history or the process list
+// The file is written to the current directory under its original name unless -o says
+// otherwise; a file already there by that name is left alone and the share refused
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/jonathan-robertson/lockedarchive/cache"
+)
+
+var errNoSecret = errors.New("no secret given")
+
+func main() {
+	memguard.CatchInterrupt(func() {
+		fmt.Println("Interrupt signal received. Exiting...")
+	})
+	defer memguard.DestroyAll()
+
+	var (
+		url     = flag.String("url", "", "link to the shared data")
+		capsule = flag.String("capsule", "", "capsule received with the link")
+		out     = flag.String("o", "", "where to write the file, replacing any there; defaults to its original name")
+	)
+	flag.Parse()
+	if *url == "" || *capsule == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	secret, err := readSecret()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "openshare:", err)
+		memguard.SafeExit(1)
+	}
+	path, err := open(*url, *capsule, secret, *out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "openshare:", err)
+		memguard.SafeExit(1)
+	}
+	fmt.Println(path)
+}
+
+// readSecret prompts for the secret on the terminal, or reads it from the first line of
+// standard input if that is not a terminal
+func readSecret() (string, error) {
+	var line string
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "secret: ")
+		data, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		line = string(data)
+	} else {
+		var err error
+		if line, err = bufio.NewReader(os.Stdin).ReadString('\n'); err != nil && line == "" {
+			return "", fmt.Errorf("reading secret: %v", err)
+		}
+	}
+
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		return "", errNoSecret
+	}
+	return secret, nil
+}
+
+// open writes the shared file to out, or to its original name, returning where it went
+// Nothing is left behind unless the whole file decrypts and matches its checksum
+func open(url, capsule, secret, out string) (string, error) {
+	dir := "."
+	if out != "" {
+		dir = filepath.Dir(out)
+	}
+	tmp, err := ioutil.TempFile(dir, ".openshare")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	defer tmp.Close()           // backup in case we don't reach tmp.Close
+
+	entry, err := cache.OpenShare(context.Background(), url, capsule, secret, tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Chmod(tmp.Name(), entry.Mode.Perm()|0600); err != nil {
+		return "", err
+	}
+	if out != "" {
+		return out, os.Rename(tmp.Name(), out)
+	}
+
+	out = filepath.Base(entry.Name) // never anywhere but here, whatever the name says
+	if out == "." || out == string(filepath.Separator) {
+		out = "shared"
+	}
+	// Linking rather than renaming fails instead of replacing a file the sharer named
+	if err := os.Link(tmp.Name(), out); os.IsExist(err) {
+		return "", fmt.Errorf("%s already exists; choose where to write the file with -o", out)
+	} else if err != nil {
+		return "", err
+	}
+	return out, nil
+}
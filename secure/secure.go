@@ -2,7 +2,9 @@ package secure
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"io"
@@ -59,6 +61,8 @@ var (
 
 	// ErrPassphraseContainerNotSet is an error that occurred during an Encryption/Decryption operation with a passphrase
 	ErrPassphraseContainerNotSet = errors.New("passphrase not set")
+
+	errKeySize = errors.New("secret: key is the wrong size")
 )
 
 // REVIEW: https://leanpub.com/gocrypto/read#leanpub-auto-nacl
@@ -74,12 +78,28 @@ func (kc *KeyContainer) Key() Key {
 	return (Key)(unsafe.Pointer(&kc.Buffer()[0]))
 }
 
+// ProtectKey copies key bytes to a safe place in memory and wipes the original, even on err
+func ProtectKey(key []byte) (*KeyContainer, error) {
+	if len(key) != KeySize {
+		Wipe(key)
+		return nil, errKeySize
+	}
+	buf, err := memguard.NewImmutableFromBytes(key)
+	return &KeyContainer{LockedBuffer: buf}, err
+}
+
 // ProtectPassphrase copies passphrase bytes to a safe place in memory and wipes the original
 func ProtectPassphrase(passphrase []byte) (*PassphraseContainer, error) {
 	buf, err := memguard.NewImmutableFromBytes(passphrase)
 	return &PassphraseContainer{LockedBuffer: buf}, err
 }
 
+// ProtectSecret copies secret bytes to a safe place in memory and wipes the original
+func ProtectSecret(secret []byte) (*SecretContainer, error) {
+	buf, err := memguard.NewImmutableFromBytes(secret)
+	return &SecretContainer{LockedBuffer: buf}, err
+}
+
 // DeriveKeyContainer generates a new KeyContainer from a passphrase and wipes passphrase's bytes once done, even on err
 func (pc *PassphraseContainer) DeriveKeyContainer(salt Salt) (*KeyContainer, error) {
 
@@ -164,6 +184,22 @@ func Decrypt(kc *KeyContainer, message []byte) ([]byte, error) {
 	return out, nil
 }
 
+// KeyedHash returns an HMAC-SHA256 of message under a key derived from kc, so data can be
+// named by its contents without revealing anything about them to those lacking the key
+func KeyedHash(kc *KeyContainer, message []byte) []byte {
+	mac := hmac.New(sha256.New, DeriveKey(kc, "keyed hash"))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// DeriveKey returns a key for purpose derived from kc; keys derived for different purposes
+// reveal nothing about each other or kc
+func DeriveKey(kc *KeyContainer, purpose string) []byte {
+	derive := hmac.New(sha256.New, kc.Buffer())
+	derive.Write([]byte("lockedarchive " + purpose))
+	return derive.Sum(nil)
+}
+
 // EncryptWithSalt encrypts the bytes with a key, nonce, and salt.
 func EncryptWithSalt(pc *PassphraseContainer, nonce Nonce, message []byte) ([]byte, error) {
 	if pc == nil {
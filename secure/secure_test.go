@@ -49,6 +49,32 @@ func TestEncrypt(t *testing.T) {
 	t.Log("data encrypted and decrypted to get same result")
 }
 
+func TestKeyedHash(t *testing.T) {
+	kc, other := makeKeyContainer(t), makeKeyContainer(t)
+	defer kc.Destroy()
+	defer other.Destroy()
+
+	message := []byte("scanned deed")
+	if !bytes.Equal(secure.KeyedHash(kc, message), secure.KeyedHash(kc, message)) {
+		t.Error("expected the same message to hash the same under the same key")
+	}
+	if bytes.Equal(secure.KeyedHash(kc, message), secure.KeyedHash(other, message)) {
+		t.Error("expected the same message to hash differently under another key")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	kc := makeKeyContainer(t)
+	defer kc.Destroy()
+
+	if !bytes.Equal(secure.DeriveKey(kc, "chunk boundaries"), secure.DeriveKey(kc, "chunk boundaries")) {
+		t.Error("expected the same purpose to derive the same key")
+	}
+	if bytes.Equal(secure.DeriveKey(kc, "chunk boundaries"), secure.DeriveKey(kc, "keyed hash")) {
+		t.Error("expected another purpose to derive another key")
+	}
+}
+
 func TestEncryptKeyToString(t *testing.T) {
 	passphrase := []byte("test passphrase!")
 	pc, err := secure.ProtectPassphrase(passphrase)
@@ -1,12 +1,114 @@
 package service
 
-import "github.com/jonathan-robertson/lockedarchive/secure"
+import (
+	"sync"
 
-// AS3Location represents a remote storage location in Amazon S3
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+var (
+	// rate limiters shared by every client of an AS3Location, keyed by archive and location name
+	as3Limiters      = make(map[locationKey]rateLimits)
+	as3LimitersMutex sync.Mutex
+)
+
+// locationKey names one location of one archive
+type locationKey struct {
+	archive, location string
+}
+
+// rateLimits are the limiters shared by every client of one location, along with the
+// rates they were made for
+type rateLimits struct {
+	uploadRate, downloadRate int64
+	upload                   *cloud.RateLimiter
+	download                 *cloud.RateLimiter
+}
+
+// AS3Location represents a remote storage location in Amazon S3 or an S3-compatible service
 type AS3Location struct {
 	Bucket    string `json:"bucket,omitempty"`
 	AccessKey string `json:"access_key,omitempty"`
 	SecretKey string `json:"secret_key,omitempty"`
+
+	Region    string `json:"region,omitempty"`     // defaults to us-east-1
+	Endpoint  string `json:"endpoint,omitempty"`   // URL of an S3-compatible service (MinIO, Wasabi, Ceph); empty for AWS
+	PathStyle bool   `json:"path_style,omitempty"` // address bucket in URL path instead of host name
+	CACert    string `json:"ca_cert,omitempty"`    // PEM-encoded certificates to trust for TLS
+
+	StorageClass string             `json:"storage_class,omitempty"` // storage class for new data; defaults to STANDARD
+	Transitions  []cloud.Transition `json:"transitions,omitempty"`   // lifecycle rules moving data to colder storage as it ages
+	ObjectLock   *cloud.ObjectLock  `json:"object_lock,omitempty"`   // retention applied when the bucket is created; cannot be removed later
+	Harden       bool               `json:"harden,omitempty"`        // apply a hardened baseline when the bucket is created; see cloud.AS3
+
+	UploadRate   int64 `json:"upload_rate,omitempty"`   // bytes per second shared by all uploads; 0 for no limit
+	DownloadRate int64 `json:"download_rate,omitempty"` // bytes per second shared by all downloads; 0 for no limit
+}
+
+// client returns an AS3 client for this location, signing with its stored credentials
+// (or the default AWS credential chain when it has none); decrypted credentials stay in
+// protected memory until release is called, after which the client must not be used
+func (as3 AS3Location) client() (client *cloud.AS3, release func(), err error) {
+	bucket, err := as3.getBucket()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer bucket.Destroy()
+
+	client = &cloud.AS3{
+		Bucket:       string(bucket.Buffer()),
+		Region:       as3.Region,
+		Endpoint:     as3.Endpoint,
+		PathStyle:    as3.PathStyle,
+		CACert:       []byte(as3.CACert),
+		StorageClass: as3.StorageClass,
+		Transitions:  as3.Transitions,
+		Lock:         as3.ObjectLock,
+		Harden:       as3.Harden,
+	}
+	release = func() {
+		if client.AccessKey != nil {
+			client.AccessKey.Destroy()
+		}
+		if client.SecretKey != nil {
+			client.SecretKey.Destroy()
+		}
+	}
+
+	if as3.AccessKey == "" && as3.SecretKey == "" {
+		return client, release, nil
+	}
+	if client.AccessKey, err = as3.getAccessKey(); err != nil {
+		return nil, nil, err
+	}
+	if client.SecretKey, err = as3.getSecretKey(); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return client, release, nil
+}
+
+// withTransfer wraps client so its transfers report progress and share the rate limits of
+// the location key names, which is this one
+// NOTE: changed rates apply to clients wrapped from then on; those already wrapped keep
+// sharing the limits they were made with
+func (as3 AS3Location) withTransfer(key locationKey, client cloud.Client, progress func(cloud.Progress)) cloud.Client {
+	as3LimitersMutex.Lock()
+	defer as3LimitersMutex.Unlock()
+
+	limiters, exists := as3Limiters[key]
+	if !exists || limiters.uploadRate != as3.UploadRate || limiters.downloadRate != as3.DownloadRate {
+		limiters = rateLimits{uploadRate: as3.UploadRate, downloadRate: as3.DownloadRate}
+		if as3.UploadRate > 0 {
+			limiters.upload = cloud.NewRateLimiter(as3.UploadRate)
+		}
+		if as3.DownloadRate > 0 {
+			limiters.download = cloud.NewRateLimiter(as3.DownloadRate)
+		}
+		as3Limiters[key] = limiters
+	}
+	return cloud.TransferClient(client, limiters.upload, limiters.download, progress)
 }
 
 // getBucket decrypts the loaded Bucket
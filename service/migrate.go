@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+)
+
+const migrationStateExt = ".migration"
+
+var (
+	errLocationLagging = errors.New("location must catch up on missed writes before it can be migrated")
+)
+
+// MigrateLocation copies everything in one of an archive's locations to a new one exactly
+// as stored, never decrypting it, then puts the new location in the old one's place
+// from is the old location's key in the config, and to describes the new location as
+// AddLocations expects. An interrupted migration resumes when run again; the old location
+// is left as it was, for removal once no longer wanted
+func MigrateLocation(ctx context.Context, archiveName, from string, to []byte) (*cloud.MigrationReport, error) {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return nil, errArchiveDoesNotExit
+	}
+	oldLocation, exists := archive.AmazonS3[from]
+	if !exists {
+		return nil, errInvalidLocation
+	}
+	newLocation, err := bytesToAS3Location(to)
+	if err != nil {
+		return nil, errInvalidLocation
+	}
+	if _, exists := archive.AmazonS3[newLocation.Bucket]; exists {
+		return nil, errLocationAlreadyInUse
+	}
+
+	path, err := replicationLogPath(archiveName)
+	if err != nil {
+		return nil, err
+	}
+	replication, err := cloud.OpenReplicationLog(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(replication.Pending(from)) > 0 {
+		return nil, errLocationLagging
+	}
+
+	// Neither client is given the archive key, so nothing can be decrypted
+	source, releaseSource, err := oldLocation.client()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSource()
+	destination, releaseDestination, err := newLocation.client()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseDestination()
+
+	if err := destination.CreateArchive(ctx); err != nil && !errors.Is(err, cloud.ErrArchiveExists) {
+		return nil, err
+	}
+
+	statePath, err := configFilePath(archiveName + migrationStateExt)
+	if err != nil {
+		return nil, err
+	}
+	migration := &cloud.Migration{
+		Source:      source,
+		Destination: destination,
+		StatePath:   statePath,
+	}
+	report, err := migration.Run(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	delete(archive.AmazonS3, from)
+	archive.AmazonS3[newLocation.Bucket] = newLocation
+	config.Archives[archiveName] = archive
+	if err := saveConfig(); err != nil {
+		return report, err
+	}
+	return report, removeIfExists(statePath)
+}
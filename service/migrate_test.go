@@ -0,0 +1,17 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/service"
+)
+
+func TestMigrateLocation(t *testing.T) {
+	createEmptyArchive(t, "moving")
+	defer service.RemoveConfiguration()
+
+	if _, err := service.MigrateLocation(context.Background(), "moving", "no-such-bucket", []byte(`{"bucket":"elsewhere"}`)); err == nil {
+		t.Error("expected migration from a location the archive lacks to be refused")
+	}
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/shibukawa/configdir"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+)
+
+const replicationLogExt = ".replication"
+
+// OpenArchive returns a client writing to every one of an archive's locations, reporting
+// transfer progress to progress (which may be nil); caller responsible for calling release
+// once done, after which the client must not be used
+// Entries are mirrored to every location, or erasure coded across them if the archive has
+// DataShards set. If the archive packs small Entries, the client is a cloud.Flusher that
+// must be flushed before release
+func OpenArchive(archiveName string, progress func(cloud.Progress)) (client cloud.Client, release func(), err error) {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return nil, nil, errArchiveDoesNotExit
+	}
+	if archive.DataShards > 0 {
+		client, release, err = archive.erasure(archiveName, progress)
+	} else {
+		client, release, err = archive.mirror(archiveName, progress)
+	}
+	if err != nil || (archive.Packing == nil && !archive.Manifest) {
+		return
+	}
+
+	key, err := archive.getMasterKey()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	releaseClient := release
+	release = func() {
+		releaseClient()
+		key.Destroy()
+	}
+	if archive.Packing != nil {
+		client = cloud.PackClient(client, key, *archive.Packing)
+	}
+	if archive.Manifest {
+		client = cloud.ManifestClient(client, key)
+	}
+	return client, release, nil
+}
+
+// BootstrapArchive returns every Entry of an archive keeping a manifest, read from a few
+// downloads of it rather than by heading each Entry
+func BootstrapArchive(ctx context.Context, archiveName string) ([]cloud.Entry, error) {
+	client, release, err := OpenArchive(archiveName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	manifest, ok := client.(*cloud.Manifest)
+	if !ok {
+		return nil, errNoManifest
+	}
+	return manifest.Entries(ctx)
+}
+
+// CatchUpArchive brings every location of an archive up to date with the writes it missed
+func CatchUpArchive(ctx context.Context, archiveName string) error {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return errArchiveDoesNotExit
+	}
+	if archive.DataShards > 0 {
+		erasure, release, err := archive.erasure(archiveName, nil)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		for name := range erasure.Locations {
+			if err := erasure.CatchUp(ctx, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	mirror, release, err := openMirror(archiveName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for name := range mirror.Locations {
+		if err := mirror.CatchUp(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditArchive compares what each of a mirrored archive's locations holds, repairing
+// problems found if options ask it to; the report marshals to JSON for keeping
+func AuditArchive(ctx context.Context, archiveName string, options cloud.AuditOptions) (*cloud.AuditReport, error) {
+	mirror, release, err := openMirror(archiveName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return mirror.Audit(ctx, options)
+}
+
+// openMirror returns a client writing to every one of a mirrored archive's locations; caller responsible for calling release
+func openMirror(archiveName string) (*cloud.Mirror, func(), error) {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return nil, nil, errArchiveDoesNotExit
+	}
+	if archive.DataShards > 0 {
+		return nil, nil, errErasureCoded
+	}
+	return archive.mirror(archiveName, nil)
+}
+
+// ReplicationStatus returns an Entry's replication status at each of an archive's locations, or
+// none once every location holds its latest write
+func ReplicationStatus(archiveName, entryID string) (map[string]cloud.Replica, error) {
+	if _, exists := config.Archives[archiveName]; !exists {
+		return nil, errArchiveDoesNotExit
+	}
+
+	path, err := replicationLogPath(archiveName)
+	if err != nil {
+		return nil, err
+	}
+	replication, err := cloud.OpenReplicationLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return replication.Status(entryID), nil
+}
+
+// mirror returns a client writing to every one of the archive's locations, each retrying
+// as configured and sharing its location's rate limits; caller responsible for calling release
+func (a Archive) mirror(archiveName string, progress func(cloud.Progress)) (*cloud.Mirror, func(), error) {
+	path, err := replicationLogPath(archiveName)
+	if err != nil {
+		return nil, nil, err
+	}
+	replication, err := cloud.OpenReplicationLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	locations, release, err := a.locations(archiveName, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &cloud.Mirror{
+		Locations: locations,
+		Log:       replication,
+	}, release, nil
+}
+
+// erasure returns a client spreading each Entry over the archive's locations; caller responsible for calling release
+func (a Archive) erasure(archiveName string, progress func(cloud.Progress)) (*cloud.Erasure, func(), error) {
+	path, err := replicationLogPath(archiveName)
+	if err != nil {
+		return nil, nil, err
+	}
+	replication, err := cloud.OpenReplicationLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	locations, release, err := a.locations(archiveName, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &cloud.Erasure{
+		Locations:  locations,
+		DataShards: a.DataShards,
+		Log:        replication,
+	}, release, nil
+}
+
+// locations returns a client for each of the archive's locations, keyed as in the config,
+// retrying as configured and sharing its location's rate limits; caller responsible for calling release
+func (a Archive) locations(archiveName string, progress func(cloud.Progress)) (map[string]cloud.Client, func(), error) {
+	key, err := a.getMasterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	releases := []func(){key.Destroy}
+	release := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+
+	locations := make(map[string]cloud.Client)
+	for name, location := range a.AmazonS3 {
+		client, releaseClient, err := location.client()
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		releases = append(releases, releaseClient)
+
+		client.Key = key
+		locations[name] = location.withTransfer(locationKey{archiveName, name}, a.withRetry(client), progress)
+	}
+	return locations, release, nil
+}
+
+// replicationLogPath returns where an archive's replication status is kept, beside the config file
+func replicationLogPath(archiveName string) (string, error) {
+	return configFilePath(archiveName + replicationLogExt)
+}
+
+// deleteReplicationLog removes an archive's replication status, if it has any
+func deleteReplicationLog(archiveName string) error {
+	path, err := replicationLogPath(archiveName)
+	if err != nil {
+		return err
+	}
+	return removeIfExists(path)
+}
+
+// configFilePath returns the path of a file kept in the same folder as the config file
+func configFilePath(filename string) (string, error) {
+	folder := configdir.New(vendorName, appName).QueryFolders(configdir.Global)[0]
+	if err := folder.MkdirAll(); err != nil {
+		return "", err
+	}
+	return filepath.Join(folder.Path, filename), nil
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
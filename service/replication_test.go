@@ -0,0 +1,116 @@
+package service_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/cloud"
+	"github.com/jonathan-robertson/lockedarchive/service"
+)
+
+func TestCatchUpArchive(t *testing.T) {
+	createEmptyArchive(t, "lagging")
+	defer service.RemoveConfiguration()
+
+	if err := service.CatchUpArchive(context.Background(), "lagging"); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.CatchUpArchive(context.Background(), "no-such-archive"); err == nil {
+		t.Error("expected catching up an archive that does not exist to fail")
+	}
+}
+
+func TestAuditArchive(t *testing.T) {
+	createEmptyArchive(t, "audited")
+	defer service.RemoveConfiguration()
+
+	if report, err := service.AuditArchive(context.Background(), "audited", cloud.AuditOptions{}); err != nil || !report.Healthy() {
+		t.Errorf("expected a healthy audit, received %+v, %v", report, err)
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	createEmptyArchive(t, "replicated")
+	defer service.RemoveConfiguration()
+
+	if status, err := service.ReplicationStatus("replicated", "entry"); err != nil || len(status) != 0 {
+		t.Errorf("expected no replication status, received %v, %v", status, err)
+	}
+}
+
+func TestBootstrapArchive(t *testing.T) {
+	createEmptyArchive(t, "unlisted")
+	defer service.RemoveConfiguration()
+
+	if _, err := service.BootstrapArchive(context.Background(), "unlisted"); err == nil {
+		t.Error("expected an archive not keeping a manifest to have none to bootstrap from")
+	}
+}
+
+func TestBootstrapPackedArchive(t *testing.T) {
+	createEmptyArchive(t, "packed")
+	defer service.RemoveConfiguration()
+	defer addStubLocation(t, "packed")()
+	if err := service.SetPacking("packed", &cloud.PackPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SetManifest("packed", true); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() (cloud.Client, func()) {
+		client, release, err := service.OpenArchive("packed", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, release
+	}
+	upload := func(client cloud.Client, id string) {
+		file, err := ioutil.TempFile("", "lockedarchive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if _, err := file.WriteString("body of " + id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Upload(context.Background(), cloud.Entry{ID: id, Name: id}, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush := func(client cloud.Client) {
+		if err := client.(cloud.Flusher).Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two devices each write an Entry, the second having read the archive before the first flushed
+	second, releaseSecond := open()
+	defer releaseSecond()
+	upload(second, "second")
+	first, releaseFirst := open()
+	defer releaseFirst()
+	upload(first, "first")
+	flush(first)
+	flush(second)
+
+	entries, err := service.BootstrapArchive(context.Background(), "packed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "first" || ids[1] != "second" {
+		t.Errorf("expected the manifest to list both devices' Entries, received %v", ids)
+	}
+}
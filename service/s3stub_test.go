@@ -0,0 +1,132 @@
+package service_test
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+	"github.com/jonathan-robertson/lockedarchive/service"
+)
+
+// addStubLocation adds to archiveName a location held by an in-process stand-in for S3;
+// caller responsible for calling close once done
+func addStubLocation(t *testing.T, archiveName string) (close func()) {
+	// The stand-in does not check signatures, but the SDK still needs something to sign with
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		if os.Getenv(env) == "" {
+			os.Setenv(env, "lockedarchive-test")
+		}
+	}
+
+	pc, err := secure.ProtectPassphrase(makeGoodPassphrase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Destroy()
+	bucket, err := secure.EncryptWithSaltToString(pc, []byte(archiveName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewTLSServer(&s3Stub{objects: make(map[string]s3StubObject)})
+	location, err := json.Marshal(service.AS3Location{
+		Bucket:    bucket,
+		Endpoint:  server.URL,
+		PathStyle: true,
+		CACert:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.AddLocations(archiveName, location); err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server.Close
+}
+
+// s3Stub is a minimal, in-memory stand-in for the object requests of the S3 API, keyed by
+// path; see the cloud package's tests for a fuller one
+type s3Stub struct {
+	sync.Mutex
+	objects map[string]s3StubObject
+}
+
+type s3StubObject struct {
+	data []byte
+	meta http.Header
+}
+
+func (stub *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.Lock()
+	defer stub.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		meta := make(http.Header)
+		for name, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				meta[name] = values
+			}
+		}
+		stub.objects[r.URL.Path] = s3StubObject{data: data, meta: meta}
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, len(data)))
+
+	case http.MethodGet, http.MethodHead:
+		object, exists := stub.objects[r.URL.Path]
+		if !exists {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range object.meta {
+			w.Header()[name] = values
+		}
+
+		data := object.data
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && start < len(data) {
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(end+1-start))
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[start : end+1]
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case http.MethodDelete:
+		delete(stub.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+	}
+}
@@ -2,14 +2,22 @@
 package service
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/shibukawa/configdir"
 
+	"github.com/jonathan-robertson/lockedarchive/cache"
+	"github.com/jonathan-robertson/lockedarchive/cloud"
 	"github.com/jonathan-robertson/lockedarchive/secure"
 )
 
@@ -28,12 +36,31 @@ var (
 	errInvalidLocation      = errors.New("invalid online storage location")
 	errLocationAlreadyInUse = errors.New("online storage location already in use")
 	errPassphraseNotSet     = errors.New("passphrase not set")
+	errInvalidDataShards    = errors.New("data shards must be between 1 and the archive's number of locations, or 0 to mirror")
+	errErasureCoded         = errors.New("archive is erasure coded rather than mirrored")
+	errNotDeduplicated      = errors.New("archive does not deduplicate its entries")
+	errNoManifest           = errors.New("archive does not keep a manifest")
 )
 
+// ErrNotShareable is returned by ShareEntry for archives that do not keep each Entry's
+// data whole in an object of its own: erasure coded, packed or deduplicated ones
+var ErrNotShareable = errors.New("archive does not store entries as objects of their own to share")
+
 // Archive represents sets of locations meant to store the same dataset
+// Every write goes to all of them, either in full or erasure coded; see OpenArchive
 type Archive struct {
-	MasterKey string                 `json:"masterKey"`
-	AmazonS3  map[string]AS3Location `json:"amazon_s3,omitempty"`
+	MasterKey  string                 `json:"masterKey"`
+	AmazonS3   map[string]AS3Location `json:"amazon_s3,omitempty"`
+	Retry      cloud.RetryPolicy      `json:"retry"`                // how this archive's locations retry transient failures
+	DataShards int                    `json:"dataShards,omitempty"` // if set, locations needed to rebuild each erasure coded Entry
+	Packing    *cloud.PackPolicy      `json:"packing,omitempty"`    // if set, how small Entries are packed together
+	Dedup      bool                   `json:"dedup,omitempty"`      // whether Entries are stored as deduplicated chunks; see OpenChunkStore
+	Manifest   bool                   `json:"manifest,omitempty"`   // whether a manifest of Entries is kept; see BootstrapArchive
+}
+
+// withRetry wraps client so it retries transient failures as configured for the archive
+func (a Archive) withRetry(client cloud.Client) cloud.Client {
+	return cloud.RetryClient(client, a.Retry)
 }
 
 // getMasterKey decrypts the archive's master key for use in encrypted operations
@@ -102,6 +129,258 @@ func AddLocations(archiveName string, data ...[]byte) error {
 	return saveConfig()
 }
 
+// SetRetryPolicy changes how an existing archive's locations retry transient failures
+func SetRetryPolicy(archiveName string, policy cloud.RetryPolicy) error {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return errArchiveDoesNotExit
+	}
+
+	archive.Retry = policy
+	config.Archives[archiveName] = archive
+	return saveConfig()
+}
+
+// SetErasureCoding has an archive split each Entry over its locations so that any
+// dataShards of them can rebuild it, rather than mirroring each Entry to all of them;
+// 0 goes back to mirroring
+// NOTE: meant for archives yet to store anything, as Entries already stored are not converted
+func SetErasureCoding(archiveName string, dataShards int) error {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return errArchiveDoesNotExit
+	}
+	if dataShards < 0 || dataShards > len(archive.AmazonS3) {
+		return errInvalidDataShards
+	}
+
+	archive.DataShards = dataShards
+	config.Archives[archiveName] = archive
+	return saveConfig()
+}
+
+// SetPacking has an archive pack small Entries together following policy, or stop packing
+// if policy is nil
+// NOTE: packed Entries are only found through the index packing keeps, so packing should
+// not be stopped once anything has been packed
+func SetPacking(archiveName string, policy *cloud.PackPolicy) error {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return errArchiveDoesNotExit
+	}
+
+	archive.Packing = policy
+	config.Archives[archiveName] = archive
+	return saveConfig()
+}
+
+// SetDeduplication decides whether an archive's Entries are written as chunks shared
+// between them (see cache.WriteChunked) rather than each as a whole
+func SetDeduplication(archiveName string, dedup bool) error {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return errArchiveDoesNotExit
+	}
+
+	archive.Dedup = dedup
+	config.Archives[archiveName] = archive
+	return saveConfig()
+}
+
+// SetManifest decides whether an archive keeps a manifest of its Entries' metadata for
+// new devices to bootstrap from; writes reach it once the archive's client is flushed
+func SetManifest(archiveName string, manifest bool) error {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return errArchiveDoesNotExit
+	}
+
+	archive.Manifest = manifest
+	config.Archives[archiveName] = archive
+	return saveConfig()
+}
+
+// OpenChunkStore returns the store holding a deduplicating archive's chunks, along with
+// the archive key chunks are named and encrypted with; caller responsible for calling
+// release once done, after which neither must be used
+func OpenChunkStore(archiveName string) (store *cloud.ChunkStore, key *secure.KeyContainer, release func(), err error) {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return nil, nil, nil, errArchiveDoesNotExit
+	}
+	if !archive.Dedup {
+		return nil, nil, nil, errNotDeduplicated
+	}
+
+	client, releaseClient, err := OpenArchive(archiveName, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err = archive.getMasterKey()
+	if err != nil {
+		releaseClient()
+		return nil, nil, nil, err
+	}
+	release = func() {
+		releaseClient()
+		key.Destroy()
+	}
+	return &cloud.ChunkStore{Client: client, Key: key}, key, release, nil
+}
+
+// RemovalReport describes everything removing an archive would permanently delete
+type RemovalReport struct {
+	Archive   string                          `json:"archive"`
+	Locations map[string]*cloud.RemovalReport `json:"locations"` // keyed as in the archive's configuration
+	Token     string                          `json:"token"`     // pass to RemoveArchive to confirm removal
+}
+
+// PlanArchiveRemoval reports what RemoveArchive would permanently delete from each of
+// an archive's locations, along with the token needed to go through with it
+func PlanArchiveRemoval(ctx context.Context, archiveName string) (*RemovalReport, error) {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return nil, errArchiveDoesNotExit
+	}
+
+	report := &RemovalReport{
+		Archive:   archiveName,
+		Locations: make(map[string]*cloud.RemovalReport),
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", archiveName)
+
+	keys := make([]string, 0, len(archive.AmazonS3))
+	for key := range archive.AmazonS3 {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		client, release, err := archive.AmazonS3[key].client()
+		if err != nil {
+			return nil, err
+		}
+		location, err := client.PlanRemoval(ctx)
+		release()
+		if err != nil {
+			return nil, err
+		}
+		report.Locations[key] = location
+		fmt.Fprintf(hash, "%q %s\n", key, location.Token)
+	}
+
+	report.Token = hex.EncodeToString(hash.Sum(nil)[:16])
+	return report, nil
+}
+
+// RemoveArchive permanently deletes everything in each of an archive's locations, then
+// the locations themselves, and removes the archive from the config
+// token must come from a PlanArchiveRemoval report made since the archive last changed,
+// or cloud.ErrConfirmation is returned and nothing is deleted
+func RemoveArchive(ctx context.Context, archiveName, token string) error {
+	report, err := PlanArchiveRemoval(ctx, archiveName)
+	if err != nil {
+		return err
+	}
+	if token == "" || token != report.Token {
+		return cloud.ErrConfirmation
+	}
+
+	archive := config.Archives[archiveName]
+	for key, location := range archive.AmazonS3 {
+		client, release, err := location.client()
+		if err != nil {
+			return err
+		}
+		err = client.PurgeArchive(ctx, report.Locations[key].Token)
+		release()
+		if err != nil {
+			return err
+		}
+
+		// Forget each location as it goes, so a failure part way leaves only what remains
+		delete(archive.AmazonS3, key)
+		if err := saveConfig(); err != nil {
+			return err
+		}
+	}
+
+	delete(config.Archives, archiveName)
+	if err := saveConfig(); err != nil {
+		return err
+	}
+	return deleteReplicationLog(archiveName)
+}
+
+// SetLegalHold places a legal hold on an Entry's data in every location of an archive, or
+// lifts it; held data cannot be deleted until the hold is lifted
+// NOTE: locations must have been created with object lock, and their keys need more than
+// LocationPolicy grants
+func SetLegalHold(ctx context.Context, archiveName, entryID string, hold bool) error {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return errArchiveDoesNotExit
+	}
+
+	for name, location := range archive.AmazonS3 {
+		client, release, err := location.client()
+		if err != nil {
+			return err
+		}
+		err = client.SetLegalHold(ctx, cloud.Entry{ID: entryID}, hold)
+		release()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// LocationPolicy returns a least-privilege IAM policy, as JSON, for the access keys stored
+// for one of an archive's locations; see cloud.AS3.IAMPolicy for what it leaves out
+func LocationPolicy(archiveName, locationName string) ([]byte, error) {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return nil, errArchiveDoesNotExit
+	}
+	location, exists := archive.AmazonS3[locationName]
+	if !exists {
+		return nil, errInvalidLocation
+	}
+
+	client, release, err := location.client()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return client.IAMPolicy()
+}
+
+// ShareEntry shares an Entry written by cache.Write with someone outside the archive for
+// expires, through a link to its data in one of the archive's locations; see cache.Share
+// Archives that erasure code, pack or deduplicate Entries have no such object to link to,
+// and are refused with ErrNotShareable
+func ShareEntry(archiveName, locationName string, entry cloud.Entry, expires time.Duration) (*cache.Share, error) {
+	archive, exists := config.Archives[archiveName]
+	if !exists {
+		return nil, errArchiveDoesNotExit
+	}
+	if archive.DataShards > 0 || archive.Packing != nil || archive.Dedup {
+		return nil, ErrNotShareable
+	}
+	location, exists := archive.AmazonS3[locationName]
+	if !exists {
+		return nil, errInvalidLocation
+	}
+
+	client, release, err := location.client()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return cache.NewShare(passphrase, client, entry, expires)
+}
+
 // RemoveConfiguration removes the config file from the file system
 func RemoveConfiguration() error {
 	return deleteConfig()
@@ -1,9 +1,13 @@
 package service_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/jonathan-robertson/lockedarchive/cloud"
 	"github.com/jonathan-robertson/lockedarchive/service"
 )
 
@@ -68,6 +72,124 @@ func TestConfig(t *testing.T) {
 	t.Log("test Config file successfully deleted")
 }
 
+func TestSetRetryPolicy(t *testing.T) {
+	createEmptyArchive(t, "retrying")
+	defer service.RemoveConfiguration()
+
+	policy := cloud.RetryPolicy{MaxAttempts: 8, Budget: 10 * time.Minute}
+	if err := service.SetRetryPolicy("retrying", policy); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("retry policy set and config saved")
+
+	if err := service.SetRetryPolicy("no-such-archive", policy); err == nil {
+		t.Error("expected a retry policy for an archive that does not exist to be refused")
+	}
+}
+
+func TestSetErasureCoding(t *testing.T) {
+	createEmptyArchive(t, "coded")
+	defer service.RemoveConfiguration()
+
+	if err := service.SetErasureCoding("coded", 1); err == nil {
+		t.Error("expected erasure coding across more locations than the archive has to be refused")
+	}
+	if err := service.SetErasureCoding("coded", 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenChunkStore(t *testing.T) {
+	createEmptyArchive(t, "whole")
+	defer service.RemoveConfiguration()
+
+	if _, _, _, err := service.OpenChunkStore("whole"); err == nil {
+		t.Error("expected an archive not set to deduplicate to have no chunk store")
+	}
+}
+
+func TestLocationPolicy(t *testing.T) {
+	createEmptyArchive(t, "policed")
+	defer service.RemoveConfiguration()
+
+	if _, err := service.LocationPolicy("policed", "no-such-bucket"); err == nil {
+		t.Error("expected no policy for a location the archive lacks")
+	}
+}
+
+func TestRemoveArchive(t *testing.T) {
+	expectActivationSuccess(t, makeGoodPassphrase())
+	defer service.RemoveConfiguration()
+
+	kc, err := service.CreateArchive("removable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc.Destroy()
+
+	report, err := service.PlanArchiveRemoval(context.Background(), "removable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Token == "" || len(report.Locations) != 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	if err := service.RemoveArchive(context.Background(), "removable", "not the token"); !errors.Is(err, cloud.ErrConfirmation) {
+		t.Errorf("expected %v, received %v", cloud.ErrConfirmation, err)
+	}
+	if err := service.RemoveArchive(context.Background(), "removable", report.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.PlanArchiveRemoval(context.Background(), "removable"); err == nil {
+		t.Error("expected archive to be gone from the config")
+	}
+	t.Log("archive removed and config saved")
+}
+
+func TestShareEntry(t *testing.T) {
+	createEmptyArchive(t, "shared")
+	defer service.RemoveConfiguration()
+	defer addStubLocation(t, "shared")()
+
+	expectRefused := func(form string) {
+		if _, err := service.ShareEntry("shared", "", cloud.Entry{ID: "entry"}, time.Hour); !errors.Is(err, service.ErrNotShareable) {
+			t.Errorf("expected sharing from a %s archive to be refused, received %v", form, err)
+		}
+	}
+
+	if err := service.SetErasureCoding("shared", 1); err != nil {
+		t.Fatal(err)
+	}
+	expectRefused("erasure coded")
+	if err := service.SetErasureCoding("shared", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.SetPacking("shared", &cloud.PackPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	expectRefused("packed")
+	if err := service.SetPacking("shared", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.SetDeduplication("shared", true); err != nil {
+		t.Fatal(err)
+	}
+	expectRefused("deduplicated")
+}
+
+// createEmptyArchive activates the service and adds an archive without any locations
+func createEmptyArchive(t *testing.T, archiveName string) {
+	expectActivationSuccess(t, makeGoodPassphrase())
+	kc, err := service.CreateArchive(archiveName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc.Destroy()
+}
+
 func makeGoodPassphrase() []byte {
 	return []byte("correct")
 }
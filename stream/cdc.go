@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+)
+
+const (
+
+	// MinChunkSize is the smallest chunk a Chunker cuts, other than the last
+	MinChunkSize = 256 * 1024
+
+	// AvgChunkSize is the size a Chunker's chunks average out to
+	AvgChunkSize = 1024 * 1024
+
+	// MaxChunkSize is the largest chunk a Chunker cuts
+	MaxChunkSize = 4 * 1024 * 1024
+)
+
+// GearTable maps each byte to a random 64-bit value for a Chunker's rolling hash; data
+// only deduplicates against data chunked with the same table
+type GearTable [256]uint64
+
+// defaultGear is used by Chunkers given no table; it must never change, or data chunked
+// before would no longer deduplicate against data chunked after
+var defaultGear GearTable
+
+func init() {
+	seed := uint64(0x6c6f636b65646172) // splitmix64
+	for i := range defaultGear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		defaultGear[i] = z ^ (z >> 31)
+	}
+}
+
+// KeyedGearTable returns a GearTable derived from kc, so where chunks are cut, and so their
+// sizes, reveal nothing about the data to those lacking the key
+// The same key always gives the same table, so data keeps deduplicating across files
+func KeyedGearTable(kc *secure.KeyContainer) *GearTable {
+	key := secure.DeriveKey(kc, "chunk boundaries")
+
+	var (
+		table GearTable
+		block []byte
+	)
+	for i := range table {
+		if len(block) == 0 {
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte{byte(i)})
+			block = mac.Sum(nil)
+		}
+		table[i] = binary.BigEndian.Uint64(block)
+		block = block[8:]
+	}
+	return &table
+}
+
+// Chunker splits a stream into content-defined chunks: a boundary falls wherever a rolling
+// hash of the bytes just read matches a pattern, so data shifted by an insertion or
+// deletion still splits into mostly the same chunks
+type Chunker struct {
+	MinSize int // defaults to MinChunkSize
+	AvgSize int // rounded down to a power of two; defaults to AvgChunkSize
+	MaxSize int // defaults to MaxChunkSize
+
+	// Gear is the rolling hash's table; defaults to a fixed one, whose boundaries anyone
+	// could work out from the data. Use KeyedGearTable for data that is to be kept secret
+	Gear *GearTable
+
+	r *bufio.Reader
+}
+
+// NewChunker returns a Chunker reading from r with the default chunk sizes
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		MinSize: MinChunkSize,
+		AvgSize: AvgChunkSize,
+		MaxSize: MaxChunkSize,
+		r:       bufio.NewReader(r),
+	}
+}
+
+// Next returns the next chunk, or io.EOF once the stream is used up
+func (chunker *Chunker) Next(ctx context.Context) ([]byte, error) {
+	min, avg, max := chunker.sizes()
+	gear := chunker.Gear
+	if gear == nil {
+		gear = &defaultGear
+	}
+	mask := ^uint64(0) << uint(64-bits.Len(uint(avg))+1) // the hash's top bits, which depend on the most bytes
+
+	var (
+		chunk = make([]byte, 0, avg)
+		hash  uint64
+	)
+	for len(chunk) < max {
+		if len(chunk)%(64*1024) == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		b, err := chunker.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk = append(chunk, b)
+
+		hash = hash<<1 + gear[b]
+		if len(chunk) >= min && hash&mask == 0 {
+			break
+		}
+	}
+
+	if len(chunk) == 0 {
+		return nil, io.EOF
+	}
+	return chunk, nil
+}
+
+func (chunker *Chunker) sizes() (min, avg, max int) {
+	min, avg, max = chunker.MinSize, chunker.AvgSize, chunker.MaxSize
+	if min < 1 {
+		min = MinChunkSize
+	}
+	if avg < 2 {
+		avg = AvgChunkSize
+	}
+	if max < min {
+		max = MaxChunkSize
+	}
+	return
+}
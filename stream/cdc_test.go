@@ -0,0 +1,90 @@
+package stream_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/secure"
+	"github.com/jonathan-robertson/lockedarchive/stream"
+)
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	original := chunkAll(t, data, nil)
+	verifyBytesEqual(t, data, bytes.Join(original, nil))
+	for i, chunk := range original {
+		if len(chunk) > 64*1024 || (len(chunk) < 4*1024 && i != len(original)-1) {
+			t.Errorf("chunk %d is %d bytes, outside the sizes asked for", i, len(chunk))
+		}
+	}
+
+	// Inserting bytes near the start only changes the chunks around the insertion
+	edited := append(append(append([]byte(nil), data[:100000]...), []byte("inserted")...), data[100000:]...)
+	seen := make(map[[sha256.Size]byte]bool)
+	for _, chunk := range original {
+		seen[sha256.Sum256(chunk)] = true
+	}
+	var shared int
+	for _, chunk := range chunkAll(t, edited, nil) {
+		if seen[sha256.Sum256(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(original)-3 {
+		t.Errorf("expected all but the chunks around the insertion to be shared, %d of %d were", shared, len(original))
+	}
+}
+
+func TestKeyedChunker(t *testing.T) {
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var gears []*stream.GearTable
+	for i := 0; i < 2; i++ {
+		kc, err := secure.GenerateKeyContainer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kc.Destroy()
+		gears = append(gears, stream.KeyedGearTable(kc))
+	}
+
+	sizes := func(gear *stream.GearTable) (sizes []int) {
+		for _, chunk := range chunkAll(t, data, gear) {
+			sizes = append(sizes, len(chunk))
+		}
+		return
+	}
+	keyed := sizes(gears[0])
+	if again := sizes(gears[0]); !reflect.DeepEqual(again, keyed) {
+		t.Error("expected the same key to cut the same chunks")
+	}
+	if reflect.DeepEqual(sizes(gears[1]), keyed) || reflect.DeepEqual(sizes(nil), keyed) {
+		t.Error("expected chunks cut under another key, or none, to differ")
+	}
+}
+
+func chunkAll(t *testing.T, data []byte, gear *stream.GearTable) [][]byte {
+	chunker := stream.NewChunker(bytes.NewReader(data))
+	chunker.Gear = gear
+	chunker.MinSize, chunker.AvgSize, chunker.MaxSize = 4*1024, 16*1024, 64*1024
+
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next(context.Background())
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
@@ -10,20 +10,24 @@ func GetChunk(ctx context.Context, r io.Reader, chunk []byte) (length int, err e
 	singleByte := make([]byte, 1)
 
 	// Loop through bytes until chunk fills or EOF is reached
-	for i := 0; i < len(chunk); i++ {
+	for length < len(chunk) {
 		select {
 		case <-ctx.Done():
 			return 0, context.Canceled
 
 		default:
-			if _, err = r.Read(singleByte); err != nil {
+			// Readers may return the last byte along with io.EOF, or nothing and no error
+			var n int
+			n, err = r.Read(singleByte)
+			if n > 0 {
+				// Write received byte to chunk
+				// TODO: Is it more effective for us to append bytes and return chunk?
+				chunk[length] = singleByte[0]
+				length++
+			}
+			if err != nil {
 				return // return even if io.EOF
 			}
-
-			// Write received byte to chunk
-			// TODO: Is it more effective for us to append bytes and return chunk?
-			chunk[i] = singleByte[0]
-			length++
 		}
 	}
 
@@ -5,6 +5,7 @@ import (
 	"context"
 	"io"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/jonathan-robertson/lockedarchive/stream"
@@ -26,12 +27,14 @@ func TestSlowChunk(t *testing.T) {
 		for ; ; time.Sleep(200 * time.Millisecond) { // 200ms to simulate high latency connection
 			n, err := r.Read(smallBlock)
 			if err != nil && err != io.EOF {
-				t.Fatal(err)
+				pw.CloseWithError(err) // surfaces in runChunkTest
+				return
 			}
 
 			if n > 0 {
 				if _, writeErr := pw.Write(smallBlock[:n]); writeErr != nil {
-					t.Fatal(writeErr)
+					pw.CloseWithError(writeErr) // surfaces in runChunkTest
+					return
 				}
 			}
 
@@ -39,15 +42,20 @@ func TestSlowChunk(t *testing.T) {
 				break
 			}
 		}
-		if err := pw.Close(); err != nil {
-			t.Fatal(err)
-		}
+		pw.Close()
 	}()
 
 	dst := runChunkTest(t, pr)
 	verifyBytesEqual(t, src, dst)
 }
 
+func TestChunkDataWithEOF(t *testing.T) {
+	src := []byte("This is a test set of data and it is very nice")
+	r := iotest.DataErrReader(bytes.NewReader(src)) // last byte arrives along with io.EOF, as from net/http
+	dst := runChunkTest(t, r)
+	verifyBytesEqual(t, src, dst)
+}
+
 func runChunkTest(t *testing.T, r io.Reader) []byte {
 	var dst []byte
 
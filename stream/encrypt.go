@@ -2,6 +2,7 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -18,6 +19,10 @@ const (
 
 	// DecryptionChunkSize represents the number of bytes we need order to decrypt each chunk
 	DecryptionChunkSize = EncryptionChunkSize + secure.NonceSize + secretbox.Overhead
+
+	// Bits of the first byte of a chunk's nonce marking the first and last chunks
+	firstChunkFlag = 0x40
+	finalChunkFlag = 0x80
 )
 
 var (
@@ -25,24 +30,39 @@ var (
 	// ErrEncryptSize is an error that occurred during encryption
 	ErrEncryptSize = fmt.Errorf("encrypt: file is too large to safely encrypt with a %d-byte chunk size", EncryptionChunkSize)
 
+	// ErrChunkSequence is an error that occurred during decryption when chunks were reordered, dropped or cut off
+	ErrChunkSequence = errors.New("decrypt: encrypted chunks are out of order, missing or followed by more")
+
 	maxChunkCount = math.Exp2(secure.NonceSize)
 )
 
 // Encrypt encrypts a stream of data in chunks.
+// Each chunk's nonce follows the one before it, with the first and last chunks marked as
+// such, so Decrypt notices chunks reordered, dropped or cut off; empty data still gets one
+// (empty) chunk to carry both marks
 // IF SIZE IS KNOWN, caller should first use TooLargeToChunk
 func Encrypt(ctx context.Context, kc *secure.KeyContainer, r io.Reader, w io.Writer) (int64, error) {
 	nonce, err := secure.GenerateNonce()
 	if err != nil {
 		return 0, err
 	}
+	nonce[0] &^= firstChunkFlag | finalChunkFlag // never changed by incrementing
 
 	// Record nonce starting point to protect against looping of nonce
 	initialNonce := new([secure.NonceSize]byte)
 	copy(initialNonce[:], nonce[:])
 
-	var written int64
-	chunk := make([]byte, EncryptionChunkSize)
-	for {
+	var (
+		written int64
+		chunk   = make([]byte, EncryptionChunkSize)
+		next    = make([]byte, EncryptionChunkSize)
+	)
+	length, err := GetChunk(ctx, r, chunk)
+	for first := true; ; first = false {
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
 		select {
 		case <-ctx.Done():
 			return 0, ctx.Err()
@@ -51,37 +71,50 @@ func Encrypt(ctx context.Context, kc *secure.KeyContainer, r io.Reader, w io.Wri
 			secure.IncrementNonce(nonce)
 
 			// Protect against the nonce repeating
-			if initialNonce == nonce {
+			if *initialNonce == *nonce {
 				return 0, ErrEncryptSize
 			}
 
-			length, err := GetChunk(ctx, r, chunk)
-			if err != nil && err != io.EOF {
-				return 0, err
+			// Read ahead to learn whether this chunk is the last
+			var nextLength int
+			if err == nil {
+				if nextLength, err = GetChunk(ctx, r, next); err != nil && err != io.EOF {
+					return 0, err
+				}
 			}
+			final := err == io.EOF && nextLength == 0
 
-			if length > 0 {
-				encryptedChunk := secure.EncryptAndWipe(kc, nonce, chunk[:length])
+			chunkNonce := *nonce
+			if first {
+				chunkNonce[0] |= firstChunkFlag
+			}
+			if final {
+				chunkNonce[0] |= finalChunkFlag
+			}
+			encryptedChunk := secure.EncryptAndWipe(kc, &chunkNonce, chunk[:length])
 
-				bytesWritten, writeErr := w.Write(encryptedChunk)
-				if writeErr != nil {
-					return 0, writeErr
-				}
-				written += int64(bytesWritten)
+			bytesWritten, writeErr := w.Write(encryptedChunk)
+			if writeErr != nil {
+				return 0, writeErr
 			}
+			written += int64(bytesWritten)
 
-			if err == io.EOF {
+			if final {
 				return written, nil
 			}
+			chunk, next, length = next, chunk, nextLength
 		}
 	}
 }
 
 // Decrypt decrypts a stream of data in chunks
+// Chunks out of order, missing or following the last are refused with ErrChunkSequence
 func Decrypt(ctx context.Context, kc *secure.KeyContainer, r io.Reader, w io.Writer) (int64, error) {
 	var (
-		chunk   = make([]byte, DecryptionChunkSize)
-		written int64
+		chunk    = make([]byte, DecryptionChunkSize)
+		written  int64
+		expected secure.Nonce // nonce of the next chunk, once the first is read
+		final    bool
 	)
 
 	for {
@@ -96,6 +129,24 @@ func Decrypt(ctx context.Context, kc *secure.KeyContainer, r io.Reader, w io.Wri
 			}
 
 			if length > 0 {
+				if final {
+					return 0, ErrChunkSequence
+				}
+				if length < secure.NonceSize {
+					return 0, secure.ErrDecrypt
+				}
+				nonce := new([secure.NonceSize]byte)
+				copy(nonce[:], chunk[:secure.NonceSize])
+				first := nonce[0]&firstChunkFlag != 0
+				final = nonce[0]&finalChunkFlag != 0
+				nonce[0] &^= firstChunkFlag | finalChunkFlag
+				if first != (expected == nil) || (expected != nil && *nonce != *expected) {
+					return 0, ErrChunkSequence
+				}
+				expected = nonce
+				secure.IncrementNonce(expected)
+
+				// The marks are part of the nonce each chunk is authenticated with
 				decryptedChunk, encErr := secure.Decrypt(kc, chunk[:length])
 				if encErr != nil {
 					return 0, encErr
@@ -109,6 +160,9 @@ func Decrypt(ctx context.Context, kc *secure.KeyContainer, r io.Reader, w io.Wri
 			}
 
 			if err == io.EOF {
+				if !final {
+					return 0, ErrChunkSequence // cut off before the last chunk
+				}
 				return written, nil // EOF marks success
 			}
 		}
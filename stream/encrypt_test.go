@@ -1,6 +1,7 @@
 package stream_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"testing"
@@ -21,12 +22,12 @@ func TestEncryption(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	t.Run("Encrypt", func(t *testing.T) { runEncryption(t, kc.Key()) })
-	t.Run("Decrypt", func(t *testing.T) { runDecryption(t, kc.Key()) })
+	t.Run("Encrypt", func(t *testing.T) { runEncryption(t, kc) })
+	t.Run("Decrypt", func(t *testing.T) { runDecryption(t, kc) })
 	compareAndCleanup(t, encSrcFilename, encWrkFilename, encDstFilename)
 }
 
-func runEncryption(t *testing.T, key secure.Key) {
+func runEncryption(t *testing.T, kc *secure.KeyContainer) {
 	src, dst := setup(t, encSrcFilename, encWrkFilename)
 	defer src.Close()
 	defer dst.Close()
@@ -40,7 +41,7 @@ func runEncryption(t *testing.T, key secure.Key) {
 		t.Fatal(stream.ErrEncryptSize)
 	}
 
-	written, err := stream.Encrypt(context.Background(), key, src, dst)
+	written, err := stream.Encrypt(context.Background(), kc, src, dst)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,12 +64,12 @@ func runEncryption(t *testing.T, key secure.Key) {
 	t.Logf("successfully wrote %d bytes of encrypted data from %s to %s", written, encSrcFilename, encWrkFilename)
 }
 
-func runDecryption(t *testing.T, key secure.Key) {
+func runDecryption(t *testing.T, kc *secure.KeyContainer) {
 	src, dst := setup(t, encWrkFilename, encDstFilename)
 	defer src.Close()
 	defer dst.Close()
 
-	written, err := stream.Decrypt(context.Background(), key, src, dst)
+	written, err := stream.Decrypt(context.Background(), kc, src, dst)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -79,3 +80,58 @@ func runDecryption(t *testing.T, key secure.Key) {
 
 	t.Logf("successfully wrote %d bytes of decrypted data from %s to %s", written, encWrkFilename, encDstFilename)
 }
+
+func TestChunkSequence(t *testing.T) {
+	kc, err := secure.GenerateKeyContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kc.Destroy()
+
+	encrypt := func(plaintext []byte) [][]byte {
+		var encrypted bytes.Buffer
+		if _, err := stream.Encrypt(context.Background(), kc, bytes.NewReader(plaintext), &encrypted); err != nil {
+			t.Fatal(err)
+		}
+		var chunks [][]byte
+		for data := encrypted.Bytes(); len(data) > 0; {
+			n := stream.DecryptionChunkSize
+			if n > len(data) {
+				n = len(data)
+			}
+			chunks = append(chunks, data[:n])
+			data = data[n:]
+		}
+		return chunks
+	}
+	decrypt := func(chunks ...[]byte) ([]byte, error) {
+		var decrypted bytes.Buffer
+		_, err := stream.Decrypt(context.Background(), kc, bytes.NewReader(bytes.Join(chunks, nil)), &decrypted)
+		return decrypted.Bytes(), err
+	}
+
+	plaintext := bytes.Repeat([]byte("s"), 4*stream.EncryptionChunkSize) // four whole chunks, however many follow
+	chunks := encrypt(plaintext)
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, received %d", len(chunks))
+	}
+	if decrypted, err := decrypt(chunks...); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("expected chunks in order to decrypt, received %v", err)
+	}
+	if decrypted, err := decrypt(encrypt(nil)...); err != nil || len(decrypted) != 0 {
+		t.Errorf("expected empty data to decrypt, received %d bytes, %v", len(decrypted), err)
+	}
+
+	for name, tampered := range map[string][][]byte{
+		"reordered":      {chunks[0], chunks[2], chunks[1], chunks[3]},
+		"dropped":        {chunks[0], chunks[1], chunks[3]},
+		"missing first":  {chunks[1], chunks[2], chunks[3]},
+		"cut off":        {chunks[0], chunks[1], chunks[2]},
+		"followed":       {chunks[0], chunks[1], chunks[2], chunks[3], chunks[3]},
+		"another stream": {chunks[0], encrypt(plaintext)[1], chunks[2], chunks[3]},
+	} {
+		if _, err := decrypt(tampered...); err != stream.ErrChunkSequence {
+			t.Errorf("%s: expected %v, received %v", name, stream.ErrChunkSequence, err)
+		}
+	}
+}
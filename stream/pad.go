@@ -0,0 +1,192 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Padding is a scheme for padding data before it is encrypted, so the size of what is
+// stored says little about the size of what was
+// Padded data ends in a marker byte followed by zeros; encrypting it authenticates the
+// padding along with the data, and Unpad refuses any that is not exactly as the scheme pads
+type Padding int
+
+const (
+
+	// NoPadding leaves data exactly as it is, without even a marker
+	NoPadding Padding = iota
+
+	// Padme rounds sizes up so only their top bits remain, at most 12% larger
+	// see https://lbarman.ch/blog/padme/
+	Padme
+
+	// PowerOfTwo rounds sizes up to the next power of two, up to twice as large
+	PowerOfTwo
+)
+
+// MinPaddedSize is the least any scheme but NoPadding pads data to
+const MinPaddedSize = 256
+
+const padMarker = 0x80
+
+var (
+
+	// ErrPadding is an error that occurred while removing padding
+	ErrPadding = errors.New("pad: data is not padded as expected")
+
+	zeros = make([]byte, 32*1024)
+)
+
+// Size returns how large length bytes of data are once padded, marker included
+func (padding Padding) Size(length int64) int64 {
+	if padding == NoPadding {
+		return length
+	}
+	length++
+	if length < MinPaddedSize {
+		return MinPaddedSize
+	}
+
+	switch padding {
+	case Padme:
+		exponent := bits.Len64(uint64(length)) - 1
+		mask := int64(1)<<uint(exponent-bits.Len64(uint64(exponent))) - 1
+		return (length + mask) &^ mask
+	case PowerOfTwo:
+		return 1 << uint(bits.Len64(uint64(length-1)))
+	}
+	return length
+}
+
+func (padding Padding) validate() error {
+	if padding < NoPadding || padding > PowerOfTwo {
+		return fmt.Errorf("pad: unknown padding scheme %d", padding)
+	}
+	return nil
+}
+
+// Pad copies r to w, then pads it as padding describes
+func Pad(padding Padding, r io.Reader, w io.Writer) (int64, error) {
+	if err := padding.validate(); err != nil {
+		return 0, err
+	}
+
+	length, err := io.Copy(w, r)
+	if err != nil || padding == NoPadding {
+		return length, err
+	}
+	if _, err := w.Write([]byte{padMarker}); err != nil {
+		return 0, err
+	}
+	if err := writeZeros(w, padding.Size(length)-length-1); err != nil {
+		return 0, err
+	}
+	return padding.Size(length), nil
+}
+
+// Unpad copies data padded by Pad with the same padding from r to w, leaving its padding behind
+// Holds back no more than the marker and a count of zeros following it, so any size of data streams through
+func Unpad(padding Padding, r io.Reader, w io.Writer) (int64, error) {
+	if err := padding.validate(); err != nil {
+		return 0, err
+	}
+	if padding == NoPadding {
+		return io.Copy(w, r)
+	}
+
+	var (
+		chunk   = make([]byte, 32*1024)
+		data    = make([]byte, 0, len(chunk))
+		marked  bool  // a marker is held back, which may end the data
+		held    int64 // zeros held back since the marker
+		written int64
+	)
+	flush := func() error {
+		n, err := w.Write(data)
+		written += int64(n)
+		data = data[:0]
+		return err
+	}
+	release := func() error { // the held back marker and zeros were data after all
+		data = append(data, padMarker)
+		if err := flush(); err != nil {
+			return err
+		}
+		if err := writeZeros(w, held); err != nil {
+			return err
+		}
+		written += held
+		marked, held = false, 0
+		return nil
+	}
+
+	for {
+		length, readErr := r.Read(chunk)
+		for _, b := range chunk[:length] {
+			switch {
+			case marked && b == 0:
+				held++
+				continue
+			case marked:
+				if err := release(); err != nil {
+					return 0, err
+				}
+			}
+			if b == padMarker {
+				marked = true
+			} else {
+				data = append(data, b)
+			}
+		}
+		if err := flush(); err != nil {
+			return 0, err
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return 0, readErr
+		}
+	}
+
+	if !marked || padding.Size(written) != written+1+held {
+		return 0, ErrPadding
+	}
+	return written, nil
+}
+
+// PadBytes returns data padded as padding describes
+func PadBytes(padding Padding, data []byte) ([]byte, error) {
+	var padded bytes.Buffer
+	if _, err := Pad(padding, bytes.NewReader(data), &padded); err != nil {
+		return nil, err
+	}
+	return padded.Bytes(), nil
+}
+
+// UnpadBytes returns data padded by PadBytes with the same padding, its padding removed
+func UnpadBytes(padding Padding, padded []byte) ([]byte, error) {
+	var data bytes.Buffer
+	if _, err := Unpad(padding, bytes.NewReader(padded), &data); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+func writeZeros(w io.Writer, count int64) error {
+	for count > 0 {
+		n := int64(len(zeros))
+		if count < n {
+			n = count
+		}
+		if _, err := w.Write(zeros[:n]); err != nil {
+			return err
+		}
+		count -= n
+	}
+	return nil
+}
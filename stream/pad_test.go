@@ -0,0 +1,64 @@
+package stream_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jonathan-robertson/lockedarchive/stream"
+)
+
+func TestPadding(t *testing.T) {
+	t.Run("Size", func(t *testing.T) {
+		for _, test := range []struct {
+			padding  stream.Padding
+			length   int64
+			expected int64
+		}{
+			{stream.NoPadding, 1000, 1000},
+			{stream.Padme, 10, stream.MinPaddedSize},
+			{stream.Padme, 999, 1024},
+			{stream.Padme, 1024, 1088},
+			{stream.Padme, 9999999, 10223616},
+			{stream.PowerOfTwo, 10, stream.MinPaddedSize},
+			{stream.PowerOfTwo, 1023, 1024},
+			{stream.PowerOfTwo, 1024, 2048},
+		} {
+			if size := test.padding.Size(test.length); size != test.expected {
+				t.Errorf("expected %d bytes under scheme %d to pad to %d, received %d", test.length, test.padding, test.expected, size)
+			}
+		}
+	})
+
+	// Data ending as padding does must still come back whole
+	data := append(bytes.Repeat([]byte("a 1-page scan "), 100), 0x80, 0, 0, 0x80, 0)
+	for _, padding := range []stream.Padding{stream.NoPadding, stream.Padme, stream.PowerOfTwo} {
+		padded, err := stream.PadBytes(padding, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(padded)) != padding.Size(int64(len(data))) {
+			t.Errorf("expected scheme %d to pad %d bytes to %d, received %d", padding, len(data), padding.Size(int64(len(data))), len(padded))
+		}
+		unpadded, err := stream.UnpadBytes(padding, padded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyBytesEqual(t, data, unpadded)
+	}
+
+	t.Run("Malformed", func(t *testing.T) {
+		padded, err := stream.PadBytes(stream.PowerOfTwo, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, malformed := range map[string][]byte{
+			"truncated": padded[:len(padded)-1],
+			"extended":  append(append([]byte(nil), padded...), 0),
+			"unmarked":  bytes.Repeat([]byte{0}, len(padded)),
+		} {
+			if _, err := stream.UnpadBytes(stream.PowerOfTwo, malformed); err != stream.ErrPadding {
+				t.Errorf("expected %s padding to fail with ErrPadding, received %v", name, err)
+			}
+		}
+	})
+}